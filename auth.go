@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// authentication and metric ACLs
+//
+// With -api-keys, -htpasswd or -trusted-user-header given, render, find and
+// info requests must say who they are from, or get a 401.  With -acl, each
+// user may only see the series under their glob prefixes, plus those under
+// the prefixes given to the user "*", which everyone may see.
+
+var ErrBadCredentials = errors.New("bad credentials")
+
+type authenticator interface {
+	// authenticate returns the user making r, or "" if r has no
+	// credentials of this kind
+	authenticate(r *http.Request) (string, error)
+}
+
+// authenticators are tried in turn; if there are none, anyone may ask
+var authenticators []authenticator
+
+// metricACLs are the series each user may see; nil means all of them
+var metricACLs map[string][]*aclPattern
+
+// apiKeys map the keys sent in the X-Api-Key header to users
+type apiKeys map[string]string
+
+func (k apiKeys) authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		return "", nil
+	}
+	if user, ok := k[key]; ok {
+		return user, nil
+	}
+	return "", ErrBadCredentials
+}
+
+// htpasswd maps users to their passwords, as {SHA} hashes or plain text,
+// checked against basic auth
+type htpasswd map[string]string
+
+func (h htpasswd) authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil
+	}
+
+	hash, ok := h[user]
+	if !ok {
+		return "", ErrBadCredentials
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		password = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	if subtle.ConstantTimeCompare([]byte(password), []byte(hash)) != 1 {
+		return "", ErrBadCredentials
+	}
+
+	return user, nil
+}
+
+// trustedProxy takes the user from a header set by an authenticating proxy,
+// if the request comes from one of the proxy's networks
+type trustedProxy struct {
+	header  string
+	proxies []*net.IPNet
+}
+
+func (p trustedProxy) authenticate(r *http.Request) (string, error) {
+	user := r.Header.Get(p.header)
+	if user == "" {
+		return "", nil
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	for _, n := range p.proxies {
+		if ip != nil && n.Contains(ip) {
+			return user, nil
+		}
+	}
+
+	// anyone can set the header
+	return "", nil
+}
+
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// authenticateRequest returns the user making r.  If r can't be
+// authenticated, it writes a 401 and returns false.
+func authenticateRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+
+	if len(authenticators) == 0 {
+		return "", true
+	}
+
+	for _, a := range authenticators {
+		user, err := a.authenticate(r)
+		if err != nil {
+			break
+		}
+		if user != "" {
+			return user, true
+		}
+	}
+
+	Metrics.AuthFailures.Add(1)
+
+	for _, a := range authenticators {
+		if _, ok := a.(htpasswd); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="carbonapi"`)
+		}
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return "", false
+}
+
+// aclPattern is a glob prefix, and the globs of its leading nodes, which
+// match the branches leading to it
+type aclPattern struct {
+	pattern  *glob
+	branches []*glob
+}
+
+func parseACLPattern(s string) (*aclPattern, error) {
+	p, err := parseGlob(s)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &aclPattern{pattern: p}
+
+	nodes := splitGlobNodes(s)
+	for i := 1; i < len(nodes); i++ {
+		b, err := parseGlob(strings.Join(nodes[:i], "."))
+		if err != nil {
+			return nil, err
+		}
+		acl.branches = append(acl.branches, b)
+	}
+
+	return acl, nil
+}
+
+// splitGlobNodes splits s at the dots outside braces
+func splitGlobNodes(s string) []string {
+	var nodes []string
+	var depth, start int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '.':
+			if depth == 0 {
+				nodes = append(nodes, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(nodes, s[start:])
+}
+
+// allows reports whether path is under the prefix, or for a branch,
+// whether it leads to it
+func (a *aclPattern) allows(path string, leaf bool) bool {
+	if a.pattern.matchPrefix(path) {
+		return true
+	}
+
+	if leaf {
+		return false
+	}
+
+	n := strings.Count(path, ".")
+	return n < len(a.branches) && a.branches[n].match(path)
+}
+
+// aclAllows reports whether user may see path
+func aclAllows(user, path string, leaf bool) bool {
+	if metricACLs == nil {
+		return true
+	}
+
+	for _, u := range []string{user, "*"} {
+		for _, a := range metricACLs[u] {
+			if a.allows(path, leaf) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// readAuthFile calls fn with the fields of each line of r, split at sep.
+// Blank lines and lines starting with # are ignored.
+func readAuthFile(r io.Reader, sep string, fn func(fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+
+		var fields []string
+		if sep == "" {
+			fields = strings.Fields(l)
+		} else {
+			fields = strings.SplitN(l, sep, 2)
+		}
+
+		if err := fn(fields); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// readAPIKeys reads `key user' lines
+func readAPIKeys(r io.Reader) (apiKeys, error) {
+	keys := make(apiKeys)
+	err := readAuthFile(r, "", func(fields []string) error {
+		if len(fields) != 2 {
+			return errors.New("expected key user")
+		}
+		keys[fields[0]] = fields[1]
+		return nil
+	})
+	return keys, err
+}
+
+// readHtpasswd reads `user:password' lines
+func readHtpasswd(r io.Reader) (htpasswd, error) {
+	h := make(htpasswd)
+	err := readAuthFile(r, ":", func(fields []string) error {
+		if len(fields) != 2 || fields[0] == "" {
+			return errors.New("expected user:password")
+		}
+		if strings.HasPrefix(fields[1], "$") {
+			return fmt.Errorf("unsupported password hash for %s, use {SHA} (htpasswd -s)", fields[0])
+		}
+		h[fields[0]] = fields[1]
+		return nil
+	})
+	return h, err
+}
+
+// readACLs reads `user prefix...' lines
+func readACLs(r io.Reader) (map[string][]*aclPattern, error) {
+	acls := make(map[string][]*aclPattern)
+	err := readAuthFile(r, "", func(fields []string) error {
+		if len(fields) < 2 {
+			return errors.New("expected user prefix...")
+		}
+		for _, f := range fields[1:] {
+			p, err := parseACLPattern(f)
+			if err != nil {
+				return fmt.Errorf("%s: %v", f, err)
+			}
+			acls[fields[0]] = append(acls[fields[0]], p)
+		}
+		return nil
+	})
+	return acls, err
+}
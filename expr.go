@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"regexp"
 	"sort"
 	"strconv"
@@ -35,8 +36,12 @@ type expr struct {
 	etype     exprType
 	val       float64
 	valStr    string
-	args      []*expr
+	args      []*expr          // positional arguments
+	namedArgs map[string]*expr // keyword arguments, name=value
 	argString string
+
+	// the node's byte offsets in the target, for error messages
+	pos, end int
 }
 
 type metricRequest struct {
@@ -46,6 +51,12 @@ type metricRequest struct {
 }
 
 func (e *expr) metrics() []metricRequest {
+	return e.bootstrapMetrics(nil)
+}
+
+// bootstrapMetrics is metrics() once the step of each fetched metric is
+// known, which lets windows given in points ask for data from before `from'
+func (e *expr) bootstrapMetrics(steps map[string]int32) []metricRequest {
 
 	switch e.etype {
 	case etName:
@@ -55,10 +66,16 @@ func (e *expr) metrics() []metricRequest {
 	case etFunc:
 		var r []metricRequest
 		for _, a := range e.args {
-			r = append(r, a.metrics()...)
+			r = append(r, a.bootstrapMetrics(steps)...)
+		}
+		for _, a := range e.namedArgs {
+			r = append(r, a.bootstrapMetrics(steps)...)
 		}
 
 		switch e.target {
+		case "identity", "timeFunction", "sinFunction", "randomWalk":
+			// generated from from and until, there's nothing to fetch
+			return nil
 		case "timeShift":
 			offs, err := getIntervalArg(e, 1, -1)
 			if err != nil {
@@ -68,7 +85,33 @@ func (e *expr) metrics() []metricRequest {
 				r[i].from += offs
 				r[i].until += offs
 			}
-		case "holtWintersForecast":
+		case "movingAverage", "movingSum", "movingMin", "movingMax", "movingWindow", "movingMedian", "exponentialMovingAverage", "stdev", "stddev", "tukeyAbove":
+			// windows need data from before the start of the graph
+			points, seconds, err := getWindowArg(e, 1)
+			if err != nil {
+				break
+			}
+			for i := range r {
+				if step, ok := steps[r[i].metric]; ok && seconds == 0 {
+					r[i].from -= int32(points) * step
+				}
+				r[i].from -= seconds
+			}
+		case "timeStack":
+			offs, start, end, err := getTimeStackArgs(e)
+			if err != nil {
+				return nil
+			}
+			var stacked []metricRequest
+			for shift := start; shift < end; shift++ {
+				for _, m := range r {
+					m.from += offs * int32(shift)
+					m.until += offs * int32(shift)
+					stacked = append(stacked, m)
+				}
+			}
+			r = stacked
+		case "holtWintersForecast", "holtWintersConfidenceBands", "holtWintersConfidenceArea", "holtWintersAberration":
 			for i := range r {
 				r[i].from -= 7 * 86400 // starts -7 days from where the original starts
 			}
@@ -80,6 +123,41 @@ func (e *expr) metrics() []metricRequest {
 }
 
 func parseExpr(e string) (*expr, string, error) {
+	exp, rest, err := parseTerm(e, false)
+	if err == nil {
+		locate(exp, len(e))
+	}
+	return exp, rest, err
+}
+
+// parseInfixExpr parses a target which may also combine series and constants
+// with the arithmetic operators + - * / and parentheses, for example
+// `a.b * 100 / (c + d)'.  The operators are rewritten into the equivalent
+// graphite functions.  Since '-' and '*' are valid in metric names, operators
+// must be separated from names by spaces.
+func parseInfixExpr(e string) (*expr, string, error) {
+	exp, rest, err := parseInfix(e, 0)
+	if err == nil {
+		locate(exp, len(e))
+	}
+	return exp, rest, err
+}
+
+// While parsing, pos and end hold the length of the input left at the start
+// and the end of each node, as the parser only ever sees what's left of the
+// target.  locate turns them into offsets from the start of the target.
+func locate(e *expr, n int) {
+	e.pos = n - e.pos
+	e.end = n - e.end
+	for _, a := range e.args {
+		locate(a, n)
+	}
+	for _, a := range e.namedArgs {
+		locate(a, n)
+	}
+}
+
+func parseTerm(e string, infix bool) (*expr, string, error) {
 
 	// skip whitespace
 	for len(e) > 1 && e[0] == ' ' {
@@ -90,14 +168,16 @@ func parseExpr(e string) (*expr, string, error) {
 		return nil, "", ErrMissingExpr
 	}
 
+	start := len(e)
+
 	if '0' <= e[0] && e[0] <= '9' || e[0] == '-' || e[0] == '+' {
 		val, e, err := parseConst(e)
-		return &expr{val: val, etype: etConst}, e, err
+		return &expr{val: val, etype: etConst, pos: start, end: len(e)}, e, err
 	}
 
 	if e[0] == '\'' || e[0] == '"' {
 		val, e, err := parseString(e)
-		return &expr{valStr: val, etype: etString}, e, err
+		return &expr{valStr: val, etype: etString, pos: start, end: len(e)}, e, err
 	}
 
 	name, e := parseName(e)
@@ -107,16 +187,18 @@ func parseExpr(e string) (*expr, string, error) {
 	}
 
 	if e != "" && e[0] == '(' {
-		exp := &expr{target: name, etype: etFunc}
+		exp := &expr{target: name, etype: etFunc, pos: start}
 
-		argString, args, e, err := parseArgList(e)
+		argString, args, namedArgs, e, err := parseArgList(e, infix)
 		exp.argString = argString
 		exp.args = args
+		exp.namedArgs = namedArgs
+		exp.end = len(e)
 
 		return exp, e, err
 	}
 
-	return &expr{target: name}, e, nil
+	return &expr{target: name, pos: start, end: len(e)}, e, nil
 }
 
 var (
@@ -124,11 +206,17 @@ var (
 	ErrMissingComma        = errors.New("missing comma")
 	ErrMissingQuote        = errors.New("missing quote")
 	ErrUnexpectedCharacter = errors.New("unexpected character")
+	ErrMissingParen        = errors.New("missing closing paren")
+	ErrDivisionByZero      = errors.New("division by zero")
+	ErrConstantOverflow    = errors.New("constant out of range")
+	ErrPositionalAfterName = errors.New("positional argument follows keyword argument")
+	ErrDuplicateKeyword    = errors.New("keyword argument repeated")
 )
 
-func parseArgList(e string) (string, []*expr, string, error) {
+func parseArgList(e string, infix bool) (string, []*expr, map[string]*expr, string, error) {
 
 	var args []*expr
+	var namedArgs map[string]*expr
 
 	if e[0] != '(' {
 		panic("arg list should start with paren")
@@ -138,31 +226,81 @@ func parseArgList(e string) (string, []*expr, string, error) {
 
 	e = e[1:]
 
+	// a call may have no arguments at all, as countSeries() may
+	if e != "" && e[0] == ')' {
+		return "", nil, nil, e[1:], nil
+	}
+
 	for {
+		name, rest, isKeyword := parseKeyword(e)
+		if isKeyword {
+			e = rest
+		}
+
 		var arg *expr
 		var err error
-		arg, e, err = parseExpr(e)
+		if infix {
+			arg, e, err = parseInfix(e, 0)
+		} else {
+			arg, e, err = parseTerm(e, false)
+		}
 		if err != nil {
-			return "", nil, e, err
+			return "", nil, nil, e, err
+		}
+
+		switch {
+		case isKeyword:
+			if namedArgs == nil {
+				namedArgs = make(map[string]*expr)
+			}
+			if _, ok := namedArgs[name]; ok {
+				return "", nil, nil, e, ErrDuplicateKeyword
+			}
+			namedArgs[name] = arg
+		case namedArgs != nil:
+			return "", nil, nil, e, ErrPositionalAfterName
+		default:
+			args = append(args, arg)
 		}
-		args = append(args, arg)
 
 		if e == "" {
-			return "", nil, "", ErrMissingComma
+			return "", nil, nil, "", ErrMissingComma
 		}
 
 		if e[0] == ')' {
-			return argString[:len(argString)-len(e)], args, e[1:], nil
+			return argString[:len(argString)-len(e)], args, namedArgs, e[1:], nil
 		}
 
 		if e[0] != ',' && e[0] != ' ' {
-			return "", nil, "", ErrUnexpectedCharacter
+			return "", nil, nil, "", ErrUnexpectedCharacter
 		}
 
 		e = e[1:]
 	}
 }
 
+// parseKeyword recognises the `name=' of a keyword argument
+func parseKeyword(e string) (string, string, bool) {
+
+	e = strings.TrimLeft(e, " ")
+
+	var i int
+	for i < len(e) && (e[i] == '_' || 'a' <= e[i] && e[i] <= 'z' || 'A' <= e[i] && e[i] <= 'Z' || i > 0 && isDigit(e[i])) {
+		i++
+	}
+
+	if i == 0 {
+		return "", "", false
+	}
+
+	rest := strings.TrimLeft(e[i:], " ")
+	if rest == "" || rest[0] != '=' || len(rest) > 1 && rest[1] == '=' {
+		return "", "", false
+	}
+
+	return e[:i], rest[1:], true
+}
+
 func isNameChar(r byte) bool {
 	return false ||
 		'a' <= r && r <= 'z' ||
@@ -200,6 +338,14 @@ func parseName(s string) (string, string) {
 FOR:
 	for braces := 0; i < len(s); i++ {
 
+		if s[i] == '[' {
+			// character classes may contain anything up to the closing bracket
+			if end := globGroupEnd(s, i); end != -1 {
+				i = end - 1
+				continue
+			}
+		}
+
 		if isNameChar(s[i]) {
 			continue
 		}
@@ -253,46 +399,360 @@ func parseString(s string) (string, string, error) {
 	return s[:i], s[i+1:], nil
 }
 
+var infixPrecedence = map[byte]int{
+	'+': 1,
+	'-': 1,
+	'*': 2,
+	'/': 2,
+}
+
+// parseInfix parses operands joined by operators binding at least as tightly
+// as minPrec
+func parseInfix(e string, minPrec int) (*expr, string, error) {
+
+	left, e, err := parseInfixOperand(e)
+	if err != nil {
+		return nil, e, err
+	}
+
+	for {
+		rest := strings.TrimLeft(e, " ")
+		if rest == "" {
+			return left, e, nil
+		}
+
+		op := rest[0]
+		prec, ok := infixPrecedence[op]
+		if !ok || prec < minPrec {
+			return left, e, nil
+		}
+
+		var right *expr
+		right, e, err = parseInfix(rest[1:], prec+1)
+		if err != nil {
+			return nil, e, err
+		}
+
+		var exp *expr
+		exp, err = infixExpr(op, left, right)
+		if err != nil {
+			return nil, e, err
+		}
+
+		// the nodes standing in for the operator span both operands
+		spanInfix(exp, left, right, left.pos, right.end)
+		left = exp
+	}
+}
+
+func parseInfixOperand(e string) (*expr, string, error) {
+
+	e = strings.TrimLeft(e, " ")
+
+	if e == "" || e[0] != '(' {
+		return parseTerm(e, true)
+	}
+
+	exp, e, err := parseInfix(e[1:], 0)
+	if err != nil {
+		return nil, e, err
+	}
+
+	e = strings.TrimLeft(e, " ")
+	if e == "" || e[0] != ')' {
+		return nil, e, ErrMissingParen
+	}
+
+	return exp, e[1:], nil
+}
+
+// infixExpr rewrites `left op right' into the function calls with the same
+// meaning.  Constant operands become arguments to scale() and offset().
+func infixExpr(op byte, left, right *expr) (*expr, error) {
+	exp, err := foldInfix(op, left, right)
+	if err != nil {
+		return nil, err
+	}
+
+	// infinite constants couldn't be written out in the canonical target
+	if !finiteConstants(exp) {
+		return nil, ErrConstantOverflow
+	}
+
+	return exp, nil
+}
+
+func foldInfix(op byte, left, right *expr) (*expr, error) {
+
+	if left.etype == etString || right.etype == etString {
+		return nil, ErrBadType
+	}
+
+	if op == '/' && right.etype == etConst && right.val == 0 {
+		return nil, ErrDivisionByZero
+	}
+
+	switch {
+	case left.etype == etConst && right.etype == etConst:
+		var v float64
+		switch op {
+		case '+':
+			v = left.val + right.val
+		case '-':
+			v = left.val - right.val
+		case '*':
+			v = left.val * right.val
+		case '/':
+			v = left.val / right.val
+		}
+		return &expr{val: v, etype: etConst}, nil
+
+	case right.etype == etConst:
+		switch op {
+		case '+':
+			return funcExpr("offset", left, right), nil
+		case '-':
+			return funcExpr("offset", left, constExpr(-right.val)), nil
+		case '*':
+			return funcExpr("scale", left, right), nil
+		case '/':
+			return funcExpr("scale", left, constExpr(1/right.val)), nil
+		}
+
+	case left.etype == etConst:
+		switch op {
+		case '+':
+			return funcExpr("offset", right, left), nil
+		case '-':
+			return funcExpr("offset", funcExpr("scale", right, constExpr(-1)), left), nil
+		case '*':
+			return funcExpr("scale", right, left), nil
+		case '/':
+			return funcExpr("scale", funcExpr("invert", right), left), nil
+		}
+	}
+
+	switch op {
+	case '+':
+		return funcExpr("sumSeries", left, right), nil
+	case '-':
+		return funcExpr("diffSeries", left, right), nil
+	case '*':
+		return funcExpr("multiplySeries", left, right), nil
+	case '/':
+		return funcExpr("divideSeries", left, right), nil
+	}
+
+	return nil, ErrUnexpectedCharacter
+}
+
+// finiteConstants reports whether all the constants in e are finite
+func finiteConstants(e *expr) bool {
+	if e.etype == etConst {
+		return !math.IsInf(e.val, 0) && !math.IsNaN(e.val)
+	}
+	for _, a := range e.args {
+		if !finiteConstants(a) {
+			return false
+		}
+	}
+	return true
+}
+
+func spanInfix(e, left, right *expr, pos, end int) {
+	if e == left || e == right {
+		return
+	}
+	e.pos, e.end = pos, end
+	for _, a := range e.args {
+		spanInfix(a, left, right, pos, end)
+	}
+}
+
+func constExpr(v float64) *expr {
+	return &expr{val: v, etype: etConst}
+}
+
+// funcExpr builds a function call, with the argString it would have had if
+// it had been written out in the target
+func funcExpr(target string, args ...*expr) *expr {
+	var s []string
+	for _, a := range args {
+		s = append(s, exprString(a))
+	}
+	return &expr{target: target, etype: etFunc, args: args, argString: strings.Join(s, ",")}
+}
+
+func exprString(e *expr) string {
+	switch e.etype {
+	case etConst:
+		return strconv.FormatFloat(e.val, 'g', -1, 64)
+	case etString:
+		return "'" + e.valStr + "'"
+	case etFunc:
+		return e.target + "(" + e.argString + ")"
+	}
+	return e.target
+}
+
+// String prints e as a canonical target: no whitespace, constants in their
+// shortest form, strings in single quotes where possible and keyword
+// arguments sorted by name.  Parsing the result gives back the same tree, as
+// parsing and folding infix constants never leave one that isn't finite.
+func (e *expr) String() string {
+	switch e.etype {
+	case etConst:
+		return strconv.FormatFloat(e.val, 'g', -1, 64)
+	case etString:
+		if strings.IndexByte(e.valStr, '\'') != -1 {
+			return `"` + e.valStr + `"`
+		}
+		return "'" + e.valStr + "'"
+	case etFunc:
+		var args []string
+		for _, a := range e.args {
+			args = append(args, a.String())
+		}
+		var names []string
+		for k := range e.namedArgs {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			args = append(args, k+"="+e.namedArgs[k].String())
+		}
+		return e.target + "(" + strings.Join(args, ",") + ")"
+	}
+	return e.target
+}
+
 var (
 	ErrBadType           = errors.New("bad type")
 	ErrMissingArgument   = errors.New("missing argument")
 	ErrMissingTimeseries = errors.New("missing time series")
 )
 
+// getArg returns argument n of e, given either by position or by the name
+// graphite-web uses for it.  It returns nil if the argument wasn't given.
+func getArg(e *expr, n int) *expr {
+	if n < len(e.args) {
+		return e.args[n]
+	}
+
+	if name := paramName(e.target, n); name != "" {
+		return e.namedArgs[name]
+	}
+
+	return nil
+}
+
+// bindNamedArgs moves the keyword arguments which directly follow the
+// positional ones into e.args, where code that counts arguments expects them
+func bindNamedArgs(e *expr) {
+	for len(e.namedArgs) > 0 {
+		name := paramName(e.target, len(e.args))
+		a, ok := e.namedArgs[name]
+		if !ok {
+			return
+		}
+		delete(e.namedArgs, name)
+		e.args = append(e.args, a)
+	}
+}
+
 func getStringArg(e *expr, n int) (string, error) {
-	if len(e.args) <= n {
+	a := getArg(e, n)
+	if a == nil {
 		return "", ErrMissingArgument
 	}
 
-	if e.args[n].etype != etString {
+	if a.etype != etString {
 		return "", ErrBadType
 	}
 
-	return e.args[n].valStr, nil
+	return a.valStr, nil
 }
 
 func getStringArgDefault(e *expr, n int, s string) (string, error) {
-	if len(e.args) <= n {
+	a := getArg(e, n)
+	if a == nil {
 		return s, nil
 	}
 
-	if e.args[n].etype != etString {
+	if a.etype != etString {
 		return "", ErrBadType
 	}
 
-	return e.args[n].valStr, nil
+	return a.valStr, nil
 }
 
-func getIntervalArg(e *expr, n int, defaultSign int) (int32, error) {
+func getStringArgs(e *expr, n int) ([]string, error) {
+
 	if len(e.args) <= n {
+		return nil, ErrMissingArgument
+	}
+
+	var strs []string
+
+	for i := n; i < len(e.args); i++ {
+		a, err := getStringArg(e, i)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, a)
+	}
+
+	return strs, nil
+}
+
+// getNameArg returns the name given to a generated series, which may be
+// written without quotes
+func getNameArg(e *expr, n int) (string, error) {
+	a := getArg(e, n)
+	if a == nil {
+		return "", ErrMissingArgument
+	}
+
+	if a.etype == etName {
+		return a.target, nil
+	}
+
+	return getStringArg(e, n)
+}
+
+// getRegexpArg returns a regular expression argument, in python's syntax
+// like graphite-web
+func getRegexpArg(e *expr, n int) (*regexp.Regexp, error) {
+	pattern, err := getStringArg(e, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return compilePythonRegexp(pattern)
+}
+
+// getReplacementArg returns the replacement for a regexp argument, which may
+// use python's \1 and \g<name> backreferences
+func getReplacementArg(e *expr, n int) (string, error) {
+	replace, err := getStringArg(e, n)
+	if err != nil {
+		return "", err
+	}
+
+	return pythonReplacement(replace), nil
+}
+
+func getIntervalArg(e *expr, n int, defaultSign int) (int32, error) {
+	a := getArg(e, n)
+	if a == nil {
 		return 0, ErrMissingArgument
 	}
 
-	if e.args[n].etype != etString {
+	if a.etype != etString {
 		return 0, ErrBadType
 	}
 
-	seconds, err := intervalString(e.args[n].valStr, defaultSign)
+	seconds, err := intervalString(a.valStr, defaultSign)
 	if err != nil {
 		return 0, ErrBadType
 	}
@@ -300,40 +760,115 @@ func getIntervalArg(e *expr, n int, defaultSign int) (int32, error) {
 	return seconds, nil
 }
 
+func getIntervalArgDefault(e *expr, n int, defaultSign int, v int32) (int32, error) {
+	if getArg(e, n) == nil {
+		return v, nil
+	}
+
+	return getIntervalArg(e, n, defaultSign)
+}
+
+// getTimeStackArgs returns the shift unit and the [start, end) range of
+// shifts for timeStack(seriesList, timeShiftUnit='1d', timeShiftStart=0, timeShiftEnd=7)
+func getTimeStackArgs(e *expr) (int32, int, int, error) {
+	offs, err := getIntervalArgDefault(e, 1, -1, -86400)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	start, err := getIntArgDefault(e, 2, 0)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	end, err := getIntArgDefault(e, 3, 7)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return offs, start, end, nil
+}
+
+// getWindowArg returns a window size argument, which is either a number of
+// points or an interval string.  Intervals are returned in seconds.
+func getWindowArg(e *expr, n int) (int, int32, error) {
+	a := getArg(e, n)
+	if a == nil {
+		return 0, 0, ErrMissingArgument
+	}
+
+	switch a.etype {
+	case etConst:
+		points, err := getIntArg(e, n)
+		return points, 0, err
+	case etString:
+		seconds, err := getIntervalArg(e, n, 1)
+		return 0, seconds, err
+	}
+
+	return 0, 0, ErrBadType
+}
+
+// windowPoints converts a window from getWindowArg to a number of points
+func windowPoints(points int, seconds int32, step int32) int {
+	if seconds == 0 || step == 0 {
+		return points
+	}
+	return int(seconds / step)
+}
+
 func getFloatArg(e *expr, n int) (float64, error) {
-	if len(e.args) <= n {
+	a := getArg(e, n)
+	if a == nil {
 		return 0, ErrMissingArgument
 	}
 
-	if e.args[n].etype != etConst {
+	if a.etype != etConst {
 		return 0, ErrBadType
 	}
 
-	return e.args[n].val, nil
+	return a.val, nil
 }
 
 func getFloatArgDefault(e *expr, n int, v float64) (float64, error) {
-	if len(e.args) <= n {
+	a := getArg(e, n)
+	if a == nil || isNone(a) {
 		return v, nil
 	}
 
-	if e.args[n].etype != etConst {
+	if a.etype != etConst {
 		return 0, ErrBadType
 	}
 
-	return e.args[n].val, nil
+	return a.val, nil
+}
+
+// isNone reports whether a is python's None, which leaves an optional
+// argument at its default
+func isNone(a *expr) bool {
+	return a.etype == etName && a.target == "None"
+}
+
+// numberArgName is how the numeric argument a, of value v, is shown in the
+// names of series: a None stays None rather than showing its default
+func numberArgName(a *expr, v float64) string {
+	if isNone(a) {
+		return "None"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
 }
 
 func getIntArg(e *expr, n int) (int, error) {
-	if len(e.args) <= n {
+	a := getArg(e, n)
+	if a == nil {
 		return 0, ErrMissingArgument
 	}
 
-	if e.args[n].etype != etConst {
+	if a.etype != etConst {
 		return 0, ErrBadType
 	}
 
-	return int(e.args[n].val), nil
+	return int(a.val), nil
 }
 
 func getIntArgs(e *expr, n int) ([]int, error) {
@@ -356,28 +891,30 @@ func getIntArgs(e *expr, n int) ([]int, error) {
 }
 
 func getIntArgDefault(e *expr, n int, d int) (int, error) {
-	if len(e.args) <= n {
+	a := getArg(e, n)
+	if a == nil || isNone(a) {
 		return d, nil
 	}
 
-	if e.args[n].etype != etConst {
+	if a.etype != etConst {
 		return 0, ErrBadType
 	}
 
-	return int(e.args[n].val), nil
+	return int(a.val), nil
 }
 
 func getBoolArgDefault(e *expr, n int, b bool) (bool, error) {
-	if len(e.args) <= n {
+	a := getArg(e, n)
+	if a == nil {
 		return b, nil
 	}
 
-	if e.args[n].etype != etName {
+	if a.etype != etName {
 		return false, ErrBadType
 	}
 
 	// names go into 'target'
-	switch e.args[n].target {
+	switch a.target {
 	case "False", "false":
 		return false, nil
 	case "True", "true":
@@ -387,12 +924,12 @@ func getBoolArgDefault(e *expr, n int, b bool) (bool, error) {
 	return false, ErrBadType
 }
 
-func getSeriesArg(arg *expr, from, until int32, values map[metricRequest][]*metricData) ([]*metricData, error) {
+func getSeriesArg(arg *expr, from, until int32, values map[metricRequest][]*metricData, fetch *fetchContext) ([]*metricData, error) {
 
 	if arg.etype != etName && arg.etype != etFunc {
 		return nil, ErrMissingTimeseries
 	}
-	a := evalExpr(arg, from, until, values)
+	a := evalExpr(arg, from, until, values, fetch)
 
 	if len(a) == 0 {
 		return nil, ErrMissingTimeseries
@@ -401,12 +938,12 @@ func getSeriesArg(arg *expr, from, until int32, values map[metricRequest][]*metr
 	return a, nil
 }
 
-func getSeriesArgs(e []*expr, from, until int32, values map[metricRequest][]*metricData) ([]*metricData, error) {
+func getSeriesArgs(e []*expr, from, until int32, values map[metricRequest][]*metricData, fetch *fetchContext) ([]*metricData, error) {
 
 	var args []*metricData
 
 	for _, arg := range e {
-		a, err := getSeriesArg(arg, from, until, values)
+		a, err := getSeriesArg(arg, from, until, values, fetch)
 		if err != nil {
 			return nil, err
 		}
@@ -420,7 +957,31 @@ func getSeriesArgs(e []*expr, from, until int32, values map[metricRequest][]*met
 	return args, nil
 }
 
-func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData) []*metricData {
+// getWindowedSeriesArg evaluates arg along with the data from before `from'
+// needed to fill the first window, and reports whether that data was there.
+// Windows given in points are looked up using the step of the unbootstrapped
+// series, the same way bootstrapMetrics requested them.
+func getWindowedSeriesArg(arg *expr, points int, seconds int32, from, until int32, values map[metricRequest][]*metricData, fetch *fetchContext) ([]*metricData, bool, error) {
+
+	if seconds != 0 {
+		a, err := getSeriesArg(arg, from-seconds, until, values, fetch)
+		return a, true, err
+	}
+
+	a, err := getSeriesArg(arg, from, until, values, fetch)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b, err := getSeriesArg(arg, from-int32(points)*a[0].GetStepTime(), until, values, fetch)
+	if err != nil {
+		return a, false, nil
+	}
+
+	return b, true, nil
+}
+
+func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData, fetch *fetchContext) []*metricData {
 
 	switch e.etype {
 	case etName:
@@ -430,16 +991,39 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return []*metricData{&p}
 	}
 
+	bindNamedArgs(e)
+
+	// Identical subexpressions are only evaluated once per request, even
+	// across targets.  Their results are kept in values under the canonical
+	// form of the expression, which can't be mistaken for a metric name as
+	// those have no parens.
+	memo := metricRequest{metric: e.String(), from: from, until: until}
+	if r, ok := values[memo]; ok {
+		return r
+	}
+
+	r := fetch.evalOnce(memo, func() []*metricData {
+		return evalFunction(e, from, until, values, fetch)
+	})
+	if values != nil && len(r) > 0 {
+		values[memo] = r
+	}
+
+	return r
+}
+
+func evalFunction(e *expr, from, until int32, values map[metricRequest][]*metricData, fetch *fetchContext) []*metricData {
+
 	// evaluate the function
 
-	// all functions have arguments -- check we do too
-	if len(e.args) == 0 {
+	// all functions but countSeries have arguments -- check we do too
+	if len(e.args) == 0 && e.target != "countSeries" {
 		return nil
 	}
 
 	switch e.target {
 	case "absolute": // absolute(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
 			for i, v := range a.Values {
 				if a.IsAbsent[i] {
 					r.Values[i] = 0
@@ -452,7 +1036,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		})
 
 	case "alias": // alias(seriesList, newName)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -466,9 +1050,9 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return []*metricData{&r}
 
 	case "aliasByMetric": // aliasByMetric(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
 			metric := extractMetric(a.GetName())
-			part := strings.Split(metric, ".")
+			part := splitMetric(metric)
 			r.Name = proto.String(part[len(part)-1])
 			r.Values = a.Values
 			r.IsAbsent = a.IsAbsent
@@ -476,7 +1060,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		})
 
 	case "aliasByNode": // aliasByNode(seriesList, *nodes)
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -490,8 +1074,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		for _, a := range args {
 
-			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
+			nodes, _ := metricNodesAndTags(a.GetName())
 
 			var name []string
 			for _, f := range fields {
@@ -511,23 +1094,13 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		return results
 
-	case "aliasSub": // aliasSub(seriesList, search, replace)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil
-		}
-
-		search, err := getStringArg(e, 1)
-		if err != nil {
-			return nil
-		}
-
-		replace, err := getStringArg(e, 2)
+	case "aliasTemplate": // aliasTemplate(seriesList, template)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		re, err := regexp.Compile(search)
+		template, err := getStringArg(e, 1)
 		if err != nil {
 			return nil
 		}
@@ -535,28 +1108,181 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		var results []*metricData
 
 		for _, a := range args {
-			metric := extractMetric(a.GetName())
+			nodes, tags := metricNodesAndTags(a.GetName())
 
 			r := *a
-			r.Name = proto.String(re.ReplaceAllString(metric, replace))
+			r.Name = proto.String(expandAliasTemplate(template, nodes, tags))
 			results = append(results, &r)
 		}
 
 		return results
 
-	case "asPercent": // asPercent(seriesList, total=None)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+	case "aliasQuery": // aliasQuery(seriesList, search, replace, newName)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		var getTotal func(i int) float64
-		var formatName func(a *metricData) string
+		re, err := getRegexpArg(e, 1)
+		if err != nil {
+			logger.Logf("%s: %v", e.target, err)
+			return nil
+		}
 
-		if len(e.args) == 1 {
-			getTotal = func(i int) float64 {
-				var t float64
-				var atLeastOne bool
+		replace, err := getReplacementArg(e, 2)
+		if err != nil {
+			return nil
+		}
+
+		newName, err := getStringArg(e, 3)
+		if err != nil {
+			return nil
+		}
+
+		var results []*metricData
+
+		for _, a := range args {
+			nexpr, rest, err := parseExpr(re.ReplaceAllString(a.GetName(), replace))
+			if err != nil || rest != "" {
+				continue
+			}
+
+			// the queried series wasn't known when we fetched
+			fetch.onDemand(nexpr.metrics(), from, until, values)
+
+			q := evalExpr(nexpr, from, until, values, fetch)
+			if len(q) == 0 {
+				continue
+			}
+
+			last := summarizeSeries("last", q[0])
+			if math.IsNaN(last) {
+				continue
+			}
+
+			r := *a
+			r.Name = proto.String(formatAliasQuery(newName, last))
+			results = append(results, &r)
+		}
+
+		return results
+
+	case "legendValue": // legendValue(seriesList, *valueTypes)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		valueTypes, err := getStringArgs(e, 1)
+		if err != nil {
+			return nil
+		}
+
+		var results []*metricData
+
+		for _, a := range args {
+			name := a.GetName()
+			for _, vt := range valueTypes {
+				if !isSummaryFunc(vt) {
+					continue
+				}
+				// same layout as graphite-web, so legends line up
+				name = fmt.Sprintf("%-20s%-5s%-10s", name, vt, fmt.Sprintf("%.2f", summarizeSeries(vt, a)))
+			}
+
+			r := *a
+			r.Name = proto.String(name)
+			results = append(results, &r)
+		}
+
+		return results
+
+	case "aliasSub": // aliasSub(seriesList, search, replace)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		re, err := getRegexpArg(e, 1)
+		if err != nil {
+			logger.Logf("%s: %v", e.target, err)
+			return nil
+		}
+
+		replace, err := getReplacementArg(e, 2)
+		if err != nil {
+			return nil
+		}
+
+		var results []*metricData
+
+		for _, a := range args {
+			metric := extractMetric(a.GetName())
+
+			r := *a
+			r.Name = proto.String(re.ReplaceAllString(metric, replace))
+			results = append(results, &r)
+		}
+
+		return results
+
+	case "asPercent": // asPercent(seriesList, total=None, *nodes)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		if len(e.args) > 2 {
+			nodes, err := getIntArgs(e, 2)
+			if err != nil {
+				return nil
+			}
+
+			var total []*metricData
+			switch {
+			case e.args[1].etype == etConst:
+				t, _ := getFloatArg(e, 1)
+				var results []*metricData
+				for _, a := range arg {
+					results = append(results, percentOf(a, constantSeries(fmt.Sprintf("%g", t), a, t)))
+				}
+				return results
+			case e.args[1].etype == etName && e.args[1].target == "None":
+				// each group is a percentage of its own total
+			default:
+				total, err = getSeriesArg(e.args[1], from, until, values, fetch)
+				if err != nil {
+					return nil
+				}
+			}
+
+			return asPercentByNodes(arg, total, nodes)
+		}
+
+		if len(e.args) == 2 && (e.args[1].etype == etName || e.args[1].etype == etFunc) && e.args[1].target != "None" {
+			total, err := getSeriesArg(e.args[1], from, until, values, fetch)
+			if err != nil {
+				return nil
+			}
+			if len(total) > 1 && len(total) == len(arg) {
+				// one total for each series, matched up by name
+				arg = sortedByName(arg)
+				total = sortedByName(total)
+				var results []*metricData
+				for i, a := range arg {
+					results = append(results, percentOf(a, total[i]))
+				}
+				return results
+			}
+		}
+
+		var getTotal func(i int) float64
+		var formatName func(a *metricData) string
+
+		if len(e.args) == 1 || e.args[1].etype == etName && e.args[1].target == "None" {
+			getTotal = func(i int) float64 {
+				var t float64
+				var atLeastOne bool
 				for _, a := range arg {
 					if a.IsAbsent[i] {
 						continue
@@ -583,7 +1309,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 				return fmt.Sprintf("asPercent(%s,%g)", a.GetName(), total)
 			}
 		} else if len(e.args) == 2 && (e.args[1].etype == etName || e.args[1].etype == etFunc) {
-			total, err := getSeriesArg(e.args[1], from, until, values)
+			total, err := getSeriesArg(e.args[1], from, until, values, fetch)
 			if err != nil || len(total) != 1 {
 				return nil
 			}
@@ -638,8 +1364,66 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		}
 		return results
 
+	case "sumSeriesLists", "diffSeriesLists", "multiplySeriesLists", "divideSeriesLists": // sumSeriesLists(seriesListFirstPos, seriesListSecondPos), diffSeriesLists(...), multiplySeriesLists(...), divideSeriesLists(dividendSeriesList, divisorSeriesList)
+		if len(e.args) != 2 {
+			return nil
+		}
+
+		first, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		second, err := getSeriesArg(e.args[1], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		if len(first) != len(second) {
+			return nil
+		}
+
+		// fetch order isn't stable, so match series up by name
+		first = sortedByName(first)
+		second = sortedByName(second)
+
+		function := strings.TrimSuffix(e.target, "Lists")
+		op := seriesListsOps[function]
+
+		var results []*metricData
+
+		for i, a := range first {
+			b := second[i]
+			if a.GetStepTime() != b.GetStepTime() || len(a.Values) != len(b.Values) {
+				return nil
+			}
+
+			r := *a
+			r.Name = proto.String(fmt.Sprintf("%s(%s,%s)", function, a.GetName(), b.GetName()))
+			r.Values = make([]float64, len(a.Values))
+			r.IsAbsent = make([]bool, len(a.Values))
+
+			for j := range a.Values {
+				av, bv := a.Values[j], b.Values[j]
+				if a.IsAbsent[j] {
+					av = math.NaN()
+				}
+				if b.IsAbsent[j] {
+					bv = math.NaN()
+				}
+
+				r.Values[j] = op(av, bv)
+				if math.IsNaN(r.Values[j]) {
+					r.Values[j] = 0
+					r.IsAbsent[j] = true
+				}
+			}
+			results = append(results, &r)
+		}
+		return results
+
 	case "avg", "averageSeries": // averageSeries(*seriesLists)
-		args, err := getSeriesArgs(e.args, from, until, values)
+		args, err := getSeriesArgs(e.args, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -656,7 +1440,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 	case "averageSeriesWithWildcards": // averageSeriesWithWildcards(seriesLIst, *position)
 		/* TODO(dgryski): make sure the arrays are all the same 'size'
 		   (duplicated from sumSeriesWithWildcards because of similar logic but aggregation) */
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -672,7 +1456,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		for _, a := range args {
 			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
+			nodes := splitMetric(metric)
 			var s []string
 			// Yes, this is O(n^2), but len(nodes) < 10 and len(fields) < 3
 			// Iterating an int slice is faster than a map for n ~ 30
@@ -720,7 +1504,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "averageAbove", "averageBelow", "currentAbove", "currentBelow", "maximumAbove", "maximumBelow", "minimumAbove", "minimumBelow": // averageAbove(seriesList, n), averageBelow(seriesList, n), currentAbove(seriesList, n), currentBelow(seriesList, n), maximumAbove(seriesList, n), maximumBelow(seriesList, n), minimumAbove(seriesList, n), minimumBelow
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -733,46 +1517,35 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		index := strings.IndexAny(e.target, "AB")
 		isAbove := e.target[index:] == "Above"
 		isInclusive := true
-		var compute func([]float64, []bool) float64
+		var summary string
 		switch e.target[0:index] {
 		case "average":
-			compute = avgValue
+			summary = "average"
 		case "current":
-			compute = currentValue
+			summary = "current"
 		case "maximum":
-			compute = maxValue
+			summary = "max"
 			isInclusive = false
 		case "minimum":
-			compute = minValue
+			summary = "min"
 			isInclusive = false
 		}
-		var results []*metricData
-		for _, a := range args {
-			value := compute(a.Values, a.IsAbsent)
-			if isAbove {
-				if isInclusive {
-					if value >= n {
-						results = append(results, a)
-					}
-				} else {
-					if value > n {
-						results = append(results, a)
-					}
-				}
-			} else {
-				if value <= n {
-					results = append(results, a)
-				}
+
+		operator := "<="
+		if isAbove {
+			operator = ">="
+			if !isInclusive {
+				operator = ">"
 			}
 		}
 
-		return results
+		return filterSeriesBySummary(args, summary, compareOperators[operator], n)
 
 	case "checkLess", "checkLessEqual", "checkGreater", "checkGreaterEqual", "checkEqual": // checkLess(seriesList, series)
 		if len(e.args) < 2 {
 			return nil
 		}
-		comparator, err := getSeriesArg(e.args[1], from, until, values)
+		comparator, err := getSeriesArg(e.args[1], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -812,7 +1585,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			gval = -1
 			operandName = c.GetName()
 		}
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
 			r.Name = proto.String(fmt.Sprintf("%s %s %s", a.GetName(), compareName, operandName))
 			r.drawAsInfinite = true
 			r.secondYAxis = true
@@ -840,7 +1613,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		})
 
 	case "checkVariance": // checkVariance(*series, acceptableStdevs, windows)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -870,7 +1643,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			return stdev
 		})[0].Values
 
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
 			r.Name = proto.String(fmt.Sprintf("stdev(%s) < %.2f (%d windows)", a.GetName(), acceptableStdevs, windows))
 			r.drawAsInfinite = true
 			r.secondYAxis = true
@@ -942,7 +1715,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		})
 
 	case "severity": // severity(seriesList, serverity)
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -961,31 +1734,49 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "derivative": // derivative(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
-			prev := a.Values[0]
-			for i, v := range a.Values {
-				if i == 0 || a.IsAbsent[i] {
-					r.IsAbsent[i] = true
-					continue
-				}
-
-				r.Values[i] = v - prev
-				prev = v
-			}
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
+			seriesDeltas(a, r, false, math.NaN(), math.NaN())
 			return r
 		})
 
+	case "derivativeByInterval": // derivativeByInterval(seriesList, intervalUnit)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		interval, err := getIntervalArg(e, 1, 1)
+		if err != nil || interval == 0 {
+			return nil
+		}
+
+		var result []*metricData
+		for _, a := range args {
+			r := *a
+			r.Name = proto.String(fmt.Sprintf("derivativeByInterval(%s,'%s')", a.GetName(), e.args[1].valStr))
+			r.Values = make([]float64, len(a.Values))
+			r.IsAbsent = make([]bool, len(a.Values))
+
+			// the change per interval rather than per step
+			seriesDeltas(a, &r, false, math.NaN(), math.NaN())
+			for i := range r.Values {
+				r.Values[i] *= float64(interval) / float64(a.GetStepTime())
+			}
+			result = append(result, &r)
+		}
+		return result
+
 	case "diffSeries": // diffSeries(*seriesLists)
 		if len(e.args) < 2 {
 			return nil
 		}
 
-		minuend, err := getSeriesArg(e.args[0], from, until, values)
+		minuend, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		subtrahends, err := getSeriesArgs(e.args[1:], from, until, values)
+		subtrahends, err := getSeriesArgs(e.args[1:], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1020,12 +1811,12 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			return nil
 		}
 
-		numerator, err := getSeriesArg(e.args[0], from, until, values)
+		numerator, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		denominator, err := getSeriesArg(e.args[1], from, until, values)
+		denominator, err := getSeriesArg(e.args[1], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1055,16 +1846,18 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return []*metricData{&r}
 
 	case "multiplySeries": // multiplySeries(factorsSeriesList)
-		firstFactor, err := getSeriesArg(e.args[0], from, until, values)
+		firstFactor, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil || len(firstFactor) != 1 {
 			return nil
 		}
 
 		r := *firstFactor[0]
 		r.Name = proto.String(fmt.Sprintf("multiplySeries(%s)", e.argString))
+		r.Values = append([]float64(nil), firstFactor[0].Values...)
+		r.IsAbsent = append([]bool(nil), firstFactor[0].IsAbsent...)
 
 		for j := 1; j < len(e.args); j++ {
-			otherFactor, err := getSeriesArg(e.args[j], from, until, values)
+			otherFactor, err := getSeriesArg(e.args[j], from, until, values, fetch)
 			if err != nil || len(otherFactor) != 1 {
 				return nil
 			}
@@ -1086,34 +1879,22 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		return []*metricData{&r}
 
-	case "exclude": // exclude(seriesList, pattern)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+	case "exclude", "grep": // exclude(seriesList, pattern), grep(seriesList, pattern)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		pat, err := getStringArg(e, 1)
-		if err != nil {
-			return nil
-		}
-
-		patre, err := regexp.Compile(pat)
+		patre, err := getRegexpArg(e, 1)
 		if err != nil {
+			logger.Logf("%s: %v", e.target, err)
 			return nil
 		}
 
-		var results []*metricData
-
-		for _, a := range arg {
-			if !patre.MatchString(a.GetName()) {
-				results = append(results, a)
-			}
-		}
-
-		return results
+		return filterSeriesByName(arg, patre.MatchString, e.target == "grep")
 
-	case "grep": // grep(seriesList, pattern)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+	case "seriesByGlob": // seriesByGlob(seriesList, pattern)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1123,23 +1904,17 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			return nil
 		}
 
-		patre, err := regexp.Compile(pat)
+		g, err := parseGlob(pat)
 		if err != nil {
 			return nil
 		}
 
-		var results []*metricData
-
-		for _, a := range arg {
-			if patre.MatchString(a.GetName()) {
-				results = append(results, a)
-			}
-		}
-
-		return results
+		return filterSeriesByName(arg, func(name string) bool {
+			return g.match(extractMetric(name))
+		}, true)
 
 	case "group": // group(*seriesLists)
-		args, err := getSeriesArgs(e.args, from, until, values)
+		args, err := getSeriesArgs(e.args, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1147,7 +1922,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return args
 
 	case "groupByNode": // groupByNode(seriesList, nodeNum, callback)
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1169,7 +1944,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		for _, a := range args {
 
 			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
+			nodes := splitMetric(metric)
 			node := nodes[field]
 
 			groups[node] = append(groups[node], a)
@@ -1187,7 +1962,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 				metricRequest{k, from, until}: v,
 			}
 
-			r := evalExpr(nexpr, from, until, nvalues)
+			r := evalExpr(nexpr, from, until, nvalues, fetch)
 			if r != nil {
 				results = append(results, r...)
 			}
@@ -1195,127 +1970,282 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		return results
 
-	case "isNonNull", "isNotNull": // isNonNull(seriesList), isNotNull(seriesList)
-
-		e.target = "isNonNull"
-
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
-			for i := range a.Values {
-				r.IsAbsent[i] = false
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-				} else {
-					r.Values[i] = 1
-				}
-
-			}
-			return r
-		})
-
-	case "lowestAverage", "lowestCurrent": // lowestAverage(seriesList, n) , lowestCurrent(seriesList, n)
-
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+	case "mapSeries": // mapSeries(seriesList, *nodes)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
-		n, err := getIntArg(e, 1)
+
+		fields, err := getIntArgs(e, 1)
 		if err != nil {
 			return nil
 		}
-		var results []*metricData
-
-		// we have fewer arguments than we want result series
-		if len(arg) < n {
-			return arg
-		}
 
-		var mh metricHeap
-
-		var compute func([]float64, []bool) float64
+		// we don't have lists of series lists, so series from the same
+		// group are just returned next to each other
+		var keys []string
+		groups := make(map[string][]*metricData)
 
-		switch e.target {
-		case "lowestAverage":
-			compute = avgValue
-		case "lowestCurrent":
-			compute = currentValue
-		}
+		for _, a := range args {
+			nodes, _ := metricNodesAndTags(a.GetName())
+			var s []string
+			for _, f := range fields {
+				if f < len(nodes) {
+					s = append(s, nodes[f])
+				}
+			}
+			key := strings.Join(s, ".")
 
-		for i, a := range arg {
-			m := compute(a.Values, a.IsAbsent)
-			heap.Push(&mh, metricHeapElement{idx: i, val: m})
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], a)
 		}
 
-		results = make([]*metricData, n)
-
-		// results should be ordered ascending
-		for i := 0; i < n; i++ {
-			v := heap.Pop(&mh).(metricHeapElement)
-			results[i] = arg[v.idx]
+		var results []*metricData
+		for _, k := range keys {
+			results = append(results, groups[k]...)
 		}
-
 		return results
 
-	case "highestAverage", "highestCurrent", "highestMax": // highestAverage(seriesList, n) , highestCurrent(seriesList, n), highestMax(seriesList, n)
+	case "reduceSeries": // reduceSeries(seriesLists, reduceFunction, reduceNode, *reduceMatchers)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
 
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		reduceFunction, err := getStringArg(e, 1)
 		if err != nil {
 			return nil
 		}
-		n, err := getIntArg(e, 1)
+
+		reduceNode, err := getIntArg(e, 2)
 		if err != nil {
 			return nil
 		}
-		var results []*metricData
 
-		// we have fewer arguments than we want result series
-		if len(arg) < n {
-			return arg
+		matchers, err := getStringArgs(e, 3)
+		if err != nil {
+			return nil
 		}
 
-		var mh metricHeap
+		var keys []string
+		groups := make(map[string][]*metricData)
 
-		var compute func([]float64, []bool) float64
+		for _, a := range args {
+			nodes, _ := metricNodesAndTags(a.GetName())
+			if reduceNode >= len(nodes) {
+				continue
+			}
 
-		switch e.target {
-		case "highestMax":
-			compute = maxValue
-		case "highestAverage":
-			compute = avgValue
-		case "highestCurrent":
-			compute = currentValue
+			i := indexOf(matchers, nodes[reduceNode])
+			if i == -1 {
+				continue
+			}
+
+			key := strings.Join(nodes[:reduceNode], ".") + ".reduce." + reduceFunction
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+				groups[key] = make([]*metricData, len(matchers))
+			}
+			groups[key][i] = a
 		}
 
-		for i, a := range arg {
-			m := compute(a.Values, a.IsAbsent)
-			if math.IsNaN(m) {
+		var results []*metricData
+
+		for _, k := range keys {
+			// create a stub context to call reduceFunction with one series
+			// for each matcher
+			var fargs []*expr
+			nvalues := make(map[metricRequest][]*metricData)
+			for _, a := range groups[k] {
+				if a == nil {
+					break
+				}
+				fargs = append(fargs, &expr{target: a.GetName()})
+				nvalues[metricRequest{a.GetName(), from, until}] = []*metricData{a}
+			}
+			if len(fargs) != len(matchers) {
+				// not every matcher matched a series in this group
 				continue
 			}
 
-			if len(mh) < n {
-				heap.Push(&mh, metricHeapElement{idx: i, val: m})
+			r := evalExpr(funcExpr(reduceFunction, fargs...), from, until, nvalues, fetch)
+			if len(r) == 0 {
 				continue
 			}
-			// m is bigger than smallest max found so far
-			if mh[0].val < m {
-				mh[0].val = m
-				mh[0].idx = i
-				heap.Fix(&mh, 0)
+
+			reduced := *r[0]
+			reduced.Name = proto.String(k)
+			results = append(results, &reduced)
+		}
+
+		return results
+
+	case "applyByNode": // applyByNode(seriesList, nodeNum, templateFunction, newName=None)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		nodeNum, err := getIntArg(e, 1)
+		if err != nil {
+			return nil
+		}
+
+		templateFunction, err := getStringArg(e, 2)
+		if err != nil {
+			return nil
+		}
+
+		newName, err := getStringArgDefault(e, 3, "")
+		if err != nil {
+			return nil
+		}
+
+		prefixes := make(map[string]bool)
+		for _, a := range args {
+			nodes, _ := metricNodesAndTags(a.GetName())
+			if nodeNum+1 < len(nodes) {
+				nodes = nodes[:nodeNum+1]
 			}
+			prefixes[strings.Join(nodes, ".")] = true
 		}
 
-		results = make([]*metricData, n)
+		var sorted []string
+		for p := range prefixes {
+			sorted = append(sorted, p)
+		}
+		sort.Strings(sorted)
 
-		// results should be ordered ascending
-		for len(mh) > 0 {
-			v := heap.Pop(&mh).(metricHeapElement)
-			results[len(mh)] = arg[v.idx]
+		var results []*metricData
+
+		for _, prefix := range sorted {
+			nexpr, rest, err := parseExpr(strings.Replace(templateFunction, "%", prefix, -1))
+			if err != nil || rest != "" {
+				return nil
+			}
+
+			// the metrics in the template weren't known when we fetched
+			fetch.onDemand(nexpr.metrics(), from, until, values)
+			fetch.onDemand(nexpr.bootstrapMetrics(metricSteps(values)), from, until, values)
+
+			for _, a := range evalExpr(nexpr, from, until, values, fetch) {
+				r := *a
+				if newName != "" {
+					r.Name = proto.String(strings.Replace(newName, "%", prefix, -1))
+				}
+				results = append(results, &r)
+			}
 		}
 
 		return results
 
+	case "isNonNull", "isNotNull": // isNonNull(seriesList), isNotNull(seriesList)
+
+		e.target = "isNonNull"
+
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
+			for i := range a.Values {
+				r.IsAbsent[i] = false
+				if a.IsAbsent[i] {
+					r.Values[i] = 0
+				} else {
+					r.Values[i] = 1
+				}
+
+			}
+			return r
+		})
+
+	case "lowestAverage", "lowestCurrent": // lowestAverage(seriesList, n) , lowestCurrent(seriesList, n)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		n, err := getIntArg(e, 1)
+		if err != nil {
+			return nil
+		}
+
+		var summary string
+		switch e.target {
+		case "lowestAverage":
+			summary = "average"
+		case "lowestCurrent":
+			summary = "current"
+		}
+
+		return lowestSeries(arg, n, summary)
+
+	case "highestAverage", "highestCurrent", "highestMax": // highestAverage(seriesList, n) , highestCurrent(seriesList, n), highestMax(seriesList, n)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		n, err := getIntArg(e, 1)
+		if err != nil {
+			return nil
+		}
+
+		var summary string
+		switch e.target {
+		case "highestMax":
+			summary = "max"
+		case "highestAverage":
+			summary = "average"
+		case "highestCurrent":
+			summary = "current"
+		}
+
+		return highestSeries(arg, n, summary)
+
+	case "highest", "lowest": // highest(seriesList, n=1, func='average'), lowest(seriesList, n=1, func='average')
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		n, err := getIntArgDefault(e, 1, 1)
+		if err != nil {
+			return nil
+		}
+		summary, err := getStringArgDefault(e, 2, "average")
+		if err != nil || !isSummaryFunc(summary) {
+			return nil
+		}
+
+		if e.target == "highest" {
+			return highestSeries(arg, n, summary)
+		}
+		return lowestSeries(arg, n, summary)
+
+	case "filterSeries": // filterSeries(seriesList, func, operator, threshold)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		summary, err := getStringArg(e, 1)
+		if err != nil || !isSummaryFunc(summary) {
+			return nil
+		}
+		operator, err := getStringArg(e, 2)
+		if err != nil {
+			return nil
+		}
+		compare, ok := compareOperators[operator]
+		if !ok {
+			return nil
+		}
+		threshold, err := getFloatArg(e, 3)
+		if err != nil {
+			return nil
+		}
+
+		return filterSeriesBySummary(arg, summary, compare, threshold)
+
 	case "hitcount": // hitcount(seriesList, intervalString, alignToInterval=False)
 		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1407,10 +2337,10 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		}
 		return results
 	case "integral": // integral(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
 			current := 0.0
 			for i, v := range a.Values {
-				if a.IsAbsent[i] || v == 0 {
+				if a.IsAbsent[i] {
 					r.Values[i] = 0
 					r.IsAbsent[i] = true
 					continue
@@ -1421,8 +2351,46 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			return r
 		})
 
+	case "integralByInterval": // integralByInterval(seriesList, intervalUnit)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		interval, err := getIntervalArg(e, 1, 1)
+		if err != nil || interval == 0 {
+			return nil
+		}
+
+		var result []*metricData
+		for _, a := range args {
+			r := *a
+			r.Name = proto.String(fmt.Sprintf("integralByInterval(%s,'%s')", a.GetName(), e.args[1].valStr))
+			r.Values = make([]float64, len(a.Values))
+			r.IsAbsent = make([]bool, len(a.Values))
+
+			// intervals are counted from the start of the graph
+			current := 0.0
+			t := a.GetStartTime()
+			for i, v := range a.Values {
+				if floorDiv(t-from, interval) != floorDiv(t-from-a.GetStepTime(), interval) {
+					current = 0
+				}
+				t += a.GetStepTime()
+
+				// absent points keep the total so far, as it may just have
+				// been reset
+				if !a.IsAbsent[i] {
+					current += v
+				}
+				r.Values[i] = current
+			}
+			result = append(result, &r)
+		}
+		return result
+
 	case "invert": // invert(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
 			for i, v := range a.Values {
 				if a.IsAbsent[i] || v == 0 {
 					r.Values[i] = 0
@@ -1435,7 +2403,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		})
 
 	case "keepLastValue": // keepLastValue(seriesList, limit=inf)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1450,7 +2418,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			if len(e.args) == 1 {
 				name = fmt.Sprintf("keepLastValue(%s)", a.GetName())
 			} else {
-				name = fmt.Sprintf("keepLastValue(%s,%d)", a.GetName(), keep)
+				name = fmt.Sprintf("keepLastValue(%s,%s)", a.GetName(), numberArgName(e.args[1], float64(keep)))
 			}
 
 			r := *a
@@ -1481,8 +2449,154 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		}
 		return results
 
+	case "interpolate": // interpolate(seriesList, limit=inf)
+		limit, err := getIntArgDefault(e, 1, -1)
+		if err != nil {
+			return nil
+		}
+
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
+			last := -1
+			for i, v := range a.Values {
+				r.Values[i] = v
+				r.IsAbsent[i] = a.IsAbsent[i]
+				if a.IsAbsent[i] {
+					continue
+				}
+
+				// only fill gaps with known values on both sides
+				if gap := i - last - 1; last != -1 && gap > 0 && (limit < 0 || gap <= limit) {
+					delta := (v - a.Values[last]) / float64(i-last)
+					for j := last + 1; j < i; j++ {
+						r.Values[j] = a.Values[last] + float64(j-last)*delta
+						r.IsAbsent[j] = false
+					}
+				}
+				last = i
+			}
+			return r
+		})
+
+	case "delay": // delay(seriesList, steps)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		steps, err := getIntArg(e, 1)
+		if err != nil {
+			return nil
+		}
+		var results []*metricData
+
+		for _, a := range arg {
+			r := *a
+			r.Name = proto.String(fmt.Sprintf("delay(%s,%d)", a.GetName(), steps))
+			r.Values = make([]float64, len(a.Values))
+			r.IsAbsent = make([]bool, len(a.Values))
+
+			for i := range a.Values {
+				j := i - steps
+				if j < 0 || j >= len(a.Values) || a.IsAbsent[j] {
+					r.IsAbsent[i] = true
+					continue
+				}
+				r.Values[i] = a.Values[j]
+			}
+			results = append(results, &r)
+		}
+		return results
+
+	case "removeEmptySeries", "removeZeroSeries": // removeEmptySeries(seriesList, xFilesFactor=0), removeZeroSeries(seriesList, xFilesFactor=0)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		xFilesFactor, err := getFloatArgDefault(e, 1, 0)
+		if err != nil {
+			return nil
+		}
+		var results []*metricData
+
+		for _, a := range arg {
+			var nonNull, nonZero int
+			for i, v := range a.Values {
+				if a.IsAbsent[i] {
+					continue
+				}
+				nonNull++
+				if v != 0 {
+					nonZero++
+				}
+			}
+
+			if nonNull == 0 || float64(nonNull) < xFilesFactor*float64(len(a.Values)) {
+				continue
+			}
+			if e.target == "removeZeroSeries" && nonZero == 0 {
+				continue
+			}
+			results = append(results, a)
+		}
+		return results
+
+	case "useSeriesAbove": // useSeriesAbove(seriesList, value, search, replace)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		value, err := getFloatArg(e, 1)
+		if err != nil {
+			return nil
+		}
+		re, err := getRegexpArg(e, 2)
+		if err != nil {
+			logger.Logf("%s: %v", e.target, err)
+			return nil
+		}
+		replace, err := getReplacementArg(e, 3)
+		if err != nil {
+			return nil
+		}
+
+		var results []*metricData
+
+		for _, a := range arg {
+			if max := summarizeSeries("max", a); math.IsNaN(max) || max <= value {
+				continue
+			}
+
+			nexpr, rest, err := parseExpr(re.ReplaceAllString(a.GetName(), replace))
+			if err != nil || rest != "" {
+				continue
+			}
+
+			// the replacement series wasn't known when we fetched
+			fetch.onDemand(nexpr.metrics(), from, until, values)
+
+			if r := evalExpr(nexpr, from, until, values, fetch); len(r) > 0 {
+				results = append(results, r[0])
+			}
+		}
+		return results
+
+	case "fallbackSeries": // fallbackSeries(seriesList, fallback)
+		if len(e.args) < 2 {
+			return nil
+		}
+
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err == nil {
+			return arg
+		}
+
+		fallback, err := getSeriesArg(e.args[1], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		return fallback
+
 	case "changed": // changed(SeriesList)
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1511,12 +2625,12 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return result
 
 	case "kolmogorovSmirnovTest2", "ksTest2": // ksTest2(series, series, points|"interval")
-		arg1, err := getSeriesArg(e.args[0], from, until, values)
+		arg1, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		arg2, err := getSeriesArg(e.args[1], from, until, values)
+		arg2, err := getSeriesArg(e.args[1], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1570,7 +2684,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return []*metricData{&r}
 
 	case "limit": // limit(seriesList, n)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1587,7 +2701,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return arg[:limit]
 
 	case "logarithm", "log": // logarithm(seriesList, base=10)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1605,7 +2719,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			if len(e.args) == 1 {
 				name = fmt.Sprintf("logarithm(%s)", a.GetName())
 			} else {
-				name = fmt.Sprintf("logarithm(%s,%d)", a.GetName(), base)
+				name = fmt.Sprintf("logarithm(%s,%s)", a.GetName(), numberArgName(e.args[1], float64(base)))
 			}
 
 			r := *a
@@ -1626,7 +2740,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "maxSeries": // maxSeries(*seriesLists)
-		args, err := getSeriesArgs(e.args, from, until, values)
+		args, err := getSeriesArgs(e.args, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1642,7 +2756,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		})
 
 	case "minSeries": // minSeries(*seriesLists)
-		args, err := getSeriesArgs(e.args, from, until, values)
+		args, err := getSeriesArgs(e.args, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1663,7 +2777,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			return nil
 		}
 
-		args, err := getSeriesArg(e.args[1], from, until, values)
+		args, err := getSeriesArg(e.args[1], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1697,107 +2811,84 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		return results
 
-	case "movingAverage": // movingAverage(seriesList, windowSize)
-		var n int
-		var err error
-
-		var scaleByStep bool
-
-		switch e.args[1].etype {
-		case etConst:
-			n, err = getIntArg(e, 1)
-		case etString:
-			var n32 int32
-			n32, err = getIntervalArg(e, 1, 1)
-			n = int(n32)
-			scaleByStep = true
-		default:
-			err = ErrBadType
-		}
+	case "movingAverage", "movingSum", "movingMin", "movingMax", "movingWindow": // movingAverage(seriesList, windowSize), movingSum(seriesList, windowSize), movingMin(seriesList, windowSize), movingMax(seriesList, windowSize), movingWindow(seriesList, windowSize, func='average', xFilesFactor=0)
+		points, seconds, err := getWindowArg(e, 1)
 		if err != nil {
 			return nil
 		}
 
-		windowSize := n
+		var summary string
+		var xFilesFactor float64
 
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil
+		switch e.target {
+		case "movingAverage":
+			summary = "average"
+		case "movingSum":
+			summary = "sum"
+		case "movingMin":
+			summary = "min"
+		case "movingMax":
+			summary = "max"
+		case "movingWindow":
+			summary, err = getStringArgDefault(e, 2, "average")
+			if err != nil || !isSummaryFunc(summary) {
+				return nil
+			}
+			xFilesFactor, err = getFloatArgDefault(e, 3, 0)
+			if err != nil {
+				return nil
+			}
 		}
 
-		if scaleByStep {
-			windowSize /= int(arg[0].GetStepTime())
+		arg, bootstrapped, err := getWindowedSeriesArg(e.args[0], points, seconds, from, until, values, fetch)
+		if err != nil {
+			return nil
 		}
 
 		var result []*metricData
 
 		for _, a := range arg {
-			w := &Windowed{data: make([]float64, windowSize)}
-
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("movingAverage(%s,%d)", a.GetName(), windowSize))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-			r.StartTime = proto.Int32(from)
-			r.StopTime = proto.Int32(until)
+			windowSize := windowPoints(points, seconds, a.GetStepTime())
+			if windowSize <= 0 {
+				return nil
+			}
 
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					// make sure missing values are ignored
-					v = math.NaN()
-				}
-				r.Values[i] = w.Mean()
-				w.Push(v)
-				if i < windowSize || math.IsNaN(r.Values[i]) {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-				}
+			r := movingWindow(a, windowSize, summary, xFilesFactor)
+			if e.target == "movingWindow" {
+				r.Name = proto.String(fmt.Sprintf("movingWindow(%s,%d,'%s')", a.GetName(), windowSize, summary))
+			} else {
+				r.Name = proto.String(fmt.Sprintf("%s(%s,%d)", e.target, a.GetName(), windowSize))
 			}
-			result = append(result, &r)
+			if bootstrapped {
+				trimBootstrap(r, windowSize)
+			}
+			result = append(result, r)
 		}
 		return result
 
 	case "movingMedian": // movingMedian(seriesList, windowSize)
-		var n int
-		var err error
-
-		var scaleByStep bool
-
-		switch e.args[1].etype {
-		case etConst:
-			n, err = getIntArg(e, 1)
-		case etString:
-			var n32 int32
-			n32, err = getIntervalArg(e, 1, 1)
-			n = int(n32)
-			scaleByStep = true
-		default:
-			err = ErrBadType
-		}
+		points, seconds, err := getWindowArg(e, 1)
 		if err != nil {
 			return nil
 		}
 
-		windowSize := n
-
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, bootstrapped, err := getWindowedSeriesArg(e.args[0], points, seconds, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		if scaleByStep {
-			windowSize /= int(arg[0].GetStepTime())
-		}
-
 		var result []*metricData
 
 		for _, a := range arg {
+			windowSize := windowPoints(points, seconds, a.GetStepTime())
+			if windowSize <= 0 {
+				return nil
+			}
+
 			r := *a
 			r.Name = proto.String(fmt.Sprintf("movingMedian(%s,%d)", a.GetName(), windowSize))
 			r.Values = make([]float64, len(a.Values))
 			r.IsAbsent = make([]bool, len(a.Values))
-			r.StartTime = proto.Int32(from)
-			r.StopTime = proto.Int32(until)
 
 			data := movingmedian.NewMovingMedian(windowSize)
 
@@ -1815,59 +2906,118 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 					r.IsAbsent[i] = true
 				}
 			}
+
+			if bootstrapped {
+				trimBootstrap(&r, windowSize)
+			}
 			result = append(result, &r)
 		}
 		return result
 
-	case "nonNegativeDerivative": // nonNegativeDerivative(seriesList, maxValue=None)
-		args, err := getSeriesArg(e.args[0], from, until, values)
+	case "exponentialMovingAverage": // exponentialMovingAverage(seriesList, windowSize)
+		points, seconds, err := getWindowArg(e, 1)
 		if err != nil {
 			return nil
 		}
 
-		maxValue, err := getFloatArgDefault(e, 1, math.NaN())
+		arg, bootstrapped, err := getWindowedSeriesArg(e.args[0], points, seconds, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
 		var result []*metricData
-		for _, a := range args {
-			var name string
-			if len(e.args) == 1 {
-				name = fmt.Sprintf("nonNegativeDerivative(%s)", a.GetName())
-			} else {
-				name = fmt.Sprintf("nonNegativeDerivative(%s,%g)", a.GetName(), maxValue)
+
+		for _, a := range arg {
+			windowSize := windowPoints(points, seconds, a.GetStepTime())
+			if windowSize <= 0 {
+				return nil
 			}
 
 			r := *a
-			r.Name = proto.String(name)
+			r.Name = proto.String(fmt.Sprintf("exponentialMovingAverage(%s,%d)", a.GetName(), windowSize))
 			r.Values = make([]float64, len(a.Values))
 			r.IsAbsent = make([]bool, len(a.Values))
 
-			prev := a.Values[0]
+			constant := 2 / (float64(windowSize) + 1)
+
+			// the average of the first window seeds the ema
+			w := &Windowed{data: make([]float64, windowSize)}
+			var ema float64
+
 			for i, v := range a.Values {
-				if i == 0 || a.IsAbsent[i] || a.IsAbsent[i-1] {
+				if a.IsAbsent[i] {
+					v = math.NaN()
+				}
+
+				switch {
+				case i < windowSize:
+					w.Push(v)
 					r.IsAbsent[i] = true
-					prev = v
 					continue
+				case i == windowSize:
+					ema = w.Mean()
 				}
-				diff := v - prev
-				if diff >= 0 {
-					r.Values[i] = diff
-				} else if !math.IsNaN(maxValue) && maxValue >= v {
-					r.Values[i] = ((maxValue - prev) + v + 1)
-				} else {
-					r.Values[i] = 0
+
+				if math.IsNaN(v) || math.IsNaN(ema) {
 					r.IsAbsent[i] = true
+					continue
 				}
-				prev = v
+
+				ema = constant*v + (1-constant)*ema
+				r.Values[i] = ema
+			}
+
+			if bootstrapped {
+				trimBootstrap(&r, windowSize)
 			}
 			result = append(result, &r)
 		}
 		return result
 
-	case "perSecond": // perSecond(seriesList, maxValue=None)
-		args, err := getSeriesArg(e.args[0], from, until, values)
+	case "linearRegression": // linearRegression(seriesList, startSourceAt=None, endSourceAt=None)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		// the source range can only narrow the data we fetched for the
+		// request; we don't fetch a separate source series like graphite
+		startStr, err := getStringArgDefault(e, 1, "")
+		if err != nil {
+			return nil
+		}
+		endStr, err := getStringArgDefault(e, 2, "")
+		if err != nil {
+			return nil
+		}
+
+		sourceStart := dateParamToEpoch(startStr, int64(from))
+		sourceStop := dateParamToEpoch(endStr, int64(until))
+
+		var results []*metricData
+
+		for _, a := range arg {
+			factor, offset, ok := linearRegressionAnalysis(a, sourceStart, sourceStop)
+			if !ok {
+				continue
+			}
+
+			r := *a
+			r.Name = proto.String(fmt.Sprintf("linearRegression(%s,%d,%d)", a.GetName(), sourceStart, sourceStop))
+			r.Values = make([]float64, len(a.Values))
+			r.IsAbsent = make([]bool, len(a.Values))
+
+			t := a.GetStartTime()
+			for i := range r.Values {
+				r.Values[i] = offset + factor*float64(t)
+				t += a.GetStepTime()
+			}
+			results = append(results, &r)
+		}
+		return results
+
+	case "nonNegativeDerivative", "perSecond": // nonNegativeDerivative(seriesList, maxValue=None, minValue=None), perSecond(seriesList, maxValue=None, minValue=None)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1877,41 +3027,60 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			return nil
 		}
 
+		minValue, err := getFloatArgDefault(e, 2, math.NaN())
+		if err != nil {
+			return nil
+		}
+
 		var result []*metricData
 		for _, a := range args {
-			r := *a
-			if len(e.args) == 1 {
-				r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, a.GetName()))
-			} else {
-				r.Name = proto.String(fmt.Sprintf("%s(%s,%g)", e.target, a.GetName(), maxValue))
+			var name string
+			switch len(e.args) {
+			case 1:
+				name = fmt.Sprintf("%s(%s)", e.target, a.GetName())
+			case 2:
+				name = fmt.Sprintf("%s(%s,%s)", e.target, a.GetName(), numberArgName(e.args[1], maxValue))
+			default:
+				name = fmt.Sprintf("%s(%s,%s,%s)", e.target, a.GetName(), numberArgName(e.args[1], maxValue), numberArgName(e.args[2], minValue))
 			}
+
+			r := *a
+			r.Name = proto.String(name)
 			r.Values = make([]float64, len(a.Values))
 			r.IsAbsent = make([]bool, len(a.Values))
 
-			prev := a.Values[0]
+			seriesDeltas(a, &r, true, maxValue, minValue)
+
+			if e.target == "perSecond" {
+				for i := range r.Values {
+					r.Values[i] /= float64(a.GetStepTime())
+				}
+			}
+			result = append(result, &r)
+		}
+		return result
+
+	case "minMax": // minMax(seriesList)
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
+			min := summarizeSeries("min", a)
+			max := summarizeSeries("max", a)
 			for i, v := range a.Values {
-				if i == 0 || a.IsAbsent[i] || a.IsAbsent[i-1] {
+				if a.IsAbsent[i] {
+					r.Values[i] = 0
 					r.IsAbsent[i] = true
-					prev = v
 					continue
 				}
-				diff := v - prev
-				if diff >= 0 {
-					r.Values[i] = diff / float64(a.GetStepTime())
-				} else if !math.IsNaN(maxValue) && maxValue >= v {
-					r.Values[i] = ((maxValue - prev) + v + 1/float64(a.GetStepTime()))
-				} else {
+				if max == min {
 					r.Values[i] = 0
-					r.IsAbsent[i] = true
+					continue
 				}
-				prev = v
+				r.Values[i] = (v - min) / (max - min)
 			}
-			result = append(result, &r)
-		}
-		return result
+			return r
+		})
 
 	case "nPercentile": // nPercentile(seriesList, n)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1944,12 +3113,12 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "pearson": // pearson(series, series, windowSize)
-		arg1, err := getSeriesArg(e.args[0], from, until, values)
+		arg1, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		arg2, err := getSeriesArg(e.args[1], from, until, values)
+		arg2, err := getSeriesArg(e.args[1], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -1997,7 +3166,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return []*metricData{&r}
 
 	case "pearsonClosest": // pearsonClosest(series, seriesList, n, direction=abs)
-		ref, err := getSeriesArg(e.args[0], from, until, values)
+		ref, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2006,7 +3175,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			return nil
 		}
 
-		compare, err := getSeriesArg(e.args[1], from, until, values)
+		compare, err := getSeriesArg(e.args[1], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2027,25 +3196,16 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		// NOTE: if direction == "abs" && len(compare) <= n : we'll still do the work to rank them
 
-		for i, v := range ref[0].IsAbsent {
-			if v == true {
-				ref[0].Values[i] = math.NaN()
-			}
-		}
+		refValues := nanValues(ref[0])
 
 		var mh metricHeap
 
 		for index, a := range compare {
-			if len(ref[0].Values) != len(a.Values) {
+			if len(refValues) != len(a.Values) {
 				// Pearson will panic if arrays are not equal length; skip
 				continue
 			}
-			for i, v := range a.IsAbsent {
-				if v == true {
-					a.Values[i] = math.NaN()
-				}
-			}
-			value := onlinestats.Pearson(ref[0].Values, a.Values)
+			value := onlinestats.Pearson(refValues, nanValues(a))
 			// Standardize the value so sort ASC will have strongest correlation first
 			switch {
 			case math.IsNaN(value):
@@ -2074,7 +3234,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "offset": // offset(seriesList,factor)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2103,7 +3263,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "offsetToZero": // offsetToZero(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *metricData, r *metricData) *metricData {
+		return forEachSeriesDo(e, from, until, values, fetch, func(a *metricData, r *metricData) *metricData {
 			minimum := math.Inf(1)
 			for i, v := range a.Values {
 				if !a.IsAbsent[i] && v < minimum {
@@ -2122,7 +3282,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		})
 
 	case "scale": // scale(seriesList, factor)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2151,7 +3311,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "scaleToSeconds": // scaleToSeconds(seriesList, seconds)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2183,7 +3343,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "pow": // pow(seriesList,factor)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2212,59 +3372,68 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "sortByMaxima", "sortByMinima", "sortByTotal": // sortByMaxima(seriesList), sortByMinima(seriesList), sortByTotal(seriesList)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		vals := make([]float64, len(arg))
-
-		for i, a := range arg {
-			switch e.target {
-			case "sortByTotal":
-				vals[i] = summarizeValues("sum", a.GetValues())
-			case "sortByMaxima":
-				vals[i] = summarizeValues("max", a.GetValues())
-			case "sortByMinima":
-				vals[i] = 1 / summarizeValues("min", a.GetValues())
-			}
+		switch e.target {
+		case "sortByTotal":
+			return sortSeries(arg, "sum", true)
+		case "sortByMaxima":
+			return sortSeries(arg, "max", true)
 		}
+		return sortSeries(arg, "min", false)
 
-		sort.Sort(byVals{vals: vals, series: arg})
+	case "sortBy": // sortBy(seriesList, func='average', reverse=False)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+		summary, err := getStringArgDefault(e, 1, "average")
+		if err != nil || !isSummaryFunc(summary) {
+			return nil
+		}
+		reverse, err := getBoolArgDefault(e, 2, false)
+		if err != nil {
+			return nil
+		}
 
-		return arg
+		return sortSeries(arg, summary, reverse)
 
 	case "sortByName": // sortByName(seriesList)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		sort.Sort(ByName(arg))
-
-		return arg
+		return sortedByName(arg)
 
 	case "stdev", "stddev": // stdev(seriesList, points, missingThreshold=0.1)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		windowPts, seconds, err := getWindowArg(e, 1)
 		if err != nil {
 			return nil
 		}
 
-		points, err := getIntArg(e, 1)
+		missingThreshold, err := getFloatArgDefault(e, 2, 0.1)
 		if err != nil {
 			return nil
 		}
 
-		missingThreshold, err := getFloatArgDefault(e, 2, 0.1)
+		arg, bootstrapped, err := getWindowedSeriesArg(e.args[0], windowPts, seconds, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
-		minLen := int((1 - missingThreshold) * float64(points))
-
 		var result []*metricData
 
 		for _, a := range arg {
+			points := windowPoints(windowPts, seconds, a.GetStepTime())
+			if points <= 0 {
+				return nil
+			}
+			minLen := int((1 - missingThreshold) * float64(points))
+
 			w := &Windowed{data: make([]float64, points)}
 
 			r := *a
@@ -2284,13 +3453,16 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 					r.IsAbsent[i] = true
 				}
 			}
+			if bootstrapped {
+				trimBootstrap(&r, points)
+			}
 			result = append(result, &r)
 		}
 		return result
 
 	case "sum", "sumSeries": // sumSeries(*seriesLists)
 		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArgs(e.args, from, until, values)
+		args, err := getSeriesArgs(e.args, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2306,7 +3478,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 	case "sumSeriesWithWildcards": // sumSeriesWithWildcards(seriesList, *position)
 		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2322,7 +3494,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		for _, a := range args {
 			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
+			nodes := splitMetric(metric)
 			var s []string
 			// Yes, this is O(n^2), but len(nodes) < 10 and len(fields) < 3
 			// Iterating an int slice is faster than a map for n ~ 30
@@ -2367,7 +3539,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 	case "percentileOfSeries": // percentileOfSeries(seriesList, n, interpolate=False)
 		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2387,7 +3559,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		})
 
 	case "maxDataPoints": // used to condense targets down to a a set of dat points
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2482,7 +3654,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 	case "summarize": // summarize(seriesList, intervalString, func='sum', alignToFrom=False)
 		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2581,14 +3753,17 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "timeShift": // timeShift(seriesList, timeShift, resetEnd=True)
-		// FIXME(dgryski): support resetEnd=true
-
 		offs, err := getIntervalArg(e, 1, -1)
 		if err != nil {
 			return nil
 		}
 
-		arg, err := getSeriesArg(e.args[0], from+offs, until+offs, values)
+		resetEnd, err := getBoolArgDefault(e, 2, true)
+		if err != nil {
+			return nil
+		}
+
+		arg, err := getSeriesArg(e.args[0], from+offs, until+offs, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2600,12 +3775,90 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			r.Name = proto.String(fmt.Sprintf("timeShift(%s)", a.GetName()))
 			r.StartTime = proto.Int32(a.GetStartTime() - offs)
 			r.StopTime = proto.Int32(a.GetStopTime() - offs)
+			if resetEnd {
+				// end where the unshifted series would have ended
+				resizeSeries(&r, until)
+			}
+			results = append(results, &r)
+		}
+		return results
+
+	case "timeStack": // timeStack(seriesList, timeShiftUnit='1d', timeShiftStart=0, timeShiftEnd=7)
+		offs, start, end, err := getTimeStackArgs(e)
+		if err != nil {
+			return nil
+		}
+
+		unit := "1d"
+		if len(e.args) > 1 {
+			unit = e.args[1].valStr
+		}
+
+		var results []*metricData
+
+		for shift := start; shift < end; shift++ {
+			shiftOffs := offs * int32(shift)
+
+			arg, err := getSeriesArg(e.args[0], from+shiftOffs, until+shiftOffs, values, fetch)
+			if err != nil {
+				// nothing for this period, the others may still have data
+				continue
+			}
+
+			for _, a := range arg {
+				r := *a
+				r.Name = proto.String(fmt.Sprintf("timeShift(%s,%s,%d)", a.GetName(), unit, shift))
+				r.StartTime = proto.Int32(a.GetStartTime() - shiftOffs)
+				r.StopTime = proto.Int32(a.GetStopTime() - shiftOffs)
+				resizeSeries(&r, until)
+				results = append(results, &r)
+			}
+		}
+		return results
+
+	case "timeSlice": // timeSlice(seriesList, startSliceAt, endSliceAt='now')
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		startStr, err := getStringArg(e, 1)
+		if err != nil {
+			return nil
+		}
+
+		endStr, err := getStringArgDefault(e, 2, "now")
+		if err != nil {
+			return nil
+		}
+
+		start := dateParamToEpoch(startStr, int64(from))
+		end := dateParamToEpoch(endStr, int64(until))
+
+		var results []*metricData
+
+		for _, a := range arg {
+			r := *a
+			r.Name = proto.String(fmt.Sprintf("timeSlice(%s,%d,%d)", a.GetName(), start, end))
+			r.Values = make([]float64, len(a.Values))
+			r.IsAbsent = make([]bool, len(a.Values))
+
+			t := a.GetStartTime()
+			for i, v := range a.Values {
+				if a.IsAbsent[i] || t < start || t > end {
+					r.Values[i] = 0
+					r.IsAbsent[i] = true
+				} else {
+					r.Values[i] = v
+				}
+				t += a.GetStepTime()
+			}
 			results = append(results, &r)
 		}
 		return results
 
 	case "transformNull": // transformNull(seriesList, default=0)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2621,7 +3874,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			if len(e.args) == 1 {
 				name = fmt.Sprintf("transformNull(%s)", a.GetName())
 			} else {
-				name = fmt.Sprintf("transformNull(%s,%g)", a.GetName(), defv)
+				name = fmt.Sprintf("transformNull(%s,%s)", a.GetName(), numberArgName(e.args[1], defv))
 			}
 
 			r := *a
@@ -2642,46 +3895,33 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "tukeyAbove": // tukeyAbove(seriesList,interval,basis,n)
-
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		windowPts, seconds, err := getWindowArg(e, 1)
 		if err != nil {
 			return nil
 		}
 
-		var n int
-		var scaleByStep bool
-
-		switch e.args[1].etype {
-		case etConst:
-			n, err = getIntArg(e, 1)
-		case etString:
-			var n32 int32
-			n32, err = getIntervalArg(e, 1, 1)
-			n = int(n32)
-			scaleByStep = true
-		default:
-			err = ErrBadType
-		}
+		basis, err := getFloatArg(e, 2)
 		if err != nil {
 			return nil
 		}
 
-		windowSize := n
-
-		if scaleByStep {
-			windowSize /= int(arg[0].GetStepTime())
-		}
-
-		basis, err := getFloatArg(e, 2)
+		n, err := getIntArg(e, 3)
 		if err != nil {
 			return nil
 		}
 
-		n, err = getIntArg(e, 3)
+		// the window before `from' is part of the baseline the quartiles
+		// are computed from, but only points on the graph are outliers
+		arg, bootstrapped, err := getWindowedSeriesArg(e.args[0], windowPts, seconds, from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
 
+		var windowSize int
+		if bootstrapped {
+			windowSize = windowPoints(windowPts, seconds, arg[0].GetStepTime())
+		}
+
 		// gather all the valid points
 		var points []float64
 		for _, a := range arg {
@@ -2693,6 +3933,10 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			}
 		}
 
+		if len(points) == 0 {
+			return nil
+		}
+
 		sort.Float64s(points)
 
 		first := int(0.25 * float64(len(points)))
@@ -2709,7 +3953,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		for i, a := range arg {
 			var outlier int
 			for i, m := range a.Values {
-				if a.IsAbsent[i] {
+				if i < windowSize || a.IsAbsent[i] {
 					continue
 				}
 				if m >= max {
@@ -2735,17 +3979,19 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 			}
 		}
 
-		results := make([]*metricData, n)
+		results := make([]*metricData, len(mh))
 		// results should be ordered ascending
 		for len(mh) > 0 {
 			v := heap.Pop(&mh).(metricHeapElement)
-			results[len(mh)] = arg[v.idx]
+			r := *arg[v.idx]
+			trimBootstrap(&r, windowSize)
+			results[len(mh)] = &r
 		}
 
 		return results
 
 	case "color": // color(seriesList, theColor) ignored
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2768,7 +4014,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "dashed", "drawAsInfinite", "secondYAxis": // ignored
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2811,51 +4057,226 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 
 		return []*metricData{&p}
 
-	case "holtWintersForecast":
-		var results []*metricData
-		args, err := getSeriesArgs(e.args, from-7*86400, until, values)
+	case "identity", "timeFunction": // identity(name), timeFunction(name, step=60)
+		name, err := getNameArg(e, 0)
 		if err != nil {
 			return nil
 		}
+		step, err := getIntArgDefault(e, 1, 60)
+		if err != nil || step <= 0 {
+			return nil
+		}
 
-		const alpha = 0.1
-		const beta = 0.0035
-		const gamma = 0.1
+		return []*metricData{generateSeries(name, from, until, int32(step), func(t int32) float64 {
+			return float64(t)
+		})}
 
-		for _, arg := range args {
-			stepTime := arg.GetStepTime()
-			numStepsToWalkToGetOriginalData := (int)((until - from) / stepTime)
+	case "sinFunction": // sinFunction(name, amplitude=1, step=60)
+		name, err := getNameArg(e, 0)
+		if err != nil {
+			return nil
+		}
+		amplitude, err := getFloatArgDefault(e, 1, 1)
+		if err != nil {
+			return nil
+		}
+		step, err := getIntArgDefault(e, 2, 60)
+		if err != nil || step <= 0 {
+			return nil
+		}
 
-			//originalSeries := arg.Values[len(arg.Values)-numStepsToWalkToGetOriginalData:]
-			bootStrapSeries := arg.Values[:len(arg.Values)-numStepsToWalkToGetOriginalData]
+		return []*metricData{generateSeries(name, from, until, int32(step), func(t int32) float64 {
+			return amplitude * math.Sin(float64(t))
+		})}
 
-			//In line with graphite, we define a season as a single day.
-			//A period is the number of steps that make a season.
-			period := (int)((24 * 60 * 60) / stepTime)
+	case "randomWalk": // randomWalk(name, step=60)
+		name, err := getNameArg(e, 0)
+		if err != nil {
+			return nil
+		}
+		step, err := getIntArgDefault(e, 1, 60)
+		if err != nil || step <= 0 {
+			return nil
+		}
 
-			predictions, err := holtwinters.Forecast(bootStrapSeries, alpha, beta, gamma, period, numStepsToWalkToGetOriginalData)
-			if err != nil {
-				return nil
-			}
+		value := 0.0
+		return []*metricData{generateSeries(name, from, until, int32(step), func(t int32) float64 {
+			v := value
+			value += rand.Float64() - 0.5
+			return v
+		})}
 
-			predictionsOfInterest := predictions[len(predictions)-numStepsToWalkToGetOriginalData:]
+	case "countSeries": // countSeries(*seriesLists)
+		// series lists matching nothing count as zero rather than an error
+		var args []*metricData
+		for _, arg := range e.args {
+			a, _ := getSeriesArg(arg, from, until, values, fetch)
+			args = append(args, a...)
+		}
 
-			r := metricData{FetchResponse: pb.FetchResponse{
-				Name:      proto.String(fmt.Sprintf("holtWintersForecast(%s)", arg.GetName())),
-				Values:    make([]float64, len(predictionsOfInterest)),
-				IsAbsent:  make([]bool, len(predictionsOfInterest)),
-				StepTime:  proto.Int32(arg.GetStepTime()),
-				StartTime: proto.Int32(arg.GetStartTime() + 7*86400),
-				StopTime:  proto.Int32(arg.GetStopTime()),
-			}}
-			r.Values = predictionsOfInterest
+		name := fmt.Sprintf("countSeries(%s)", e.argString)
 
-			results = append(results, &r)
+		if len(args) == 0 {
+			return []*metricData{generateSeries(name, from, until, until-from, func(int32) float64 {
+				return 0
+			})}
 		}
-		return results
+
+		r := *args[0]
+		r.Name = proto.String(name)
+		r.Values = make([]float64, len(args[0].Values))
+		r.IsAbsent = make([]bool, len(args[0].Values))
+		for i := range r.Values {
+			r.Values[i] = float64(len(args))
+		}
+		return []*metricData{&r}
+
+	case "unique": // unique(*seriesLists)
+		args, err := getSeriesArgs(e.args, from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		seen := make(map[string]bool)
+
+		var results []*metricData
+		for _, a := range args {
+			if seen[a.GetName()] {
+				continue
+			}
+			seen[a.GetName()] = true
+			results = append(results, a)
+		}
+		return results
+
+	case "holtWintersForecast": // holtWintersForecast(seriesList)
+		var results []*metricData
+		args, err := getSeriesArgs(e.args, from-7*86400, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		for _, arg := range args {
+			predictions, _, err := holtWintersAnalysis(arg, from, until)
+			if err != nil {
+				return nil
+			}
+
+			r := metricData{FetchResponse: pb.FetchResponse{
+				Name:      proto.String(fmt.Sprintf("holtWintersForecast(%s)", arg.GetName())),
+				Values:    predictions,
+				IsAbsent:  make([]bool, len(predictions)),
+				StepTime:  proto.Int32(arg.GetStepTime()),
+				StartTime: proto.Int32(arg.GetStartTime() + 7*86400),
+				StopTime:  proto.Int32(arg.GetStopTime()),
+			}}
+
+			results = append(results, &r)
+		}
+		return results
+
+	case "holtWintersConfidenceBands", "holtWintersConfidenceArea": // holtWintersConfidenceBands(seriesList, delta=3), holtWintersConfidenceArea(seriesList, delta=3)
+		args, err := getSeriesArg(e.args[0], from-7*86400, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		delta, err := getFloatArgDefault(e, 1, 3)
+		if err != nil {
+			return nil
+		}
+
+		var results []*metricData
+
+		for _, arg := range args {
+			predictions, deviations, err := holtWintersAnalysis(arg, from, until)
+			if err != nil {
+				return nil
+			}
+
+			lowerName := fmt.Sprintf("holtWintersConfidenceLower(%s)", arg.GetName())
+			upperName := fmt.Sprintf("holtWintersConfidenceUpper(%s)", arg.GetName())
+			if e.target == "holtWintersConfidenceArea" {
+				// graphite draws the area between the bands, which we can't;
+				// keep both bands under the area's name
+				lowerName = fmt.Sprintf("holtWintersConfidenceArea(%s)", arg.GetName())
+				upperName = lowerName
+			}
+
+			lower := metricData{FetchResponse: pb.FetchResponse{
+				Name:      proto.String(lowerName),
+				Values:    make([]float64, len(predictions)),
+				IsAbsent:  make([]bool, len(predictions)),
+				StepTime:  proto.Int32(arg.GetStepTime()),
+				StartTime: proto.Int32(arg.GetStartTime() + 7*86400),
+				StopTime:  proto.Int32(arg.GetStopTime()),
+			}}
+
+			upper := lower
+			upper.Name = proto.String(upperName)
+			upper.Values = make([]float64, len(predictions))
+			upper.IsAbsent = make([]bool, len(predictions))
+
+			for i, p := range predictions {
+				lower.Values[i] = p - delta*deviations[i]
+				upper.Values[i] = p + delta*deviations[i]
+			}
+
+			results = append(results, &lower, &upper)
+		}
+		return results
+
+	case "holtWintersAberration": // holtWintersAberration(seriesList, delta=3)
+		args, err := getSeriesArg(e.args[0], from-7*86400, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		delta, err := getFloatArgDefault(e, 1, 3)
+		if err != nil {
+			return nil
+		}
+
+		var results []*metricData
+
+		for _, arg := range args {
+			predictions, deviations, err := holtWintersAnalysis(arg, from, until)
+			if err != nil {
+				return nil
+			}
+
+			r := metricData{FetchResponse: pb.FetchResponse{
+				Name:      proto.String(fmt.Sprintf("holtWintersAberration(%s)", arg.GetName())),
+				Values:    make([]float64, len(predictions)),
+				IsAbsent:  make([]bool, len(predictions)),
+				StepTime:  proto.Int32(arg.GetStepTime()),
+				StartTime: proto.Int32(arg.GetStartTime() + 7*86400),
+				StopTime:  proto.Int32(arg.GetStopTime()),
+			}}
+
+			// the actual values for the requested range follow the bootstrap data
+			offset := len(arg.Values) - len(predictions)
+
+			for i, p := range predictions {
+				j := offset + i
+				if j < 0 || arg.IsAbsent[j] {
+					continue
+				}
+
+				v := arg.Values[j]
+				if upper := p + delta*deviations[i]; v > upper {
+					r.Values[i] = v - upper
+				} else if lower := p - delta*deviations[i]; v < lower {
+					r.Values[i] = v - lower
+				}
+			}
+
+			results = append(results, &r)
+		}
+		return results
 
 	case "squareRoot": // squareRoot(seriesList)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
+		arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2880,7 +4301,7 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		return results
 
 	case "removeBelowValue": // removeBelowValue(seriesLists, n)
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2902,8 +4323,55 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 		}
 		return results
 
+	case "removeBetweenPercentile": // removeBetweenPercentile(seriesList, n)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
+		if err != nil {
+			return nil
+		}
+
+		n, err := getFloatArg(e, 1)
+		if err != nil {
+			return nil
+		}
+
+		if n < 50 {
+			n = 100 - n
+		}
+
+		length := len(args[0].Values)
+		lows := make([]float64, length)
+		highs := make([]float64, length)
+
+		for i := range lows {
+			var points []float64
+			for _, a := range args {
+				if i < len(a.Values) && !a.IsAbsent[i] {
+					points = append(points, a.Values[i])
+				}
+			}
+
+			lows[i] = percentile(points, 100-n, false)
+			highs[i] = percentile(points, n, false)
+		}
+
+		var results []*metricData
+
+		// keep the series with at least one point outside the band
+		for _, a := range args {
+			for i, v := range a.Values {
+				if i >= length || a.IsAbsent[i] {
+					continue
+				}
+				if !(lows[i] < v && v < highs[i]) {
+					results = append(results, a)
+					break
+				}
+			}
+		}
+		return results
+
 	case "removeAboveValue": // removeAboveValue(seriesLists, n)
-		args, err := getSeriesArg(e.args[0], from, until, values)
+		args, err := getSeriesArg(e.args[0], from, until, values, fetch)
 		if err != nil {
 			return nil
 		}
@@ -2931,6 +4399,416 @@ func evalExpr(e *expr, from, until int32, values map[metricRequest][]*metricData
 	return nil
 }
 
+// smoothing parameters for the holtWinters* functions, same as graphite
+const (
+	hwAlpha = 0.1
+	hwBeta  = 0.0035
+	hwGamma = 0.1
+)
+
+var errShortBootstrap = errors.New("not enough data to bootstrap holt-winters")
+
+// holtWintersAnalysis forecasts the [from, until) part of the series using
+// the bootstrap data fetched before it.  It returns the predictions and the
+// expected (seasonal) deviation at each point, used for the confidence bands.
+func holtWintersAnalysis(arg *metricData, from, until int32) ([]float64, []float64, error) {
+	stepTime := arg.GetStepTime()
+	numStepsToWalkToGetOriginalData := int((until - from) / stepTime)
+
+	bootStrapLen := len(arg.Values) - numStepsToWalkToGetOriginalData
+	if bootStrapLen <= 0 {
+		return nil, nil, errShortBootstrap
+	}
+
+	bootStrapSeries := arg.Values[:bootStrapLen]
+
+	//In line with graphite, we define a season as a single day.
+	//A period is the number of steps that make a season.
+	period := int((24 * 60 * 60) / stepTime)
+
+	predictions, err := holtwinters.Forecast(bootStrapSeries, hwAlpha, hwBeta, hwGamma, period, numStepsToWalkToGetOriginalData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// deviations are smoothed per season, like the seasonal component itself
+	deviations := make([]float64, len(predictions))
+	expected := make([]float64, len(predictions))
+	for i, p := range predictions {
+		if i >= period {
+			expected[i] = deviations[i-period]
+		}
+
+		if i >= len(arg.Values) || arg.IsAbsent[i] {
+			deviations[i] = expected[i]
+			continue
+		}
+
+		deviations[i] = hwGamma*math.Abs(arg.Values[i]-p) + (1-hwGamma)*expected[i]
+	}
+
+	first := len(predictions) - numStepsToWalkToGetOriginalData
+
+	return predictions[first:], expected[first:], nil
+}
+
+// seriesListsOps combine two points for the *SeriesLists functions, with
+// the same handling of absent (NaN) points as the functions they are named
+// after
+var seriesListsOps = map[string]func(a, b float64) float64{
+	"sumSeries": func(a, b float64) float64 {
+		switch {
+		case math.IsNaN(a):
+			return b
+		case math.IsNaN(b):
+			return a
+		}
+		return a + b
+	},
+	"diffSeries": func(a, b float64) float64 {
+		if math.IsNaN(b) {
+			return a
+		}
+		return a - b
+	},
+	"multiplySeries": func(a, b float64) float64 {
+		return a * b
+	},
+	"divideSeries": func(a, b float64) float64 {
+		if b == 0 {
+			return math.NaN()
+		}
+		return a / b
+	},
+}
+
+func sortedByName(args []*metricData) []*metricData {
+	sorted := append([]*metricData(nil), args...)
+	sort.Sort(ByName(sorted))
+	return sorted
+}
+
+// percentOf returns a as a percentage of total.  A nil total means there
+// was no total to match a with.
+func percentOf(a, total *metricData) *metricData {
+	r := *a
+	r.Values = make([]float64, len(a.Values))
+	r.IsAbsent = make([]bool, len(a.Values))
+
+	if total == nil {
+		r.Name = proto.String(fmt.Sprintf("asPercent(%s,MISSING)", a.GetName()))
+		for i := range r.IsAbsent {
+			r.IsAbsent[i] = true
+		}
+		return &r
+	}
+
+	r.Name = proto.String(fmt.Sprintf("asPercent(%s,%s)", a.GetName(), total.GetName()))
+
+	for i, v := range a.Values {
+		if a.IsAbsent[i] || i >= len(total.Values) || total.IsAbsent[i] || total.Values[i] == 0 {
+			r.IsAbsent[i] = true
+			continue
+		}
+		r.Values[i] = (v / total.Values[i]) * 100
+	}
+	return &r
+}
+
+// constantSeries returns a series named name with the shape of a and every
+// value set to v
+func constantSeries(name string, a *metricData, v float64) *metricData {
+	r := *a
+	r.Name = proto.String(name)
+	r.Values = make([]float64, len(a.Values))
+	r.IsAbsent = make([]bool, len(a.Values))
+	for i := range r.Values {
+		r.Values[i] = v
+	}
+	return &r
+}
+
+// sumOfSeries adds up group into a single series, as sumSeries would
+func sumOfSeries(group []*metricData) *metricData {
+	if len(group) == 1 {
+		return group[0]
+	}
+
+	var names []string
+	for _, a := range group {
+		names = append(names, a.GetName())
+	}
+
+	r := constantSeries(fmt.Sprintf("sumSeries(%s)", strings.Join(names, ",")), group[0], 0)
+	for i := range r.Values {
+		r.IsAbsent[i] = true
+		for _, a := range group {
+			if i < len(a.Values) && !a.IsAbsent[i] {
+				r.Values[i] += a.Values[i]
+				r.IsAbsent[i] = false
+			}
+		}
+	}
+	return r
+}
+
+// groupByNodes groups series by the given nodes of their names, returning
+// the keys in order of first appearance
+func groupByNodes(args []*metricData, fields []int) ([]string, map[string][]*metricData) {
+	var keys []string
+	groups := make(map[string][]*metricData)
+
+	for _, a := range args {
+		nodes, _ := metricNodesAndTags(a.GetName())
+
+		var key []string
+		for _, f := range fields {
+			if f < 0 {
+				f += len(nodes)
+			}
+			if f >= 0 && f < len(nodes) {
+				key = append(key, nodes[f])
+			}
+		}
+		k := strings.Join(key, ".")
+
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], a)
+	}
+
+	return keys, groups
+}
+
+// asPercentByNodes matches each series with the total sharing the same
+// nodes.  Without a total list, each group is its own total.  Series and
+// totals without a match are returned with every point absent.
+func asPercentByNodes(args, total []*metricData, nodes []int) []*metricData {
+
+	keys, groups := groupByNodes(sortedByName(args), nodes)
+
+	totalKeys, totals := keys, groups
+	if total != nil {
+		totalKeys, totals = groupByNodes(sortedByName(total), nodes)
+	}
+
+	var results []*metricData
+
+	for _, k := range keys {
+		var t *metricData
+		if group, ok := totals[k]; ok {
+			t = sumOfSeries(group)
+		}
+		for _, a := range groups[k] {
+			results = append(results, percentOf(a, t))
+		}
+	}
+
+	for _, k := range totalKeys {
+		if _, ok := groups[k]; ok {
+			continue
+		}
+		t := sumOfSeries(totals[k])
+		r := constantSeries(fmt.Sprintf("asPercent(MISSING,%s)", t.GetName()), t, 0)
+		for i := range r.IsAbsent {
+			r.IsAbsent[i] = true
+		}
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// generateSeries builds a series over [from, until) with f giving the value
+// at each timestamp
+func generateSeries(name string, from, until, step int32, f func(t int32) float64) *metricData {
+	var values []float64
+	for t := from; t < until; t += step {
+		values = append(values, f(t))
+	}
+
+	return &metricData{
+		FetchResponse: pb.FetchResponse{
+			Name:      proto.String(name),
+			StartTime: proto.Int32(from),
+			StopTime:  proto.Int32(from + int32(len(values))*step),
+			StepTime:  proto.Int32(step),
+			Values:    values,
+			IsAbsent:  make([]bool, len(values)),
+		},
+	}
+}
+
+// seriesDeltas sets r to the change between consecutive points of a.  As
+// in graphite, the point after an absent one has no delta.  Counters
+// (nonNegative) ignore values outside [minValue, maxValue], and treat a
+// decrease as a wrap past maxValue or, failing that, a reset to minValue.
+// Without either we can't tell how much the counter grew, so the point is
+// absent.  NaN limits are unset.
+func seriesDeltas(a, r *metricData, nonNegative bool, maxValue, minValue float64) {
+	prev := math.NaN()
+
+	for i, v := range a.Values {
+		r.Values[i] = 0
+		r.IsAbsent[i] = true
+
+		if a.IsAbsent[i] || nonNegative && (v > maxValue || v < minValue) {
+			prev = math.NaN()
+			continue
+		}
+
+		if math.IsNaN(prev) {
+			prev = v
+			continue
+		}
+
+		delta := v - prev
+		prev = v
+
+		if nonNegative && delta < 0 {
+			switch {
+			case !math.IsNaN(maxValue) && !math.IsNaN(minValue):
+				delta += maxValue + 1 - minValue
+			case !math.IsNaN(maxValue):
+				delta += maxValue + 1
+			case !math.IsNaN(minValue):
+				delta = v - minValue
+			default:
+				continue
+			}
+		}
+
+		r.Values[i] = delta
+		r.IsAbsent[i] = false
+	}
+}
+
+// floorDiv is integer division rounding towards negative infinity
+func floorDiv(a, b int32) int32 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// movingWindow summarizes the windowSize points preceding each point of a.
+// Points without a full window before them are absent.
+func movingWindow(a *metricData, windowSize int, summary string, xFilesFactor float64) *metricData {
+	r := *a
+	r.Values = make([]float64, len(a.Values))
+	r.IsAbsent = make([]bool, len(a.Values))
+
+	w := &Windowed{data: make([]float64, windowSize)}
+	window := make([]float64, 0, windowSize)
+
+	for i, v := range a.Values {
+		if i >= windowSize {
+			if summary == "average" {
+				// the common case doesn't need to look at the whole window
+				r.Values[i] = w.Mean()
+				if float64(w.Len()) < xFilesFactor*float64(windowSize) {
+					r.Values[i] = math.NaN()
+				}
+			} else {
+				window = window[:0]
+				for j := i - windowSize; j < i; j++ {
+					if !a.IsAbsent[j] {
+						window = append(window, a.Values[j])
+					}
+				}
+				r.Values[i] = math.NaN()
+				if float64(len(window)) >= xFilesFactor*float64(windowSize) {
+					r.Values[i] = summarizeValues(summary, window)
+				}
+			}
+		} else {
+			r.Values[i] = math.NaN()
+		}
+
+		if a.IsAbsent[i] {
+			// make sure missing values are ignored
+			v = math.NaN()
+		}
+		w.Push(v)
+
+		if math.IsNaN(r.Values[i]) {
+			r.Values[i] = 0
+			r.IsAbsent[i] = true
+		}
+	}
+
+	return &r
+}
+
+// trimBootstrap drops the first n points of r, which were only fetched to
+// fill the window of the first point we were asked for
+func trimBootstrap(r *metricData, n int) {
+	if n > len(r.Values) {
+		n = len(r.Values)
+	}
+
+	r.Values = r.Values[n:]
+	r.IsAbsent = r.IsAbsent[n:]
+	r.StartTime = proto.Int32(r.GetStartTime() + int32(n)*r.GetStepTime())
+}
+
+// linearRegressionAnalysis returns the factor and offset of the least
+// squares line through the points of a in [start, stop]
+func linearRegressionAnalysis(a *metricData, start, stop int32) (float64, float64, bool) {
+	var n, sumI, sumV, sumII, sumIV float64
+
+	t := a.GetStartTime()
+	for i, v := range a.Values {
+		if !a.IsAbsent[i] && t >= start && t <= stop {
+			fi := float64(i)
+			n++
+			sumI += fi
+			sumV += v
+			sumII += fi * fi
+			sumIV += fi * v
+		}
+		t += a.GetStepTime()
+	}
+
+	denominator := n*sumII - sumI*sumI
+	if denominator == 0 {
+		return 0, 0, false
+	}
+
+	factor := (n*sumIV - sumI*sumV) / denominator / float64(a.GetStepTime())
+	offset := (sumII*sumV-sumIV*sumI)/denominator - factor*float64(a.GetStartTime())
+
+	return factor, offset, true
+}
+
+// resizeSeries makes r end at stop, dropping values past it or padding with
+// absent values up to it
+func resizeSeries(r *metricData, stop int32) {
+	step := r.GetStepTime()
+	if step <= 0 {
+		return
+	}
+
+	n := int((stop - r.GetStartTime() + step - 1) / step)
+	if n < 0 {
+		n = 0
+	}
+
+	values := make([]float64, n)
+	absent := make([]bool, n)
+	copied := copy(values, r.Values)
+	copy(absent, r.IsAbsent)
+	for i := copied; i < n; i++ {
+		absent[i] = true
+	}
+
+	r.Values = values
+	r.IsAbsent = absent
+	r.StopTime = proto.Int32(stop)
+}
+
 type removeFunc func(float64, float64) bool
 
 func removeByValue(a *metricData, threshold float64, condition removeFunc) metricData {
@@ -2951,8 +4829,112 @@ func removeByValue(a *metricData, threshold float64, condition removeFunc) metri
 	return r
 }
 
-// Total (sortByTotal), max (sortByMaxima), min (sortByMinima) sorting
-// For 'min', we actually store 1/v so the sorting logic is the same
+// highestSeries returns the n series with the highest summary values,
+// highest first
+func highestSeries(arg []*metricData, n int, summary string) []*metricData {
+
+	// we have fewer arguments than we want result series
+	if len(arg) < n {
+		return arg
+	}
+
+	var mh metricHeap
+
+	for i, a := range arg {
+		m := summarizeSeries(summary, a)
+		if math.IsNaN(m) {
+			continue
+		}
+
+		if len(mh) < n {
+			heap.Push(&mh, metricHeapElement{idx: i, val: m})
+			continue
+		}
+		// m is bigger than smallest max found so far
+		if mh[0].val < m {
+			mh[0].val = m
+			mh[0].idx = i
+			heap.Fix(&mh, 0)
+		}
+	}
+
+	results := make([]*metricData, len(mh))
+
+	// the heap pops the smallest first, so fill from the end
+	for len(mh) > 0 {
+		v := heap.Pop(&mh).(metricHeapElement)
+		results[len(mh)] = arg[v.idx]
+	}
+
+	return results
+}
+
+// lowestSeries returns the n series with the lowest summary values, lowest
+// first
+func lowestSeries(arg []*metricData, n int, summary string) []*metricData {
+
+	// we have fewer arguments than we want result series
+	if len(arg) < n {
+		return arg
+	}
+
+	var mh metricHeap
+
+	for i, a := range arg {
+		m := summarizeSeries(summary, a)
+		if math.IsNaN(m) {
+			continue
+		}
+		heap.Push(&mh, metricHeapElement{idx: i, val: m})
+	}
+
+	var results []*metricData
+
+	// results should be ordered ascending
+	for len(mh) > 0 && len(results) < n {
+		v := heap.Pop(&mh).(metricHeapElement)
+		results = append(results, arg[v.idx])
+	}
+
+	return results
+}
+
+// sortSeries sorts the series by their summary values, in ascending order
+// unless reverse is set
+func sortSeries(arg []*metricData, summary string, reverse bool) []*metricData {
+	// arg may be shared with other expressions
+	arg = append([]*metricData(nil), arg...)
+
+	vals := make([]float64, len(arg))
+
+	for i, a := range arg {
+		vals[i] = summarizeSeries(summary, a)
+	}
+
+	if reverse {
+		sort.Stable(byVals{vals: vals, series: arg})
+	} else {
+		sort.Stable(sort.Reverse(byVals{vals: vals, series: arg}))
+	}
+
+	return arg
+}
+
+// filterSeriesBySummary returns the series whose summary value compares
+// true against threshold
+func filterSeriesBySummary(arg []*metricData, summary string, compare func(float64, float64) bool, threshold float64) []*metricData {
+	var results []*metricData
+
+	for _, a := range arg {
+		if compare(summarizeSeries(summary, a), threshold) {
+			results = append(results, a)
+		}
+	}
+
+	return results
+}
+
+// Sorting series by a summary value, descending
 type byVals struct {
 	vals   []float64
 	series []*metricData
@@ -2975,10 +4957,24 @@ func (s ByName) Len() int           { return len(s) }
 func (s ByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s ByName) Less(i, j int) bool { return s[i].GetName() < s[j].GetName() }
 
+// filterSeriesByName returns the series whose names match (or, if keep is
+// false, don't match) the given predicate
+func filterSeriesByName(args []*metricData, match func(string) bool, keep bool) []*metricData {
+	var results []*metricData
+
+	for _, a := range args {
+		if match(a.GetName()) == keep {
+			results = append(results, a)
+		}
+	}
+
+	return results
+}
+
 type seriesFunc func(*metricData, *metricData) *metricData
 
-func forEachSeriesDo(e *expr, from, until int32, values map[metricRequest][]*metricData, function seriesFunc) []*metricData {
-	arg, err := getSeriesArg(e.args[0], from, until, values)
+func forEachSeriesDo(e *expr, from, until int32, values map[metricRequest][]*metricData, fetch *fetchContext, function seriesFunc) []*metricData {
+	arg, err := getSeriesArg(e.args[0], from, until, values, fetch)
 	if err != nil {
 		return nil
 	}
@@ -3022,6 +5018,34 @@ func aggregateSeries(e *expr, args []*metricData, function aggregateFunc) []*met
 	return []*metricData{&r}
 }
 
+// summarizeSeries applies the summarize function f to the non-absent values of a
+func summarizeSeries(f string, a *metricData) float64 {
+	values := make([]float64, 0, len(a.Values))
+	for i, v := range a.Values {
+		if !a.IsAbsent[i] {
+			values = append(values, v)
+		}
+	}
+
+	return summarizeValues(f, values)
+}
+
+// isSummaryFunc reports whether f is understood by summarizeValues
+func isSummaryFunc(f string) bool {
+	switch f {
+	case "sum", "total", "avg", "average", "median", "max", "min", "last", "current", "first",
+		"diff", "stddev", "count", "range", "multiply":
+		return true
+	}
+
+	if len(f) > 1 && f[0] == 'p' {
+		_, err := strconv.ParseFloat(f[1:], 64)
+		return err == nil
+	}
+
+	return false
+}
+
 func summarizeValues(f string, values []float64) float64 {
 	rv := 0.0
 
@@ -3030,16 +5054,47 @@ func summarizeValues(f string, values []float64) float64 {
 	}
 
 	switch f {
-	case "sum":
+	case "sum", "total":
 		for _, av := range values {
 			rv += av
 		}
 
-	case "avg":
+	case "avg", "average":
 		for _, av := range values {
 			rv += av
 		}
 		rv /= float64(len(values))
+	case "median":
+		rv = percentile(values, 50, true)
+	case "stddev":
+		var sum, sumsq float64
+		for _, av := range values {
+			sum += av
+			sumsq += av * av
+		}
+		n := float64(len(values))
+		rv = math.Sqrt(n*sumsq-sum*sum) / n
+	case "count":
+		rv = float64(len(values))
+	case "range":
+		min, max := math.Inf(1), math.Inf(-1)
+		for _, av := range values {
+			min = math.Min(min, av)
+			max = math.Max(max, av)
+		}
+		rv = max - min
+	case "multiply":
+		rv = 1
+		for _, av := range values {
+			rv *= av
+		}
+	case "diff":
+		rv = values[0]
+		for _, av := range values[1:] {
+			rv -= av
+		}
+	case "first":
+		rv = values[0]
 	case "max":
 		rv = math.Inf(-1)
 		for _, av := range values {
@@ -3054,16 +5109,18 @@ func summarizeValues(f string, values []float64) float64 {
 				rv = av
 			}
 		}
-	case "last":
+	case "last", "current":
 		if len(values) > 0 {
 			rv = values[len(values)-1]
 		}
 
 	default:
-		f = strings.Split(f, "p")[1]
-		percent, err := strconv.ParseFloat(f, 64)
-		if err == nil {
-			rv = percentile(values, percent, true)
+		rv = math.NaN()
+		if len(f) > 1 && f[0] == 'p' {
+			percent, err := strconv.ParseFloat(f[1:], 64)
+			if err == nil {
+				rv = percentile(values, percent, true)
+			}
 		}
 	}
 
@@ -3100,19 +5157,24 @@ func alignToBucketSize(start, stop, bucketSize int32) (int32, int32) {
 func extractMetric(m string) string {
 
 	// search for a metric name in `m'
-	// metric name is defined to be a series of name characters terminated by a comma
+	// metric name is defined to be a series of name characters and glob
+	// groups terminated by a comma or a closing paren
 
 	start := 0
 	end := 0
-	curlyBraces := 0
 	for end < len(m) {
-		if m[end] == '{' {
-			curlyBraces++
-		} else if m[end] == '}' {
-			curlyBraces--
-		} else if m[end] == ')' || (m[end] == ',' && curlyBraces == 0) {
+		switch c := m[end]; {
+		case c == '{' || c == '[':
+			groupEnd := globGroupEnd(m, end)
+			if groupEnd == -1 {
+				return m[start:]
+			}
+			end = groupEnd
+			continue
+		case c == ')' || c == ',':
 			return m[start:end]
-		} else if !(isNameChar(m[end]) || m[end] == ',') {
+		case !isNameChar(c) && c != ';' && c != '=':
+			// tags (`foo.bar;dc=ams') are part of the metric name
 			start = end + 1
 		}
 
@@ -3122,6 +5184,116 @@ func extractMetric(m string) string {
 	return m[start:end]
 }
 
+// metricNodesAndTags returns the nodes and tags of the metric inside a
+// (possibly function wrapped) series name
+func metricNodesAndTags(name string) ([]string, map[string]string) {
+
+	metric := extractMetric(name)
+
+	tags := make(map[string]string)
+
+	parts := strings.Split(metric, ";")
+	for _, t := range parts[1:] {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		}
+	}
+
+	return splitMetric(parts[0]), tags
+}
+
+var aliasTemplatePlaceholder = regexp.MustCompile(`\{(node-?[0-9]+|tag\.[^}]+)\}`)
+
+// expandAliasTemplate replaces {nodeN} and {tag.name} in template.  Negative
+// node indexes count from the end; nodes and tags that don't exist expand to
+// the empty string.
+func expandAliasTemplate(template string, nodes []string, tags map[string]string) string {
+	return aliasTemplatePlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		key := p[1 : len(p)-1]
+
+		if strings.HasPrefix(key, "tag.") {
+			return tags[key[len("tag."):]]
+		}
+
+		n, _ := strconv.Atoi(key[len("node"):])
+		if n < 0 {
+			n += len(nodes)
+		}
+		if n < 0 || n >= len(nodes) {
+			return ""
+		}
+		return nodes[n]
+	})
+}
+
+var aliasQueryVerb = regexp.MustCompile(`^%[-+ 0#]*[0-9]*(\.[0-9]+)?[difgs]`)
+
+// formatAliasQuery formats v into a python-style newName, as given to
+// aliasQuery.  Only the first %d, %i, %f, %g or %s is given v; %% and any
+// other % are left as a literal %.
+func formatAliasQuery(newName string, v float64) string {
+
+	var out []byte
+	formatted := false
+
+	for i := 0; i < len(newName); i++ {
+		c := newName[i]
+		if c != '%' {
+			out = append(out, c)
+			continue
+		}
+
+		if strings.HasPrefix(newName[i:], "%%") {
+			out = append(out, '%')
+			i++
+			continue
+		}
+
+		verb := aliasQueryVerb.FindString(newName[i:])
+		if verb == "" || formatted {
+			out = append(out, '%')
+			continue
+		}
+		formatted = true
+
+		switch verb[len(verb)-1] {
+		case 'd', 'i':
+			out = append(out, fmt.Sprintf(verb[:len(verb)-1]+"d", int64(v))...)
+		case 's':
+			out = append(out, fmt.Sprintf(verb, pythonFloatString(v))...)
+		default:
+			out = append(out, fmt.Sprintf(verb, v)...)
+		}
+		i += len(verb) - 1
+	}
+
+	return string(out)
+}
+
+// pythonFloatString prints v as python's str() does, so whole numbers keep
+// their ".0" and large and small ones use an exponent
+func pythonFloatString(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "nan"
+	case math.IsInf(v, 1):
+		return "inf"
+	case math.IsInf(v, -1):
+		return "-inf"
+	}
+
+	if a := math.Abs(v); a != 0 && (a < 1e-4 || a >= 1e16) {
+		return strconv.FormatFloat(v, 'e', -1, 64)
+	}
+
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
 func contains(a []int, i int) bool {
 	for _, aa := range a {
 		if aa == i {
@@ -3131,6 +5303,15 @@ func contains(a []int, i int) bool {
 	return false
 }
 
+func indexOf(a []string, s string) int {
+	for i, aa := range a {
+		if aa == s {
+			return i
+		}
+	}
+	return -1
+}
+
 // Based on github.com/dgryski/go-onlinestats
 // Copied here because we don't need the rest of the package, and we only need
 // a small part of this type which we need to modify anyway.
@@ -3233,6 +5414,10 @@ func compareEqual(a float64, b float64) bool {
 	return a == b
 }
 
+func compareNotEqual(a float64, b float64) bool {
+	return a != b
+}
+
 func compareGreater(a float64, b float64) bool {
 	return a > b
 }
@@ -3241,30 +5426,27 @@ func compareGreaterEqual(a float64, b float64) bool {
 	return a >= b
 }
 
-func maxValue(f64s []float64, absent []bool) float64 {
-	m := math.Inf(-1)
-	for i, v := range f64s {
-		if absent[i] {
-			continue
-		}
-		if v > m {
-			m = v
-		}
-	}
-	return m
+var compareOperators = map[string]func(float64, float64) bool{
+	"=":  compareEqual,
+	"!=": compareNotEqual,
+	">":  compareGreater,
+	">=": compareGreaterEqual,
+	"<":  compareLess,
+	"<=": compareLessEqual,
 }
 
-func minValue(f64s []float64, absent []bool) float64 {
-	m := math.Inf(1)
-	for i, v := range f64s {
-		if absent[i] {
-			continue
-		}
-		if v < m {
-			m = v
+// nanValues returns the values of a with NaN for absent points, leaving a as
+// it is
+func nanValues(a *metricData) []float64 {
+	v := make([]float64, len(a.Values))
+	for i := range v {
+		if a.IsAbsent[i] {
+			v[i] = math.NaN()
+		} else {
+			v[i] = a.Values[i]
 		}
 	}
-	return m
+	return v
 }
 
 func avgValue(f64s []float64, absent []bool) float64 {
@@ -3280,17 +5462,6 @@ func avgValue(f64s []float64, absent []bool) float64 {
 	return t / float64(elts)
 }
 
-func currentValue(f64s []float64, absent []bool) float64 {
-
-	for i := len(f64s) - 1; i >= 0; i-- {
-		if !absent[i] {
-			return f64s[i]
-		}
-	}
-
-	return math.NaN()
-}
-
 func varianceValue(f64s []float64, absent []bool) float64 {
 	var squareSum float64
 	var elts int
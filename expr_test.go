@@ -135,7 +135,7 @@ func TestEvalExpr(t *testing.T) {
 		&data,
 	}
 
-	evalExpr(exp, int32(request.from), int32(request.until), metricMap)
+	evalExpr(exp, int32(request.from), int32(request.until), metricMap, nil)
 }
 
 func TestParseExpr(t *testing.T) {
@@ -264,6 +264,29 @@ func TestParseExpr(t *testing.T) {
 				etype:  etName,
 			},
 		},
+		{
+			`servers.{web,api}[!0-9]*.cpu`,
+			&expr{
+				target: "servers.{web,api}[!0-9]*.cpu",
+				etype:  etName,
+			},
+		},
+		{
+			"summarize(metric1, '1h', func='max', alignToFrom = true)",
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "1h", etype: etString},
+				},
+				namedArgs: map[string]*expr{
+					"func":        &expr{valStr: "max", etype: etString},
+					"alignToFrom": &expr{target: "true"},
+				},
+				argString: "metric1, '1h', func='max', alignToFrom = true",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -272,12 +295,102 @@ func TestParseExpr(t *testing.T) {
 			t.Errorf("parse for %+v failed: err=%v", tt.s, err)
 			continue
 		}
+		clearPositions(e)
 		if !reflect.DeepEqual(e, tt.e) {
 			t.Errorf("parse for %+v failed:\ngot  %+s\nwant %+v", tt.s, spew.Sdump(e), spew.Sdump(tt.e))
 		}
 	}
 }
 
+// clearPositions zeroes the offsets recorded by the parser, so parsed trees
+// can be compared with ones built by hand
+func clearPositions(e *expr) {
+	e.pos, e.end = 0, 0
+	for _, a := range e.args {
+		clearPositions(a)
+	}
+	for _, a := range e.namedArgs {
+		clearPositions(a)
+	}
+}
+
+func TestExprPositions(t *testing.T) {
+
+	target := "sum(foo.bar, scale(baz.*, 2.5), 'x')"
+
+	e, _, err := parseExpr(target)
+	if err != nil {
+		t.Fatalf("parseExpr(%q): %v", target, err)
+	}
+
+	nodes := []*expr{e, e.args[0], e.args[1], e.args[1].args[0], e.args[1].args[1], e.args[2]}
+	want := []string{target, "foo.bar", "scale(baz.*, 2.5)", "baz.*", "2.5", "'x'"}
+
+	for i, n := range nodes {
+		if got := target[n.pos:n.end]; got != want[i] {
+			t.Errorf("node %d spans %q, want %q", i, got, want[i])
+		}
+	}
+
+	// operators span both of their operands
+	target = "a.b + 2 * c.d"
+	e, _, err = parseInfixExpr(target)
+	if err != nil {
+		t.Fatalf("parseInfixExpr(%q): %v", target, err)
+	}
+	if got := target[e.pos:e.end]; got != target {
+		t.Errorf("infix expression spans %q, want %q", got, target)
+	}
+	if got := target[e.args[1].pos:e.args[1].end]; got != "2 * c.d" {
+		t.Errorf("infix operand spans %q, want %q", got, "2 * c.d")
+	}
+}
+
+func TestExprString(t *testing.T) {
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"foo.bar", "foo.bar"},
+		{"sumSeries(foo.*,  bar.{a,b})", "sumSeries(foo.*,bar.{a,b})"},
+		{`alias(foo, "bar")`, "alias(foo,'bar')"},
+		{`alias(foo, "it's")`, `alias(foo,"it's")`},
+		{"scale(foo, 1e2)", "scale(foo,100)"},
+		{"hitcount(foo, '1h', true)", "hitcount(foo,'1h',true)"},
+	}
+
+	for _, tt := range tests {
+		e, _, err := parseExpr(tt.target)
+		if err != nil {
+			t.Fatalf("parseExpr(%q): %v", tt.target, err)
+		}
+
+		got := e.String()
+		if got != tt.want {
+			t.Errorf("parseExpr(%q).String()=%q, want %q", tt.target, got, tt.want)
+		}
+
+		again, _, err := parseExpr(got)
+		if err != nil {
+			t.Fatalf("parseExpr(%q): %v", got, err)
+		}
+		if again.String() != got {
+			t.Errorf("%q doesn't round trip: %q", got, again.String())
+		}
+	}
+
+	e := &expr{
+		target:    "summarize",
+		etype:     etFunc,
+		args:      []*expr{{target: "foo"}, {valStr: "1h", etype: etString}},
+		namedArgs: map[string]*expr{"func": {valStr: "max", etype: etString}, "alignToFrom": {target: "true"}},
+	}
+	if got, want := e.String(), "summarize(foo,'1h',alignToFrom=true,func='max')"; got != want {
+		t.Errorf("String()=%q, want %q", got, want)
+	}
+}
+
 func makeResponse(name string, values []float64, step, start int32) *metricData {
 
 	absent := make([]bool, len(values))
@@ -301,6 +414,174 @@ func makeResponse(name string, values []float64, step, start int32) *metricData
 	}}
 }
 
+func TestParseInfixExpr(t *testing.T) {
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"a.b * 100 / (c + d)", "divideSeries(scale(a.b,100),sumSeries(c,d))"},
+		{"a + b * c", "sumSeries(a,multiplySeries(b,c))"},
+		{"a - b - c", "diffSeries(diffSeries(a,b),c)"},
+		{"a / 2", "scale(a,0.5)"},
+		{"a - 5", "offset(a,-5)"},
+		{"10 - a", "offset(scale(a,-1),10)"},
+		{"2 / a", "scale(invert(a),2)"},
+		{"a * (2 + 3)", "scale(a,5)"},
+		{"a.b-c.*", "a.b-c.*"},
+		{"sumSeries(a, b) / c", "divideSeries(sumSeries(a, b),c)"},
+	}
+
+	for _, tt := range tests {
+		exp, e, err := parseInfixExpr(tt.target)
+		if err != nil || e != "" {
+			t.Errorf("failed to parse %s: %v (rest %q)", tt.target, err, e)
+			continue
+		}
+		if got := exprString(exp); got != tt.want {
+			t.Errorf("parseInfixExpr(%s)=%s, want %s", tt.target, got, tt.want)
+		}
+	}
+
+	// arguments to functions may use infix operators too
+	exp, _, err := parseInfixExpr("movingAverage(a + b, 5)")
+	if err != nil || len(exp.args) != 2 || exp.args[0].target != "sumSeries" {
+		t.Errorf("failed to parse infix function argument: %+v: %v", exp, err)
+	}
+
+	for _, target := range []string{"a / 0", "(a + b", "a + 'b'", "a +", "1e308 * 10 + a.b", "a.b / 1e-320"} {
+		if _, _, err := parseInfixExpr(target); err == nil {
+			t.Errorf("parseInfixExpr(%s) succeeded, want error", target)
+		}
+	}
+}
+
+func TestParseKeywordArgErrors(t *testing.T) {
+
+	tests := []struct {
+		target string
+		err    error
+	}{
+		{"summarize(metric1, func='max', '1h')", ErrPositionalAfterName},
+		{"summarize(metric1, '1h', func='max', func='sum')", ErrDuplicateKeyword},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := parseExpr(tt.target); err != tt.err {
+			t.Errorf("parseExpr(%q)=%v, want %v", tt.target, err, tt.err)
+		}
+	}
+}
+
+func TestEvalKeywordArgs(t *testing.T) {
+
+	now32 := int32(time.Now().Unix())
+
+	values := map[metricRequest][]*metricData{
+		metricRequest{"metric*", 0, 1}: []*metricData{
+			makeResponse("metric1", []float64{1, 5, 2, 8}, 1, now32),
+			makeResponse("metric2", []float64{3, 4, 3, 4}, 1, now32),
+		},
+	}
+
+	tests := []struct {
+		keywords   string
+		positional string
+	}{
+		// keywords straight after the positional arguments
+		{"summarize(metric*, intervalString='2s', func='max')", "summarize(metric*, '2s', 'max')"},
+		// and ones which skip an argument
+		{"highest(metric*, func='max')", "highest(metric*, 1, 'max')"},
+		{"scale(seriesList=metric*, factor=2)", "scale(metric*, 2)"},
+	}
+
+	for _, tt := range tests {
+		var got, want []*metricData
+		for _, r := range []struct {
+			target string
+			g      *[]*metricData
+		}{{tt.keywords, &got}, {tt.positional, &want}} {
+			exp, _, err := parseExpr(r.target)
+			if err != nil {
+				t.Fatalf("parseExpr(%q): %v", r.target, err)
+			}
+			if err := validateExpr(exp); err != nil {
+				t.Fatalf("validateExpr(%q): %v", r.target, err)
+			}
+			*r.g = evalExpr(exp, 0, 1, values, nil)
+		}
+
+		if len(got) == 0 || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s=%v, want %v", tt.keywords, got, want)
+		}
+	}
+}
+
+func TestEvalMemoized(t *testing.T) {
+
+	now32 := int32(time.Now().Unix())
+
+	values := map[metricRequest][]*metricData{
+		metricRequest{"a.*", 0, 1}: []*metricData{
+			makeResponse("a.b", []float64{1, 2, 3}, 1, now32),
+			makeResponse("a.c", []float64{3, 2, 1}, 1, now32),
+		},
+	}
+
+	exp, _, err := parseExpr("asPercent(a.*, sumSeries(  a.*))")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	first := evalExpr(exp, 0, 1, values, nil)
+
+	sum, ok := values[metricRequest{"sumSeries(a.*)", 0, 1}]
+	if !ok || len(sum) != 1 {
+		t.Fatalf("sumSeries(a.*) wasn't remembered: %v", sum)
+	}
+
+	// the second time around, both the whole expression and its parts come
+	// from what was remembered
+	sum[0].Values = []float64{8, 8, 8}
+	if again := evalExpr(exp, 0, 1, values, nil); !reflect.DeepEqual(again, first) {
+		t.Errorf("second evaluation differs: %v, want %v", again, first)
+	}
+
+	exp, _, _ = parseExpr("scale(sumSeries(a.*), 2)")
+	if got := evalExpr(exp, 0, 1, values, nil); len(got) != 1 || !reflect.DeepEqual(got[0].Values, []float64{16, 16, 16}) {
+		t.Errorf("sumSeries(a.*) was evaluated again: %v", got)
+	}
+}
+
+func TestEvalInfixExpr(t *testing.T) {
+
+	now32 := int32(time.Now().Unix())
+
+	exp, _, err := parseInfixExpr("a * 100 / (b + c)")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	values := map[metricRequest][]*metricData{
+		metricRequest{"a", 0, 1}: []*metricData{makeResponse("a", []float64{1, 2, math.NaN(), 4}, 1, now32)},
+		metricRequest{"b", 0, 1}: []*metricData{makeResponse("b", []float64{1, 2, 3, math.NaN()}, 1, now32)},
+		metricRequest{"c", 0, 1}: []*metricData{makeResponse("c", []float64{3, 6, 5, 8}, 1, now32)},
+	}
+
+	g := evalExpr(exp, 0, 1, values, nil)
+	if len(g) != 1 {
+		t.Fatalf("got %d series, want 1", len(g))
+	}
+
+	want := []float64{25, 25, math.NaN(), 50}
+	if !nearlyEqual(g[0].Values, g[0].IsAbsent, want) {
+		t.Errorf("got %+v, want %+v", g[0].Values, want)
+	}
+	if name := "divideSeries(scale(a,100),sumSeries(b,c))"; g[0].GetName() != name {
+		t.Errorf("bad name: got %v, want %v", g[0].GetName(), name)
+	}
+}
+
 func TestEvalExpression(t *testing.T) {
 
 	now32 := int32(time.Now().Unix())
@@ -453,7 +734,7 @@ func TestEvalExpression(t *testing.T) {
 			map[metricRequest][]*metricData{
 				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{2, 4, 0, 10, 1, math.NaN(), 8, 40, 37}, 1, now32)},
 			},
-			[]float64{math.NaN(), 2, 29, 10, 24, math.NaN(), math.NaN(), 32, math.NaN()},
+			[]float64{math.NaN(), 2, 29, 10, 24, math.NaN(), math.NaN(), math.NaN(), math.NaN()},
 			"nonNegativeDerivative(metric1,32)",
 		},
 		{
@@ -505,823 +786,797 @@ func TestEvalExpression(t *testing.T) {
 		},
 		{
 			&expr{
-				target: "movingMedian",
+				target: "aliasSub",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 4, etype: etConst},
+					&expr{target: "ip.*TCP*"},
+					&expr{valStr: `^.*TCP(\d+)`, etype: etString},
+					&expr{valStr: `port \1`, etype: etString},
 				},
-				argString: "metric1,4",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8}, 1, now32)},
+				metricRequest{"ip.*TCP*", 0, 1}: []*metricData{makeResponse("ip.foo.TCP8080", []float64{1, 2, 3}, 1, now32)},
 			},
-			[]float64{math.NaN(), math.NaN(), math.NaN(), 1, 1, 1.5, 2, 2, 3, 4, 5, 6},
-			"movingMedian(metric1,4)",
+			[]float64{1, 2, 3},
+			"port 8080",
 		},
 		{
 			&expr{
-				target: "movingMedian",
+				target: "interpolate",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 5, etype: etConst},
 				},
-				argString: "metric1,5",
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), 1, math.NaN(), math.NaN(), 4, math.NaN()}, 1, now32)},
 			},
-			[]float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), 1, 1, 2, 2, 2, 4, 4, 6, 6, 4, 2},
-			"movingMedian(metric1,5)",
+			[]float64{math.NaN(), 1, 2, 3, 4, math.NaN()},
+			"interpolate(metric1)",
 		},
 		{
 			&expr{
-				target: "movingMedian",
+				target: "interpolate",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "1s", etype: etString},
+					&expr{val: 1, etype: etConst},
 				},
-				argString: "metric1,1s",
+				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), 3, math.NaN(), math.NaN(), 6}, 1, now32)},
 			},
-			[]float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, math.NaN()},
-			"movingMedian(metric1,1)",
+			[]float64{1, 2, 3, math.NaN(), math.NaN(), 6},
+			"interpolate(metric1)",
 		},
 		{
 			&expr{
-				target: "movingMedian",
+				target: "delay",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "1min", etype: etString},
+					&expr{val: 2, etype: etConst},
 				},
-				argString: "metric1,1min",
+				argString: "metric1,2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, math.NaN(), 4, 5}, 1, now32)},
 			},
-			[]float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN()},
-			"movingMedian(metric1,60)",
+			[]float64{math.NaN(), math.NaN(), 1, 2, math.NaN()},
+			"delay(metric1,2)",
 		},
 		{
 			&expr{
-				target: "pearson",
+				target: "fallbackSeries",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
 					&expr{target: "metric2"},
-					&expr{val: 6, etype: etConst},
 				},
-				argString: "metric1,metric2,6",
+				argString: "metric1,metric2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{43, 21, 25, 42, 57, 59}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{99, 65, 79, 75, 87, 81}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{1, 2, 3}, 1, now32)},
 			},
-			[]float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), 0.5298089018901744},
-			"pearson(metric1,metric2,6)",
+			[]float64{1, 2, 3},
+			"metric2",
 		},
 		{
 			&expr{
-				target: "scale",
+				target: "useSeriesAbove",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 2.5, etype: etConst},
+					&expr{target: "metric1.reqs"},
+					&expr{val: 10, etype: etConst},
+					&expr{valStr: "reqs", etype: etString},
+					&expr{valStr: "time", etype: etString},
 				},
-				argString: "metric1,2.5",
+				argString: "metric1.reqs,10,'reqs','time'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, math.NaN(), 4, 5}, 1, now32)},
+				metricRequest{"metric1.reqs", 0, 1}: []*metricData{makeResponse("metric1.reqs", []float64{1, 20, 3}, 1, now32)},
+				metricRequest{"metric1.time", 0, 1}: []*metricData{makeResponse("metric1.time", []float64{4, 5, 6}, 1, now32)},
 			},
-			[]float64{2.5, 5.0, math.NaN(), 10.0, 12.5},
-			"scale(metric1,2.5)",
+			[]float64{4, 5, 6},
+			"metric1.time",
 		},
 		{
 			&expr{
-				target: "scaleToSeconds",
+				target: "movingAverage",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 5, etype: etConst},
+					&expr{val: 2, etype: etConst},
 				},
-				argString: "metric1,5",
+				argString: "metric1,2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{60, 120, math.NaN(), 120, 120}, 60, now32)},
+				metricRequest{"metric1", 0, 1}:  []*metricData{makeResponse("metric1", []float64{3, 4, 5, 6}, 1, now32)},
+				metricRequest{"metric1", -2, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5, 6}, 1, now32)},
 			},
-			[]float64{5, 10, math.NaN(), 10, 10},
-			"scaleToSeconds(metric1,5)",
+			[]float64{1.5, 2.5, 3.5, 4.5},
+			"movingAverage(metric1,2)",
 		},
 		{
 			&expr{
-				target: "pow",
+				target: "stdev",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 3, etype: etConst},
+					&expr{val: 2, etype: etConst},
 				},
-				argString: "metric1,3",
+				argString: "metric1,2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{5, 1, math.NaN(), 0, 12, 125, 10.4, 1.1}, 60, now32)},
+				metricRequest{"metric1", 0, 1}:  []*metricData{makeResponse("metric1", []float64{3, 5, 7}, 1, now32)},
+				metricRequest{"metric1", -2, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 3, 5, 7}, 1, now32)},
 			},
-			[]float64{125, 1, math.NaN(), 0, 1728, 1953125, 1124.864, 1.331},
-			"pow(metric1,3)",
+			[]float64{1, 1, 1},
+			"stdev(metric1,2)",
 		},
 		{
 			&expr{
-				target: "keepLastValue",
+				target: "movingAverage",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 3, etype: etConst},
+					&expr{valStr: "2s", etype: etString},
 				},
-				argString: "metric1,3",
+				argString: "metric1,'2s'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), 2, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 4, 5}, 1, now32)},
+				metricRequest{"metric1", -2, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5, 6}, 1, now32)},
 			},
-			[]float64{math.NaN(), 2, 2, 2, 2, math.NaN(), 4, 5},
-			"keepLastValue(metric1,3)",
+			[]float64{1.5, 2.5, 3.5, 4.5},
+			"movingAverage(metric1,2)",
 		},
-
 		{
 			&expr{
-				target: "keepLastValue",
+				target: "movingSum",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
+					&expr{val: 2, etype: etConst},
 				},
-				argString: "metric1",
+				argString: "metric1,2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), 2, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 4, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{math.NaN(), 2, 2, 2, 2, 2, 4, 5},
-			"keepLastValue(metric1)",
+			[]float64{math.NaN(), math.NaN(), 3, 5, 7},
+			"movingSum(metric1,2)",
 		},
 		{
 			&expr{
-				target: "changed",
+				target: "movingMax",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
+					&expr{val: 2, etype: etConst},
 				},
-				argString: "metric1",
+				argString: "metric1,2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), 0, 0, 0, math.NaN(), math.NaN(), 1, 1, 2, 3, 4, 4, 5, 5, 5, 6, 7}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 5, 3, math.NaN(), 2}, 1, now32)},
 			},
-			[]float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 1, 1, 0, 1, 0, 0, 1, 1},
-			"changed(metric1)",
+			[]float64{math.NaN(), math.NaN(), 5, 5, 3},
+			"movingMax(metric1,2)",
 		},
 		{
 			&expr{
-				target: "alias",
+				target: "movingWindow",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "renamed", etype: etString},
+					&expr{valStr: "2s", etype: etString},
+					&expr{valStr: "median", etype: etString},
 				},
+				argString: "metric1,'2s','median'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric1", -2, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5, 6}, 1, now32)},
 			},
-			[]float64{1, 2, 3, 4, 5},
-			"renamed",
+			[]float64{1.5, 2.5, 3.5, 4.5},
+			"movingWindow(metric1,2,'median')",
 		},
 		{
 			&expr{
-				target: "aliasByMetric",
+				target: "exponentialMovingAverage",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.foo.bar.baz"},
+					&expr{target: "metric1"},
+					&expr{val: 2, etype: etConst},
 				},
+				argString: "metric1,2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{2, 4, 6, 8, math.NaN(), 10}, 1, now32)},
 			},
-			[]float64{1, 2, 3, 4, 5},
-			"baz",
+			[]float64{math.NaN(), math.NaN(), 5, 7, math.NaN(), 9},
+			"exponentialMovingAverage(metric1,2)",
 		},
 		{
 			&expr{
-				target: "aliasByNode",
+				target: "linearRegression",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.foo.bar.baz"},
-					&expr{val: 1, etype: etConst},
+					&expr{target: "metric1"},
 				},
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 3, math.NaN(), 7}, 1, 0)},
 			},
-			[]float64{1, 2, 3, 4, 5},
-			"foo",
+			[]float64{1, 3, 5, 7},
+			"linearRegression(metric1,0,1)",
 		},
 		{
 			&expr{
-				target: "aliasByNode",
+				target: "removeBetweenPercentile",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.foo.bar.baz"},
-					&expr{val: 1, etype: etConst},
-					&expr{val: 3, etype: etConst},
+					&expr{target: "metric1"},
+					&expr{val: 30, etype: etConst},
 				},
+				argString: "metric1,30",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
-			},
-			[]float64{1, 2, 3, 4, 5},
-			"foo.baz",
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricE", []float64{5, 5}, 1, now32),
+					makeResponse("metricF", []float64{6, 6}, 1, now32),
+					makeResponse("metricG", []float64{7, 7}, 1, now32),
+					makeResponse("metricA", []float64{1, 1}, 1, now32),
+					makeResponse("metricB", []float64{2, 2}, 1, now32),
+					makeResponse("metricC", []float64{3, 3}, 1, now32),
+					makeResponse("metricD", []float64{4, 4}, 1, now32),
+					makeResponse("metricH", []float64{8, 8}, 1, now32),
+					makeResponse("metricI", []float64{9, 9}, 1, now32),
+					makeResponse("metricJ", []float64{10, 10}, 1, now32),
+				},
+			},
+			[]float64{1, 1},
+			"metricA",
 		},
 		{
 			&expr{
-				target: "aliasByNode",
+				target: "movingMedian",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.foo.bar.baz"},
-					&expr{val: 1, etype: etConst},
-					&expr{val: -2, etype: etConst},
-				},
+					&expr{target: "metric1"},
+					&expr{val: 4, etype: etConst},
+				},
+				argString: "metric1,4",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8}, 1, now32)},
 			},
-			[]float64{1, 2, 3, 4, 5},
-			"foo.bar",
+			[]float64{math.NaN(), math.NaN(), math.NaN(), 1, 1, 1.5, 2, 2, 3, 4, 5, 6},
+			"movingMedian(metric1,4)",
 		},
 		{
 			&expr{
-				target: "aliasSub",
+				target: "movingMedian",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.foo.bar.baz"},
-					&expr{valStr: "foo", etype: etString},
-					&expr{valStr: "replaced", etype: etString},
+					&expr{target: "metric1"},
+					&expr{val: 5, etype: etConst},
 				},
+				argString: "metric1,5",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, math.NaN()}, 1, now32)},
 			},
-			[]float64{1, 2, 3, 4, 5},
-			"metric1.replaced.bar.baz",
+			[]float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), 1, 1, 2, 2, 2, 4, 4, 6, 6, 4, 2},
+			"movingMedian(metric1,5)",
 		},
 		{
 			&expr{
-				target: "aliasSub",
+				target: "movingMedian",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.TCP100"},
-					&expr{valStr: "^.*TCP(\\d+)", etype: etString},
-					&expr{valStr: "$1", etype: etString},
+					&expr{target: "metric1"},
+					&expr{valStr: "1s", etype: etString},
 				},
+				argString: "metric1,1s",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.TCP100", 0, 1}: []*metricData{makeResponse("metric1.TCP100", []float64{1, 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric1", -1, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, math.NaN()}, 1, now32)},
 			},
-			[]float64{1, 2, 3, 4, 5},
-			"100",
+			[]float64{1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, math.NaN()},
+			"movingMedian(metric1,1)",
 		},
 		{
 			&expr{
-				target: "derivative",
+				target: "movingMedian",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
+					&expr{valStr: "1min", etype: etString},
 				},
+				argString: "metric1,1min",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{2, 4, 6, 1, 4, math.NaN(), 8}, 1, now32)},
+				metricRequest{"metric1", -60, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, math.NaN()}, 1, now32)},
 			},
-			[]float64{math.NaN(), 2, 2, -5, 3, math.NaN(), 4},
-			"derivative(metric1)",
+			// all of the points fetched were bootstrap for the window
+			[]float64{},
+			"movingMedian(metric1,60)",
 		},
 		{
 			&expr{
-				target: "avg",
+				target: "pearson",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
 					&expr{target: "metric2"},
-					&expr{target: "metric3"}},
-				argString: "metric1,metric2,metric3",
+					&expr{val: 6, etype: etConst},
+				},
+				argString: "metric1,metric2,6",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), 2, 3, 4, 5}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 5, 6}, 1, now32)},
-				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{3, math.NaN(), 4, 5, 6, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{43, 21, 25, 42, 57, 59}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{99, 65, 79, 75, 87, 81}, 1, now32)},
 			},
-			[]float64{2, math.NaN(), 3, 4, 5, 5.5},
-			"averageSeries(metric1,metric2,metric3)",
+			[]float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), 0.5298089018901744},
+			"pearson(metric1,metric2,6)",
 		},
 		{
 			&expr{
-				target: "maxSeries",
+				target: "scale",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
-					&expr{target: "metric3"}},
-				argString: "metric1,metric2,metric3",
+					&expr{val: 2.5, etype: etConst},
+				},
+				argString: "metric1,2.5",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), 2, 3, 4, 5}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 5, 6}, 1, now32)},
-				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{3, math.NaN(), 4, 5, 6, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, math.NaN(), 4, 5}, 1, now32)},
 			},
-			[]float64{3, math.NaN(), 4, 5, 6, 6},
-			"maxSeries(metric1,metric2,metric3)",
+			[]float64{2.5, 5.0, math.NaN(), 10.0, 12.5},
+			"scale(metric1,2.5)",
 		},
 		{
 			&expr{
-				target: "minSeries",
+				target: "scaleToSeconds",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
-					&expr{target: "metric3"}},
-				argString: "metric1,metric2,metric3",
+					&expr{val: 5, etype: etConst},
+				},
+				argString: "metric1,5",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), 2, 3, 4, 5}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 5, 6}, 1, now32)},
-				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{3, math.NaN(), 4, 5, 6, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{60, 120, math.NaN(), 120, 120}, 60, now32)},
 			},
-			[]float64{1, math.NaN(), 2, 3, 4, 5},
-			"minSeries(metric1,metric2,metric3)",
+			[]float64{5, 10, math.NaN(), 10, 10},
+			"scaleToSeconds(metric1,5)",
 		},
 		{
 			&expr{
-				target: "asPercent",
+				target: "pow",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
+					&expr{val: 3, etype: etConst},
 				},
-				argString: "metric1,metric2",
+				argString: "metric1,3",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{5, 1, math.NaN(), 0, 12, 125, 10.4, 1.1}, 60, now32)},
 			},
-			[]float64{50, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 200},
-			"asPercent(metric1,metric2)",
+			[]float64{125, 1, math.NaN(), 0, 1728, 1953125, 1124.864, 1.331},
+			"pow(metric1,3)",
 		},
 		{
 			&expr{
-				target: "divideSeries",
+				target: "keepLastValue",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
+					&expr{val: 3, etype: etConst},
 				},
-				argString: "metric1,metric2",
+				argString: "metric1,3",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), 2, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 4, 5}, 1, now32)},
 			},
-			[]float64{0.5, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 2},
-			"divideSeries(metric1,metric2)",
+			[]float64{math.NaN(), 2, 2, 2, 2, math.NaN(), 4, 5},
+			"keepLastValue(metric1,3)",
 		},
 		{
 			&expr{
-				target: "multiplySeries",
+				target: "keepLastValue",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
+					&expr{target: "None"},
 				},
-				argString: "metric1,metric2",
+				argString: "metric1,None",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), 2, math.NaN(), math.NaN(), 4}, 1, now32)},
 			},
-			[]float64{2, math.NaN(), math.NaN(), math.NaN(), 0, 72},
-			"multiplySeries(metric1,metric2)",
+			[]float64{math.NaN(), 2, 2, 2, 4},
+			"keepLastValue(metric1,None)",
 		},
+
 		{
 			&expr{
-				target: "multiplySeries",
+				target: "keepLastValue",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
-					&expr{target: "metric3"},
 				},
-				argString: "metric1,metric2,metric3",
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
-				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{3, math.NaN(), 4, math.NaN(), 7, 8}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), 2, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 4, 5}, 1, now32)},
 			},
-			[]float64{6, math.NaN(), math.NaN(), math.NaN(), 0, 576},
-			"multiplySeries(metric1,metric2,metric3)",
+			[]float64{math.NaN(), 2, 2, 2, 2, 2, 4, 5},
+			"keepLastValue(metric1)",
 		},
 		{
 			&expr{
-				target: "diffSeries",
+				target: "changed",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
 				},
-				argString: "metric1,metric2",
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), 0, 0, 0, math.NaN(), math.NaN(), 1, 1, 2, 3, 4, 4, 5, 5, 5, 6, 7}, 1, now32)},
 			},
-			[]float64{-1, math.NaN(), math.NaN(), 3, 4, 6},
-			"diffSeries(metric1,metric2)",
+			[]float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 1, 1, 0, 1, 0, 0, 1, 1},
+			"changed(metric1)",
 		},
 		{
 			&expr{
-				target: "diffSeries",
+				target: "alias",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
-					&expr{target: "metric3"},
+					&expr{valStr: "renamed", etype: etString},
 				},
-				argString: "metric1,metric2,metric3",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{5, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
-				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{3, math.NaN(), 3, math.NaN(), 0, 7}, 1, now32)},
-				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{1, math.NaN(), 3, math.NaN(), 0, 4}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{1, math.NaN(), math.NaN(), 3, 4, 1},
-			"diffSeries(metric1,metric2,metric3)",
+			[]float64{1, 2, 3, 4, 5},
+			"renamed",
 		},
 		{
 			&expr{
-				target: "transformNull",
+				target: "aliasByMetric",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
+					&expr{target: "metric1.foo.bar.baz"},
 				},
-				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
+				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{1, 0, 0, 3, 4, 12},
-			"transformNull(metric1)",
+			[]float64{1, 2, 3, 4, 5},
+			"baz",
 		},
 		{
 			&expr{
-				target: "transformNull",
+				target: "aliasByNode",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 5, etype: etConst},
+					&expr{target: "metric1.foo.bar.baz"},
+					&expr{val: -1, etype: etConst},
+					&expr{val: 0, etype: etConst},
 				},
-				argString: "metric1,5",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
+				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("scale(metric1.foo.bar.baz;dc=ams,2)", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{1, 5, 5, 3, 4, 12},
-			"transformNull(metric1,5)",
+			[]float64{1, 2, 3, 4, 5},
+			"baz.metric1",
 		},
 		{
 			&expr{
-				target: "highestMax",
+				target: "aliasTemplate",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 1, etype: etConst},
+					&expr{target: "metric1.foo.bar.baz"},
+					&expr{valStr: "{node0}-{node2} ({tag.dc}) {node-1}{node9}{tag.missing}", etype: etString},
 				},
-				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{1, 1, 3, 3, 12, 11}, 1, now32),
-					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
-					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 10}, 1, now32),
-				},
+				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("movingAverage(metric1.foo.bar.baz;dc=ams,5)", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{1, 1, 3, 3, 12, 11},
-			"metricA", // NOTE(dgryski): not sure if this matches graphite
+			[]float64{1, 2, 3, 4, 5},
+			"metric1-bar (ams) baz",
 		},
 		{
 			&expr{
-				target: "lowestCurrent",
+				target: "legendValue",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 1, etype: etConst},
+					&expr{valStr: "avg", etype: etString},
+					&expr{valStr: "max", etype: etString},
 				},
-				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
-					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
-					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{1, 1, 3, 3, 4, 1},
-			"metricB", // NOTE(dgryski): not sure if this matches graphite
+			[]float64{1, 2, 3, 4, 5},
+			"metric1             avg  3.00      max  5.00      ",
 		},
 		{
 			&expr{
-				target: "highestCurrent",
+				target: "aliasQuery",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 1, etype: etConst},
+					&expr{target: "hosts.*.cpu"},
+					&expr{valStr: `hosts\.([^.]+)\.cpu`, etype: etString},
+					&expr{valStr: "hosts.$1.cores", etype: etString},
+					&expr{valStr: "%d cores", etype: etString},
 				},
-				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metric0", []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN()}, 1, now32),
-					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
-					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
-					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
-				},
+				metricRequest{"hosts.*.cpu", 0, 1}:      []*metricData{makeResponse("hosts.web1.cpu", []float64{1, 2, 3}, 1, now32)},
+				metricRequest{"hosts.web1.cores", 0, 1}: []*metricData{makeResponse("hosts.web1.cores", []float64{8, 16, math.NaN()}, 1, now32)},
 			},
-			[]float64{1, 1, 3, 3, 4, 15},
-			"metricC", // NOTE(dgryski): not sure if this matches graphite
+			[]float64{1, 2, 3},
+			"16 cores",
 		},
 		{
 			&expr{
-				target: "highestAverage",
+				target: "aliasQuery",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 1, etype: etConst},
+					&expr{target: "hosts.*.cpu"},
+					&expr{valStr: `hosts\.([^.]+)\.cpu`, etype: etString},
+					&expr{valStr: "hosts.$1.cores", etype: etString},
+					&expr{valStr: "x %s", etype: etString},
 				},
-				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
-					makeResponse("metricB", []float64{1, 5, 5, 5, 5, 5}, 1, now32),
-					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 10}, 1, now32),
-				},
+				metricRequest{"hosts.*.cpu", 0, 1}:      []*metricData{makeResponse("hosts.web1.cpu", []float64{1, 2, 3}, 1, now32)},
+				metricRequest{"hosts.web1.cores", 0, 1}: []*metricData{makeResponse("hosts.web1.cores", []float64{8, 16, math.NaN()}, 1, now32)},
 			},
-			[]float64{1, 5, 5, 5, 5, 5},
-			"metricB", // NOTE(dgryski): not sure if this matches graphite
+			[]float64{1, 2, 3},
+			"x 16.0",
 		},
 		{
 			&expr{
-				target: "exclude",
+				target: "aliasByNode",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{valStr: "(Foo|Baz)", etype: etString},
+					&expr{target: "metric1.foo.bar.baz"},
+					&expr{val: 1, etype: etConst},
 				},
-				argString: "metric1,'(Foo|Baz)'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricFoo", []float64{1, 1, 1, 1, 1}, 1, now32),
-					makeResponse("metricBar", []float64{2, 2, 2, 2, 2}, 1, now32),
-					makeResponse("metricBaz", []float64{3, 3, 3, 3, 3}, 1, now32),
-				},
+				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{2, 2, 2, 2, 2},
-			"metricBar", // NOTE(dgryski): not sure if this matches graphite
+			[]float64{1, 2, 3, 4, 5},
+			"foo",
 		},
 		{
 			&expr{
-				target: "grep",
+				target: "aliasByNode",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{valStr: "Bar", etype: etString},
+					&expr{target: "metric1.foo.bar.baz"},
+					&expr{val: 1, etype: etConst},
+					&expr{val: 3, etype: etConst},
 				},
-				argString: "metric1,'Bar'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricFoo", []float64{1, 1, 1, 1, 1}, 1, now32),
-					makeResponse("metricBar", []float64{2, 2, 2, 2, 2}, 1, now32),
-					makeResponse("metricBaz", []float64{3, 3, 3, 3, 3}, 1, now32),
-				},
+				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{2, 2, 2, 2, 2},
-			"metricBar", // NOTE(dgryski): not sure if this matches graphite
+			[]float64{1, 2, 3, 4, 5},
+			"foo.baz",
 		},
 		{
 			&expr{
-				target: "logarithm",
+				target: "aliasByNode",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
+					&expr{target: "metric1.foo.bar.baz"},
+					&expr{val: 1, etype: etConst},
+					&expr{val: -2, etype: etConst},
 				},
-				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 10, 100, 1000, 10000}, 1, now32)},
+				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{0, 1, 2, 3, 4},
-			"logarithm(metric1)",
+			[]float64{1, 2, 3, 4, 5},
+			"foo.bar",
 		},
 		{
 			&expr{
-				target: "logarithm",
+				target: "aliasSub",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 2, etype: etConst},
+					&expr{target: "metric1.foo.bar.baz"},
+					&expr{valStr: "foo", etype: etString},
+					&expr{valStr: "replaced", etype: etString},
 				},
-				argString: "metric1,2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 4, 8, 16, 32}, 1, now32)},
+				metricRequest{"metric1.foo.bar.baz", 0, 1}: []*metricData{makeResponse("metric1.foo.bar.baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{0, 1, 2, 3, 4, 5},
-			"logarithm(metric1,2)",
+			[]float64{1, 2, 3, 4, 5},
+			"metric1.replaced.bar.baz",
 		},
 		{
 			&expr{
-				target: "absolute",
+				target: "aliasSub",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
+					&expr{target: "metric1.TCP100"},
+					&expr{valStr: "^.*TCP(\\d+)", etype: etString},
+					&expr{valStr: "$1", etype: etString},
 				},
-				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{0, -1, 2, -3, 4, 5}, 1, now32)},
+				metricRequest{"metric1.TCP100", 0, 1}: []*metricData{makeResponse("metric1.TCP100", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
-			[]float64{0, 1, 2, 3, 4, 5},
-			"absolute(metric1)",
+			[]float64{1, 2, 3, 4, 5},
+			"100",
 		},
 		{
 			&expr{
-				target: "isNonNull",
+				target: "derivative",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
 				},
-				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), -1, math.NaN(), -3, 4, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{2, 4, 6, 1, 4, math.NaN(), 8}, 1, now32)},
 			},
-			[]float64{0, 1, 0, 1, 1, 1},
-			"isNonNull(metric1)",
+			[]float64{math.NaN(), 2, 2, -5, 3, math.NaN(), math.NaN()},
+			"derivative(metric1)",
 		},
 		{
 			&expr{
-				target: "averageAbove",
+				target: "countSeries",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 5, etype: etConst},
+					&expr{target: "metric1.*"},
 				},
-				argString: "metric1,5",
+				argString: "metric1.*",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
+				metricRequest{"metric1.*", 0, 1}: []*metricData{
+					makeResponse("metric1.foo", []float64{1, 2, 3}, 1, now32),
+					makeResponse("metric1.bar", []float64{1, math.NaN(), 3}, 1, now32),
 				},
 			},
-			[]float64{3, 4, 5, 6, 7, 8},
-			"metricB",
+			[]float64{2, 2, 2},
+			"countSeries(metric1.*)",
 		},
 		{
 			&expr{
-				target: "averageBelow",
+				target: "countSeries",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{val: 0, etype: etConst},
+					&expr{target: "metric2.*"},
 				},
-				argString: "metric1,0",
+				argString: "metric2.*",
 			},
-			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{0, 4, 4, 5, 5, 6}, 1, now32),
+			map[metricRequest][]*metricData{},
+			[]float64{0},
+			"countSeries(metric2.*)",
+		},
+		{
+			&expr{
+				target: "countSeries",
+				etype:  etFunc,
+			},
+			map[metricRequest][]*metricData{},
+			[]float64{0},
+			"countSeries()",
+		},
+		{
+			&expr{
+				target: "timeFunction",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{valStr: "the.time", etype: etString},
+					&expr{val: 1, etype: etConst},
 				},
+				argString: "'the.time',1",
 			},
-			[]float64{0, 0, 0, 0, 0, 0},
-			"metricA",
+			nil,
+			[]float64{0},
+			"the.time",
 		},
 		{
 			&expr{
-				target: "maximumAbove",
+				target: "perSecond",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 6, etype: etConst},
+					&expr{val: 255, etype: etConst},
 				},
-				argString: "metric1,6",
+				argString: "metric1,255",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{200, 250, 44, math.NaN(), 100, 120}, 10, now32)},
 			},
-			[]float64{3, 4, 5, 6, 7, 8},
-			"metricB",
+			[]float64{math.NaN(), 5, 5, math.NaN(), math.NaN(), 2},
+			"perSecond(metric1,255)",
 		},
 		{
 			&expr{
-				target: "maximumBelow",
+				target: "nonNegativeDerivative",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 5, etype: etConst},
+					&expr{val: math.NaN(), etype: etConst},
+					&expr{val: 0, etype: etConst},
 				},
-				argString: "metric1,5",
+				argString: "metric1,NaN,0",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{10, 20, 5, 15}, 1, now32)},
 			},
-			[]float64{0, 0, 0, 0, 0, 0},
-			"metricA",
+			[]float64{math.NaN(), 10, 5, 10},
+			"nonNegativeDerivative(metric1,NaN,0)",
 		},
 		{
 			&expr{
-				target: "minimumAbove",
+				target: "nonNegativeDerivative",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 1, etype: etConst},
+					&expr{target: "None"},
+					&expr{val: 0, etype: etConst},
 				},
-				argString: "metric1,1",
+				argString: "metric1,None,0",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{1, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{2, 4, 4, 5, 5, 6}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{10, 20, 5, 15}, 1, now32)},
 			},
-			[]float64{2, 4, 4, 5, 5, 6},
-			"metricC",
+			[]float64{math.NaN(), 10, 5, 10},
+			"nonNegativeDerivative(metric1,None,0)",
 		},
 		{
 			&expr{
-				target: "minimumBelow",
+				target: "perSecond",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: -2, etype: etConst},
+					&expr{target: "None"},
 				},
-				argString: "metric1,-2",
+				argString: "metric1,None",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{-1, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{-2, 4, 4, 5, 5, 6}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{10, 20, 5, 15}, 10, now32)},
 			},
-			[]float64{-2, 4, 4, 5, 5, 6},
-			"metricC",
+			[]float64{math.NaN(), 1, math.NaN(), 1},
+			"perSecond(metric1,None)",
 		},
 		{
 			&expr{
-				target: "pearsonClosest",
+				target: "derivativeByInterval",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{target: "metric2"},
-					&expr{val: 1, etype: etConst},
+					&expr{valStr: "1min", etype: etString},
 				},
-				argString: "metric1,metric2,1",
+				argString: "metric1,'1min'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricX", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
-				},
-				metricRequest{"metric2", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{3, math.NaN(), 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 4, 3}, 10, now32)},
 			},
-			[]float64{3, math.NaN(), 5, 6, 7, 8},
-			"metricB",
+			[]float64{math.NaN(), 6, 12, -6},
+			"derivativeByInterval(metric1,'1min')",
 		},
 		{
 			&expr{
-				target: "invert",
+				target: "integral",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
@@ -1329,30 +1584,30 @@ func TestEvalExpression(t *testing.T) {
 				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{-4, -2, -1, 0, 1, 2, 4}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, math.NaN(), 2, 3}, 1, now32)},
 			},
-			[]float64{-0.25, -0.5, -1, math.NaN(), 1, 0.5, 0.25},
-			"invert(metric1)",
+			[]float64{1, 1, math.NaN(), 3, 6},
+			"integral(metric1)",
 		},
 		{
 			&expr{
-				target: "offset",
+				target: "integralByInterval",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 10, etype: etConst},
+					&expr{valStr: "2s", etype: etString},
 				},
-				argString: "metric1,10",
+				argString: "metric1,'2s'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{93, 94, 95, math.NaN(), 97, 98, 99, 100, 101}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, math.NaN(), 5}, 1, 0)},
 			},
-			[]float64{103, 104, 105, math.NaN(), 107, 108, 109, 110, 111},
-			"offset(metric1,10)",
+			[]float64{1, 3, 3, 3, 5},
+			"integralByInterval(metric1,'2s')",
 		},
 		{
 			&expr{
-				target: "offsetToZero",
+				target: "minMax",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
@@ -1360,863 +1615,2120 @@ func TestEvalExpression(t *testing.T) {
 				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{93, 94, 95, math.NaN(), 97, 98, 99, 100, 101}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{10, 20, math.NaN(), 15}, 1, now32)},
 			},
-			[]float64{0, 1, 2, math.NaN(), 4, 5, 6, 7, 8},
-			"offsetToZero(metric1)",
+			[]float64{0, 1, math.NaN(), 0.5},
+			"minMax(metric1)",
 		},
 		{
 			&expr{
-				target: "currentAbove",
+				target: "avg",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 7, etype: etConst},
-				},
-				argString: "metric1,7",
+					&expr{target: "metric2"},
+					&expr{target: "metric3"}},
+				argString: "metric1,metric2,metric3",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 5, 6}, 1, now32)},
+				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{3, math.NaN(), 4, 5, 6, math.NaN()}, 1, now32)},
 			},
-			[]float64{3, 4, 5, 6, 7, 8},
-			"metricB",
+			[]float64{2, math.NaN(), 3, 4, 5, 5.5},
+			"averageSeries(metric1,metric2,metric3)",
 		},
 		{
 			&expr{
-				target: "currentBelow",
+				target: "maxSeries",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 0, etype: etConst},
-				},
-				argString: "metric1,0",
+					&expr{target: "metric2"},
+					&expr{target: "metric3"}},
+				argString: "metric1,metric2,metric3",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, math.NaN()}, 1, now32),
-					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{0, 4, 4, 5, 5, 6}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 5, 6}, 1, now32)},
+				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{3, math.NaN(), 4, 5, 6, math.NaN()}, 1, now32)},
 			},
-			[]float64{0, 0, 0, 0, 0, math.NaN()},
-			"metricA",
+			[]float64{3, math.NaN(), 4, 5, 6, 6},
+			"maxSeries(metric1,metric2,metric3)",
 		},
 		{
 			&expr{
-				target: "integral",
+				target: "minSeries",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-				},
-				argString: "metric1",
+					&expr{target: "metric2"},
+					&expr{target: "metric3"}},
+				argString: "metric1,metric2,metric3",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5, math.NaN(), 7, 8}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), 2, 3, 4, 5}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 5, 6}, 1, now32)},
+				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{3, math.NaN(), 4, 5, 6, math.NaN()}, 1, now32)},
 			},
-			[]float64{1, 3, 6, 10, 15, math.NaN(), 22, 30},
-			"integral(metric1)",
+			[]float64{1, math.NaN(), 2, 3, 4, 5},
+			"minSeries(metric1,metric2,metric3)",
 		},
 		{
 			&expr{
-				target: "sortByTotal",
+				target: "asPercent",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
+					&expr{target: "metric2"},
 				},
-				argString: "metric1",
+				argString: "metric1,metric2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{5, 5, 5, 5, 5, 5}, 1, now32),
-					makeResponse("metricC", []float64{4, 4, 5, 5, 4, 4}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
 			},
-			[]float64{5, 5, 5, 5, 5, 5},
-			"metricB",
+			[]float64{50, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 200},
+			"asPercent(metric1,metric2)",
 		},
 		{
 			&expr{
-				target: "sortByMaxima",
+				target: "divideSeries",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
+					&expr{target: "metric2"},
 				},
-				argString: "metric1",
+				argString: "metric1,metric2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{5, 5, 5, 5, 5, 5}, 1, now32),
-					makeResponse("metricC", []float64{2, 2, 10, 5, 2, 2}, 1, now32),
-				},
-			},
-			[]float64{2, 2, 10, 5, 2, 2},
-			"metricC",
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
+			},
+			[]float64{0.5, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 2},
+			"divideSeries(metric1,metric2)",
 		},
 		{
 			&expr{
-				target: "sortByMinima",
+				target: "multiplySeries",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
+					&expr{target: "metric2"},
 				},
-				argString: "metric1",
+				argString: "metric1,metric2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
-					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
 			},
-			[]float64{0, 0, 0, 0, 0, 0},
-			"metricA",
+			[]float64{2, math.NaN(), math.NaN(), math.NaN(), 0, 72},
+			"multiplySeries(metric1,metric2)",
 		},
 		{
 			&expr{
-				target: "sortByName",
+				target: "multiplySeries",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
+					&expr{target: "metric2"},
+					&expr{target: "metric3"},
 				},
-				argString: "metric1",
+				argString: "metric1,metric2,metric3",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricX", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{0, 0, 2, 0, 0, 0}, 1, now32),
-					makeResponse("metricC", []float64{0, 0, 0, 3, 0, 0}, 1, now32),
-				},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
+				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{3, math.NaN(), 4, math.NaN(), 7, 8}, 1, now32)},
 			},
-			[]float64{0, 1, 0, 0, 0, 0},
-			"metricA",
+			[]float64{6, math.NaN(), math.NaN(), math.NaN(), 0, 576},
+			"multiplySeries(metric1,metric2,metric3)",
 		},
 		{
 			&expr{
-				target: "constantLine",
+				target: "diffSeries",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{val: 42.42, etype: etConst},
+					&expr{target: "metric1"},
+					&expr{target: "metric2"},
 				},
-				argString: "42.42",
+				argString: "metric1,metric2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"42.42", 0, 1}: []*metricData{makeResponse("constantLine", []float64{12.3, 12.3}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{2, math.NaN(), 3, math.NaN(), 0, 6}, 1, now32)},
 			},
-			[]float64{42.42, 42.42},
-			"42.42",
+			[]float64{-1, math.NaN(), math.NaN(), 3, 4, 6},
+			"diffSeries(metric1,metric2)",
 		},
 		{
 			&expr{
-				target: "squareRoot",
+				target: "diffSeries",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
+					&expr{target: "metric2"},
+					&expr{target: "metric3"},
 				},
-				argString: "metric1",
+				argString: "metric1,metric2,metric3",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 0, 7, 8, 20, 30, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{5, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
+				metricRequest{"metric2", 0, 1}: []*metricData{makeResponse("metric2", []float64{3, math.NaN(), 3, math.NaN(), 0, 7}, 1, now32)},
+				metricRequest{"metric3", 0, 1}: []*metricData{makeResponse("metric3", []float64{1, math.NaN(), 3, math.NaN(), 0, 4}, 1, now32)},
 			},
-			[]float64{1, 1.4142135623730951, 0, 2.6457513110645907, 2.8284271247461903, 4.47213595499958, 5.477225575051661, math.NaN()},
-			"squareRoot(metric1)",
+			[]float64{1, math.NaN(), math.NaN(), 3, 4, 1},
+			"diffSeries(metric1,metric2,metric3)",
 		},
 		{
 			&expr{
-				target: "removeBelowValue",
+				target: "transformNull",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 0, etype: etConst},
 				},
 				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, -1, 7, 8, 20, 30, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
 			},
-			[]float64{1, 2, math.NaN(), 7, 8, 20, 30, math.NaN()},
-			"removeBelowValue(metric1, 0)",
+			[]float64{1, 0, 0, 3, 4, 12},
+			"transformNull(metric1)",
 		},
 		{
 			&expr{
-				target: "removeAboveValue",
+				target: "transformNull",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 10, etype: etConst},
+					&expr{val: 5, etype: etConst},
 				},
-				argString: "metric1",
+				argString: "metric1,5",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, -1, 7, 8, 20, 30, math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, math.NaN(), math.NaN(), 3, 4, 12}, 1, now32)},
 			},
-			[]float64{1, 2, -1, 7, 8, math.NaN(), math.NaN(), math.NaN()},
-			"removeAboveValue(metric1, 10)",
+			[]float64{1, 5, 5, 3, 4, 12},
+			"transformNull(metric1,5)",
 		},
-	}
-
-	for _, tt := range tests {
-		g := evalExpr(tt.e, 0, 1, tt.m)
-		if g == nil {
-			t.Errorf("failed to eval %v", tt.name)
-			continue
-		}
-		if g[0] == nil {
-			t.Errorf("returned no value %v", tt.e.argString)
-			continue
-		}
-		if g[0].GetStepTime() == 0 {
-			t.Errorf("missing step for %+v", g)
-		}
-		if !nearlyEqual(g[0].Values, g[0].IsAbsent, tt.w) {
-			t.Errorf("failed: %s: got %+v, want %+v", g[0].GetName(), g[0].Values, tt.w)
-		}
-		if g[0].GetName() != tt.name {
-			t.Errorf("bad name for %+v: got %v, want %v", g, g[0].GetName(), tt.name)
-		}
-	}
-}
-
-func TestEvalSummarize(t *testing.T) {
-
-	t0, err := time.Parse(time.UnixDate, "Wed Sep 10 10:32:00 CEST 2014")
-	if err != nil {
-		panic(err)
-	}
-
-	tenThirtyTwo := int32(t0.Unix())
-
-	t0, err = time.Parse(time.UnixDate, "Wed Sep 10 10:59:00 CEST 2014")
-	if err != nil {
-		panic(err)
-	}
-
-	tenFiftyNine := int32(t0.Unix())
-
-	t0, err = time.Parse(time.UnixDate, "Wed Sep 10 10:30:00 CEST 2014")
-	if err != nil {
-		panic(err)
-	}
-
-	tenThirty := int32(t0.Unix())
-
-	now32 := tenThirty
-
-	tests := []struct {
-		e     *expr
-		m     map[metricRequest][]*metricData
-		w     []float64
-		name  string
-		step  int32
-		start int32
-		stop  int32
-	}{
 		{
 			&expr{
-				target: "summarize",
+				target: "highestMax",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
+					&expr{val: 1, etype: etConst},
 				},
-				argString: "metric1,'5s'",
+				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
-					1, 1, 1, 1, 1,
-					2, 2, 2, 2, 2,
-					3, 3, 3, 3, 3,
-					4, 4, 4, 4, 4,
-					5, 5, 5, 5, 5,
-					math.NaN(), 2, 3, 4, 5,
-					math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(),
-				}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{1, 1, 3, 3, 12, 11}, 1, now32),
+					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 10}, 1, now32),
+				},
 			},
-			[]float64{5, 10, 15, 20, 25, 14, math.NaN()},
-			"summarize(metric1,'5s')",
-			5,
-			now32,
-			now32 + 35,
+			[]float64{1, 1, 3, 3, 12, 11},
+			"metricA", // NOTE(dgryski): not sure if this matches graphite
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "lowestCurrent",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
-					&expr{valStr: "avg", etype: etString},
+					&expr{val: 1, etype: etConst},
 				},
-				argString: "metric1,'5s','avg'",
+				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 3, 3, 3, 3, 3, 4, 4, 4, 4, 4, 5, 5, 5, 5, 5, 1, 2, 3, math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN()}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
+				},
 			},
-			[]float64{1, 2, 3, 4, 5, 2, math.NaN()},
-			"summarize(metric1,'5s','avg')",
-			5,
-			now32,
-			now32 + 35,
+			[]float64{1, 1, 3, 3, 4, 1},
+			"metricB", // NOTE(dgryski): not sure if this matches graphite
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "highestCurrent",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
-					&expr{valStr: "max", etype: etString},
+					&expr{val: 1, etype: etConst},
 				},
-				argString: "metric1,'5s','max'",
+				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metric0", []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN()}, 1, now32),
+					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
+				},
 			},
-			[]float64{1, 2, 3, 4.5, 5},
-			"summarize(metric1,'5s','max')",
-			5,
-			now32,
-			now32 + 25*1,
+			[]float64{1, 1, 3, 3, 4, 15},
+			"metricC", // NOTE(dgryski): not sure if this matches graphite
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "highestAverage",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
-					&expr{valStr: "min", etype: etString},
+					&expr{val: 1, etype: etConst},
 				},
-				argString: "metric1,'5s','min'",
+				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+					makeResponse("metricB", []float64{1, 5, 5, 5, 5, 5}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 10}, 1, now32),
+				},
 			},
-			[]float64{0, 1, 1.5, 2, 5},
-			"summarize(metric1,'5s','min')",
-			5,
-			now32,
-			now32 + 25*1,
+			[]float64{1, 5, 5, 5, 5, 5},
+			"metricB", // NOTE(dgryski): not sure if this matches graphite
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "exclude",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
-					&expr{valStr: "last", etype: etString},
+					&expr{valStr: "(Foo|Baz)", etype: etString},
 				},
-				argString: "metric1,'5s','last'",
+				argString: "metric1,'(Foo|Baz)'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricFoo", []float64{1, 1, 1, 1, 1}, 1, now32),
+					makeResponse("metricBar", []float64{2, 2, 2, 2, 2}, 1, now32),
+					makeResponse("metricBaz", []float64{3, 3, 3, 3, 3}, 1, now32),
+				},
 			},
-			[]float64{1, 2, 3, 4.5, 5},
-			"summarize(metric1,'5s','last')",
-			5,
-			now32,
-			now32 + 25*1,
+			[]float64{2, 2, 2, 2, 2},
+			"metricBar", // NOTE(dgryski): not sure if this matches graphite
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "seriesByGlob",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
-					&expr{valStr: "p50", etype: etString},
+					&expr{target: "servers.*.cpu"},
+					&expr{valStr: "servers.{web,api}[0-9]*.cpu", etype: etString},
 				},
-				argString: "metric1,'5s','p50'",
+				argString: "servers.*.cpu,'servers.{web,api}[0-9]*.cpu'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+				metricRequest{"servers.*.cpu", 0, 1}: []*metricData{
+					makeResponse("servers.db1.cpu", []float64{1, 1, 1, 1, 1}, 1, now32),
+					makeResponse("servers.webx.cpu", []float64{2, 2, 2, 2, 2}, 1, now32),
+					makeResponse("servers.api12.cpu", []float64{3, 3, 3, 3, 3}, 1, now32),
+				},
 			},
-			[]float64{0.5, 1.5, 2, 3, 5},
-			"summarize(metric1,'5s','p50')",
-			5,
-			now32,
-			now32 + 25*1,
+			[]float64{3, 3, 3, 3, 3},
+			"servers.api12.cpu",
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "grep",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
-					&expr{valStr: "p25", etype: etString},
+					&expr{valStr: "Bar", etype: etString},
 				},
-				argString: "metric1,'5s','p25'",
+				argString: "metric1,'Bar'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricFoo", []float64{1, 1, 1, 1, 1}, 1, now32),
+					makeResponse("metricBar", []float64{2, 2, 2, 2, 2}, 1, now32),
+					makeResponse("metricBaz", []float64{3, 3, 3, 3, 3}, 1, now32),
+				},
 			},
-			[]float64{0, 1, 2, 3, 5},
-			"summarize(metric1,'5s','p25')",
-			5,
-			now32,
-			now32 + 25*1,
+			[]float64{2, 2, 2, 2, 2},
+			"metricBar", // NOTE(dgryski): not sure if this matches graphite
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "seriesByGlob",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
-					&expr{valStr: "p99.9", etype: etString},
+					&expr{target: "servers.*.cpu"},
+					&expr{valStr: "servers.{web,api}[0-9]*.cpu", etype: etString},
 				},
-				argString: "metric1,'5s','p99.9'",
+				argString: "servers.*.cpu,'servers.{web,api}[0-9]*.cpu'",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+				metricRequest{"servers.*.cpu", 0, 1}: []*metricData{
+					makeResponse("servers.db1.cpu", []float64{1, 1, 1, 1, 1}, 1, now32),
+					makeResponse("servers.webx.cpu", []float64{2, 2, 2, 2, 2}, 1, now32),
+					makeResponse("servers.api12.cpu", []float64{3, 3, 3, 3, 3}, 1, now32),
+				},
 			},
-			[]float64{1, 2, 3, 4.498, 5},
-			"summarize(metric1,'5s','p99.9')",
-			5,
-			now32,
-			now32 + 25*1,
+			[]float64{3, 3, 3, 3, 3},
+			"servers.api12.cpu",
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "logarithm",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "5s", etype: etString},
-					&expr{valStr: "p100.1", etype: etString},
 				},
-				argString: "metric1,'5s','p100.1'",
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 10, 100, 1000, 10000}, 1, now32)},
 			},
-			[]float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN()},
-			"summarize(metric1,'5s','p100.1')",
-			5,
-			now32,
-			now32 + 25*1,
+			[]float64{0, 1, 2, 3, 4},
+			"logarithm(metric1)",
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "logarithm",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "1s", etype: etString},
-					&expr{valStr: "p50", etype: etString},
+					&expr{val: 2, etype: etConst},
 				},
-				argString: "metric1,'1s','p50'",
+				argString: "metric1,2",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 4, 8, 16, 32}, 1, now32)},
 			},
-			[]float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5},
-			"summarize(metric1,'1s','p50')",
-			1,
-			now32,
-			now32 + 25*1,
+			[]float64{0, 1, 2, 3, 4, 5},
+			"logarithm(metric1,2)",
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "absolute",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "10min", etype: etString},
 				},
-				argString: "metric1,'10min'",
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
-					1, 1, 1, 1, 1, 2, 2, 2, 2, 2,
-					3, 3, 3, 3, 3, 4, 4, 4, 4, 4,
-					5, 5, 5, 5, 5}, 60, tenThirtyTwo)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{0, -1, 2, -3, 4, 5}, 1, now32)},
 			},
-			[]float64{11, 31, 33},
-			"summarize(metric1,'10min')",
-			600,
-			tenThirty,
-			tenThirty + 30*60,
+			[]float64{0, 1, 2, 3, 4, 5},
+			"absolute(metric1)",
 		},
 		{
 			&expr{
-				target: "summarize",
+				target: "isNonNull",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "10min", etype: etString},
-					&expr{valStr: "sum", etype: etString},
-					&expr{target: "true", etype: etName},
 				},
-				argString: "metric1,'10min','sum',true",
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
-					1, 1, 1, 1, 1, 2, 2, 2, 2, 2,
-					3, 3, 3, 3, 3, 4, 4, 4, 4, 4,
-					5, 5, 5, 5, 5}, 60, tenThirtyTwo)},
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{math.NaN(), -1, math.NaN(), -3, 4, 5}, 1, now32)},
 			},
-			[]float64{15, 35, 25},
-			"summarize(metric1,'10min','sum',true)",
-			600,
-			tenThirtyTwo,
-			tenThirtyTwo + 25*60,
+			[]float64{0, 1, 0, 1, 1, 1},
+			"isNonNull(metric1)",
 		},
 		{
 			&expr{
-				target: "hitcount",
+				target: "averageAbove",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "30s", etype: etString},
+					&expr{val: 5, etype: etConst},
 				},
-				argString: "metric1,'30s'",
+				argString: "metric1,5",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
-					1, 1, 1, 1, 1, 2,
-					2, 2, 2, 2, 3, 3,
-					3, 3, 3, 4, 4, 4,
-					4, 4, 5, 5, 5, 5,
-					math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(),
-					5}, 5, now32)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
+				},
 			},
-			[]float64{35, 70, 105, 140, math.NaN(), 25},
-			"hitcount(metric1,'30s')",
-			30,
-			now32,
-			now32 + 31*5,
+			[]float64{3, 4, 5, 6, 7, 8},
+			"metricB",
 		},
 		{
 			&expr{
-				target: "hitcount",
+				target: "averageBelow",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "1h", etype: etString},
+					&expr{val: 0, etype: etConst},
 				},
-				argString: "metric1,'1h'",
+				argString: "metric1,0",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
-					1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 3, 3,
-					3, 3, 3, 4, 4, 4, 4, 4, 5, 5, 5, 5,
-					5}, 5, tenFiftyNine)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{0, 4, 4, 5, 5, 6}, 1, now32),
+				},
 			},
-			[]float64{375},
-			"hitcount(metric1,'1h')",
-			3600,
-			tenFiftyNine,
-			tenFiftyNine + 25*5,
+			[]float64{0, 0, 0, 0, 0, 0},
+			"metricA",
 		},
 		{
 			&expr{
-				target: "hitcount",
+				target: "maximumAbove",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{valStr: "1h", etype: etString},
-					&expr{target: "true", etype: etName},
+					&expr{val: 6, etype: etConst},
 				},
-				argString: "metric1,'1h'",
+				argString: "metric1,6",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
-					1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 3, 3,
-					3, 3, 3, 4, 4, 4, 4, 4, 5, 5, 5, 5,
-					5}, 5, tenFiftyNine)},
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
+				},
 			},
-			[]float64{105, 270},
-			"hitcount(metric1,'1h',true)",
-			3600,
-			tenFiftyNine - (59 * 60),
-			tenFiftyNine + 25*5,
+			[]float64{3, 4, 5, 6, 7, 8},
+			"metricB",
 		},
-	}
-
-	for _, tt := range tests {
-		g := evalExpr(tt.e, 0, 1, tt.m)
-		if g == nil {
-			t.Errorf("failed to eval %v", tt.name)
-			continue
-		}
-		if g[0].GetStepTime() != tt.step {
-			t.Errorf("bad step for %s:\ngot  %d\nwant %d", g[0].GetName(), g[0].GetStepTime(), tt.step)
-		}
-		if g[0].GetStartTime() != tt.start {
-			t.Errorf("bad start for %s: got %s want %s", g[0].GetName(), time.Unix(int64(g[0].GetStartTime()), 0).Format(time.StampNano), time.Unix(int64(tt.start), 0).Format(time.StampNano))
-		}
-		if g[0].GetStopTime() != tt.stop {
-			t.Errorf("bad stop for %s: got %s want %s", g[0].GetName(), time.Unix(int64(g[0].GetStopTime()), 0).Format(time.StampNano), time.Unix(int64(tt.stop), 0).Format(time.StampNano))
-		}
-
-		if !nearlyEqual(g[0].Values, g[0].IsAbsent, tt.w) {
-			t.Errorf("failed: %s:\ngot  %+v,\nwant %+v", g[0].GetName(), g[0].Values, tt.w)
-		}
-		if g[0].GetName() != tt.name {
-			t.Errorf("bad name for %+v: got %v, want %v", g, g[0].GetName(), tt.name)
-		}
-	}
-}
-
-func TestEvalMultipleReturns(t *testing.T) {
-
-	now32 := int32(time.Now().Unix())
-
-	tests := []struct {
-		e       *expr
-		m       map[metricRequest][]*metricData
-		name    string
-		results map[string][]*metricData
-	}{
 		{
 			&expr{
-				target: "groupByNode",
+				target: "maximumBelow",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.foo.*.*"},
-					&expr{val: 3, etype: etConst},
-					&expr{valStr: "sum", etype: etString},
+					&expr{target: "metric1"},
+					&expr{val: 5, etype: etConst},
 				},
+				argString: "metric1,5",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.foo.*.*", 0, 1}: []*metricData{
-					makeResponse("metric1.foo.bar1.baz", []float64{1, 2, 3, 4, 5}, 1, now32),
-					makeResponse("metric1.foo.bar1.qux", []float64{6, 7, 8, 9, 10}, 1, now32),
-					makeResponse("metric1.foo.bar2.baz", []float64{11, 12, 13, 14, 15}, 1, now32),
-					makeResponse("metric1.foo.bar2.qux", []float64{7, 8, 9, 10, 11}, 1, now32),
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
 				},
 			},
-			"groupByNode",
-			map[string][]*metricData{
-				"sumSeries(baz)": []*metricData{makeResponse("sumSeries(baz)", []float64{12, 14, 16, 18, 20}, 1, now32)},
-				"sumSeries(qux)": []*metricData{makeResponse("sumSeries(qux)", []float64{13, 15, 17, 19, 21}, 1, now32)},
-			},
+			[]float64{0, 0, 0, 0, 0, 0},
+			"metricA",
 		},
 		{
 			&expr{
-				target: "sumSeriesWithWildcards",
+				target: "minimumAbove",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.foo.*.*"},
+					&expr{target: "metric1"},
 					&expr{val: 1, etype: etConst},
-					&expr{val: 2, etype: etConst},
 				},
+				argString: "metric1,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.foo.*.*", 0, 1}: []*metricData{
-					makeResponse("metric1.foo.bar1.baz", []float64{1, 2, 3, 4, 5}, 1, now32),
-					makeResponse("metric1.foo.bar1.qux", []float64{6, 7, 8, 9, 10}, 1, now32),
-					makeResponse("metric1.foo.bar2.baz", []float64{11, 12, 13, 14, 15}, 1, now32),
-					makeResponse("metric1.foo.bar2.qux", []float64{7, 8, 9, 10, 11}, 1, now32),
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{1, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{2, 4, 4, 5, 5, 6}, 1, now32),
 				},
 			},
-			"sumSeriesWithWildcards",
-			map[string][]*metricData{
-				"sumSeriesWithWildcards(metric1.baz)": []*metricData{makeResponse("sumSeriesWithWildcards(metric1.baz)", []float64{12, 14, 16, 18, 20}, 1, now32)},
-				"sumSeriesWithWildcards(metric1.qux)": []*metricData{makeResponse("sumSeriesWithWildcards(metric1.qux)", []float64{13, 15, 17, 19, 21}, 1, now32)},
+			[]float64{2, 4, 4, 5, 5, 6},
+			"metricC",
+		},
+		{
+			&expr{
+				target: "minimumBelow",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: -2, etype: etConst},
+				},
+				argString: "metric1,-2",
 			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{-1, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{-2, 4, 4, 5, 5, 6}, 1, now32),
+				},
+			},
+			[]float64{-2, 4, 4, 5, 5, 6},
+			"metricC",
 		},
 		{
 			&expr{
-				target: "averageSeriesWithWildcards",
+				target: "pearsonClosest",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{target: "metric1.foo.*.*"},
+					&expr{target: "metric1"},
+					&expr{target: "metric2"},
 					&expr{val: 1, etype: etConst},
-					&expr{val: 2, etype: etConst},
 				},
+				argString: "metric1,metric2,1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1.foo.*.*", 0, 1}: []*metricData{
-					makeResponse("metric1.foo.bar1.baz", []float64{1, 2, 3, 4, 5}, 1, now32),
-					makeResponse("metric1.foo.bar1.qux", []float64{6, 7, 8, 9, 10}, 1, now32),
-					makeResponse("metric1.foo.bar2.baz", []float64{11, 12, 13, 14, 15}, 1, now32),
-					makeResponse("metric1.foo.bar2.qux", []float64{7, 8, 9, 10, 11}, 1, now32),
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricX", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
+				},
+				metricRequest{"metric2", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{3, math.NaN(), 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
 				},
 			},
-			"averageSeriesWithWildcards",
-			map[string][]*metricData{
-				"averageSeriesWithWildcards(metric1.baz)": []*metricData{makeResponse("averageSeriesWithWildcards(metric1.baz)", []float64{6, 7, 8, 9, 10}, 1, now32)},
-				"averageSeriesWithWildcards(metric1.qux)": []*metricData{makeResponse("averageSeriesWithWildcards(metric1.qux)", []float64{6.5, 7.5, 8.5, 9.5, 10.5}, 1, now32)},
+			[]float64{3, math.NaN(), 5, 6, 7, 8},
+			"metricB",
+		},
+		{
+			&expr{
+				target: "invert",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+				},
+				argString: "metric1",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{-4, -2, -1, 0, 1, 2, 4}, 1, now32)},
 			},
+			[]float64{-0.25, -0.5, -1, math.NaN(), 1, 0.5, 0.25},
+			"invert(metric1)",
 		},
 		{
 			&expr{
-				target: "highestCurrent",
+				target: "offset",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 2, etype: etConst},
+					&expr{val: 10, etype: etConst},
 				},
-				argString: "metric1,2",
+				argString: "metric1,10",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
-					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
-					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{93, 94, 95, math.NaN(), 97, 98, 99, 100, 101}, 1, now32)},
+			},
+			[]float64{103, 104, 105, math.NaN(), 107, 108, 109, 110, 111},
+			"offset(metric1,10)",
+		},
+		{
+			&expr{
+				target: "offsetToZero",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
 				},
+				argString: "metric1",
 			},
-			"highestCurrent",
-			map[string][]*metricData{
-				"metricA": []*metricData{makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32)},
-				"metricC": []*metricData{makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32)},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{93, 94, 95, math.NaN(), 97, 98, 99, 100, 101}, 1, now32)},
 			},
+			[]float64{0, 1, 2, math.NaN(), 4, 5, 6, 7, 8},
+			"offsetToZero(metric1)",
 		},
 		{
 			&expr{
-				target: "lowestCurrent",
+				target: "currentAbove",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 3, etype: etConst},
+					&expr{val: 7, etype: etConst},
 				},
+				argString: "metric1,7",
 			},
 			map[metricRequest][]*metricData{
 				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
-					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
-					makeResponse("metricD", []float64{1, 1, 3, 3, 4, 3}, 1, now32),
-					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
 				},
 			},
-			"lowestCurrent",
-			map[string][]*metricData{
-				"metricA": []*metricData{makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32)},
-				"metricB": []*metricData{makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32)},
-				"metricD": []*metricData{makeResponse("metricD", []float64{1, 1, 3, 3, 4, 3}, 1, now32)},
-			},
+			[]float64{3, 4, 5, 6, 7, 8},
+			"metricB",
 		},
 		{
 			&expr{
-				target: "limit",
+				target: "currentBelow",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 2, etype: etConst},
+					&expr{val: 0, etype: etConst},
 				},
-				argString: "metric1, 2",
+				argString: "metric1,0",
 			},
 			map[metricRequest][]*metricData{
 				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{0, 0, 1, 0, 0, 0}, 1, now32),
-					makeResponse("metricC", []float64{0, 0, 0, 1, 0, 0}, 1, now32),
-					makeResponse("metricD", []float64{0, 0, 0, 0, 1, 0}, 1, now32),
-					makeResponse("metricE", []float64{0, 0, 0, 0, 0, 1}, 1, now32),
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, math.NaN()}, 1, now32),
+					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{0, 4, 4, 5, 5, 6}, 1, now32),
 				},
 			},
-			"limit",
-			map[string][]*metricData{
-				"metricA": []*metricData{makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32)},
-				"metricB": []*metricData{makeResponse("metricB", []float64{0, 0, 1, 0, 0, 0}, 1, now32)},
+			[]float64{0, 0, 0, 0, 0, math.NaN()},
+			"metricA",
+		},
+		{
+			&expr{
+				target: "integral",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+				},
+				argString: "metric1",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5, math.NaN(), 7, 8}, 1, now32)},
 			},
+			[]float64{1, 3, 6, 10, 15, math.NaN(), 22, 30},
+			"integral(metric1)",
 		},
 		{
 			&expr{
-				target: "limit",
+				target: "sortByTotal",
 				etype:  etFunc,
 				args: []*expr{
 					&expr{target: "metric1"},
-					&expr{val: 20, etype: etConst},
 				},
-				argString: "metric1, 20",
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
 				metricRequest{"metric1", 0, 1}: []*metricData{
-					makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32),
-					makeResponse("metricB", []float64{0, 0, 1, 0, 0, 0}, 1, now32),
-					makeResponse("metricC", []float64{0, 0, 0, 1, 0, 0}, 1, now32),
-					makeResponse("metricD", []float64{0, 0, 0, 0, 1, 0}, 1, now32),
-					makeResponse("metricE", []float64{0, 0, 0, 0, 0, 1}, 1, now32),
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{5, 5, 5, 5, 5, 5}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 5, 5, 4, 4}, 1, now32),
 				},
 			},
-			"limit",
-			map[string][]*metricData{
-				"metricA": []*metricData{makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32)},
-				"metricB": []*metricData{makeResponse("metricB", []float64{0, 0, 1, 0, 0, 0}, 1, now32)},
-				"metricC": []*metricData{makeResponse("metricC", []float64{0, 0, 0, 1, 0, 0}, 1, now32)},
-				"metricD": []*metricData{makeResponse("metricD", []float64{0, 0, 0, 0, 1, 0}, 1, now32)},
-				"metricE": []*metricData{makeResponse("metricE", []float64{0, 0, 0, 0, 0, 1}, 1, now32)},
+			[]float64{5, 5, 5, 5, 5, 5},
+			"metricB",
+		},
+		{
+			&expr{
+				target: "sortByMaxima",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+				},
+				argString: "metric1",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{5, 5, 5, 5, 5, 5}, 1, now32),
+					makeResponse("metricC", []float64{2, 2, 10, 5, 2, 2}, 1, now32),
+				},
 			},
+			[]float64{2, 2, 10, 5, 2, 2},
+			"metricC",
 		},
 		{
 			&expr{
-				target: "mostDeviant",
+				target: "sortByMinima",
 				etype:  etFunc,
 				args: []*expr{
-					&expr{val: 2, etype: etConst},
-					&expr{target: "metric*"},
+					&expr{target: "metric1"},
 				},
+				argString: "metric1",
 			},
 			map[metricRequest][]*metricData{
-				metricRequest{"metric*", 0, 1}: []*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
 					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
 					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
 					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
-					makeResponse("metricD", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
-					makeResponse("metricE", []float64{4, 7, 7, 7, 7, 1}, 1, now32),
 				},
 			},
-			"mostDeviant",
-			map[string][]*metricData{
-				"metricB": []*metricData{makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32)},
-				"metricE": []*metricData{makeResponse("metricE", []float64{4, 7, 7, 7, 7, 1}, 1, now32)},
-			},
+			[]float64{0, 0, 0, 0, 0, 0},
+			"metricA",
 		},
-	}
-
-	for _, tt := range tests {
-		g := evalExpr(tt.e, 0, 1, tt.m)
-		if g == nil {
-			t.Errorf("failed to eval %v", tt.name)
-			continue
-		}
-		if g[0].GetStepTime() == 0 {
-			t.Errorf("missing step for %+v", g)
-		}
-		if len(g) != len(tt.results) {
-			t.Errorf("unexpected results len: got %d, want %d", len(g), len(tt.results))
-		}
-		for _, gg := range g {
-			r, ok := tt.results[gg.GetName()]
-			if !ok {
-				t.Errorf("missing result name: %v", gg.GetName())
-				continue
-			}
-			if !reflect.DeepEqual(r[0].Values, gg.Values) || !reflect.DeepEqual(r[0].IsAbsent, gg.IsAbsent) ||
-				r[0].GetStartTime() != gg.GetStartTime() ||
-				r[0].GetStopTime() != gg.GetStopTime() ||
-				r[0].GetStepTime() != gg.GetStepTime() {
-				t.Errorf("result mismatch, got\n%#v,\nwant\n%#v", gg, r)
-			}
-		}
-	}
-}
-
-func TestExtractMetric(t *testing.T) {
-
-	var tests = []struct {
-		input  string
-		metric string
-	}{
 		{
-			"f",
-			"f",
+			&expr{
+				target: "sortBy",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "median", etype: etString},
+				},
+				argString: "metric1,'median'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{9, 9, 9, 9, 9, 9}, 1, now32),
+					makeResponse("metricB", []float64{1, 1, 1, 1, 100, 100}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 4, 5, 5, 5}, 1, now32),
+				},
+			},
+			[]float64{1, 1, 1, 1, 100, 100},
+			"metricB",
 		},
 		{
-			"func(f)",
-			"f",
-		},
+			&expr{
+				target: "sortBy",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "range", etype: etString},
+					&expr{target: "true", etype: etName},
+				},
+				argString: "metric1,'range',true",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{9, 9, 9, 9, 9, 9}, 1, now32),
+					makeResponse("metricB", []float64{1, 1, 1, 1, 100, math.NaN()}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 4, 5, 5, 5}, 1, now32),
+				},
+			},
+			[]float64{1, 1, 1, 1, 100, math.NaN()},
+			"metricB",
+		},
+		{
+			&expr{
+				target: "sortByName",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+				},
+				argString: "metric1",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricX", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{0, 0, 2, 0, 0, 0}, 1, now32),
+					makeResponse("metricC", []float64{0, 0, 0, 3, 0, 0}, 1, now32),
+				},
+			},
+			[]float64{0, 1, 0, 0, 0, 0},
+			"metricA",
+		},
+		{
+			&expr{
+				target: "constantLine",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{val: 42.42, etype: etConst},
+				},
+				argString: "42.42",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"42.42", 0, 1}: []*metricData{makeResponse("constantLine", []float64{12.3, 12.3}, 1, now32)},
+			},
+			[]float64{42.42, 42.42},
+			"42.42",
+		},
+		{
+			&expr{
+				target: "squareRoot",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+				},
+				argString: "metric1",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, 0, 7, 8, 20, 30, math.NaN()}, 1, now32)},
+			},
+			[]float64{1, 1.4142135623730951, 0, 2.6457513110645907, 2.8284271247461903, 4.47213595499958, 5.477225575051661, math.NaN()},
+			"squareRoot(metric1)",
+		},
+		{
+			&expr{
+				target: "removeBelowValue",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: 0, etype: etConst},
+				},
+				argString: "metric1",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, -1, 7, 8, 20, 30, math.NaN()}, 1, now32)},
+			},
+			[]float64{1, 2, math.NaN(), 7, 8, 20, 30, math.NaN()},
+			"removeBelowValue(metric1, 0)",
+		},
+		{
+			&expr{
+				target: "removeAboveValue",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: 10, etype: etConst},
+				},
+				argString: "metric1",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 2, -1, 7, 8, 20, 30, math.NaN()}, 1, now32)},
+			},
+			[]float64{1, 2, -1, 7, 8, math.NaN(), math.NaN(), math.NaN()},
+			"removeAboveValue(metric1, 10)",
+		},
+	}
+
+	for _, tt := range tests {
+		g := evalExpr(tt.e, 0, 1, tt.m, nil)
+		if g == nil {
+			t.Errorf("failed to eval %v", tt.name)
+			continue
+		}
+		if g[0] == nil {
+			t.Errorf("returned no value %v", tt.e.argString)
+			continue
+		}
+		if g[0].GetStepTime() == 0 {
+			t.Errorf("missing step for %+v", g)
+		}
+		if !nearlyEqual(g[0].Values, g[0].IsAbsent, tt.w) {
+			t.Errorf("failed: %s: got %+v, want %+v", g[0].GetName(), g[0].Values, tt.w)
+		}
+		if g[0].GetName() != tt.name {
+			t.Errorf("bad name for %+v: got %v, want %v", g, g[0].GetName(), tt.name)
+		}
+	}
+}
+
+func TestEvalSummarize(t *testing.T) {
+
+	t0, err := time.Parse(time.UnixDate, "Wed Sep 10 10:32:00 CEST 2014")
+	if err != nil {
+		panic(err)
+	}
+
+	tenThirtyTwo := int32(t0.Unix())
+
+	t0, err = time.Parse(time.UnixDate, "Wed Sep 10 10:59:00 CEST 2014")
+	if err != nil {
+		panic(err)
+	}
+
+	tenFiftyNine := int32(t0.Unix())
+
+	t0, err = time.Parse(time.UnixDate, "Wed Sep 10 10:30:00 CEST 2014")
+	if err != nil {
+		panic(err)
+	}
+
+	tenThirty := int32(t0.Unix())
+
+	now32 := tenThirty
+
+	tests := []struct {
+		e     *expr
+		m     map[metricRequest][]*metricData
+		w     []float64
+		name  string
+		step  int32
+		start int32
+		stop  int32
+	}{
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+				},
+				argString: "metric1,'5s'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
+					1, 1, 1, 1, 1,
+					2, 2, 2, 2, 2,
+					3, 3, 3, 3, 3,
+					4, 4, 4, 4, 4,
+					5, 5, 5, 5, 5,
+					math.NaN(), 2, 3, 4, 5,
+					math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(),
+				}, 1, now32)},
+			},
+			[]float64{5, 10, 15, 20, 25, 14, math.NaN()},
+			"summarize(metric1,'5s')",
+			5,
+			now32,
+			now32 + 35,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+					&expr{valStr: "avg", etype: etString},
+				},
+				argString: "metric1,'5s','avg'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 3, 3, 3, 3, 3, 4, 4, 4, 4, 4, 5, 5, 5, 5, 5, 1, 2, 3, math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN()}, 1, now32)},
+			},
+			[]float64{1, 2, 3, 4, 5, 2, math.NaN()},
+			"summarize(metric1,'5s','avg')",
+			5,
+			now32,
+			now32 + 35,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+					&expr{valStr: "max", etype: etString},
+				},
+				argString: "metric1,'5s','max'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+			[]float64{1, 2, 3, 4.5, 5},
+			"summarize(metric1,'5s','max')",
+			5,
+			now32,
+			now32 + 25*1,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+					&expr{valStr: "min", etype: etString},
+				},
+				argString: "metric1,'5s','min'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+			[]float64{0, 1, 1.5, 2, 5},
+			"summarize(metric1,'5s','min')",
+			5,
+			now32,
+			now32 + 25*1,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+					&expr{valStr: "last", etype: etString},
+				},
+				argString: "metric1,'5s','last'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+			[]float64{1, 2, 3, 4.5, 5},
+			"summarize(metric1,'5s','last')",
+			5,
+			now32,
+			now32 + 25*1,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+					&expr{valStr: "p50", etype: etString},
+				},
+				argString: "metric1,'5s','p50'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+			[]float64{0.5, 1.5, 2, 3, 5},
+			"summarize(metric1,'5s','p50')",
+			5,
+			now32,
+			now32 + 25*1,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+					&expr{valStr: "p25", etype: etString},
+				},
+				argString: "metric1,'5s','p25'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+			[]float64{0, 1, 2, 3, 5},
+			"summarize(metric1,'5s','p25')",
+			5,
+			now32,
+			now32 + 25*1,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+					&expr{valStr: "p99.9", etype: etString},
+				},
+				argString: "metric1,'5s','p99.9'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+			[]float64{1, 2, 3, 4.498, 5},
+			"summarize(metric1,'5s','p99.9')",
+			5,
+			now32,
+			now32 + 25*1,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "5s", etype: etString},
+					&expr{valStr: "p100.1", etype: etString},
+				},
+				argString: "metric1,'5s','p100.1'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+			[]float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN()},
+			"summarize(metric1,'5s','p100.1')",
+			5,
+			now32,
+			now32 + 25*1,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "1s", etype: etString},
+					&expr{valStr: "p50", etype: etString},
+				},
+				argString: "metric1,'1s','p50'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+			[]float64{1, 0, 0, 0.5, 1, 2, 1, 1, 1.5, 2, 3, 2, 2, 1.5, 3, 4, 3, 2, 3, 4.5, 5, 5, 5, 5, 5},
+			"summarize(metric1,'1s','p50')",
+			1,
+			now32,
+			now32 + 25*1,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "10min", etype: etString},
+				},
+				argString: "metric1,'10min'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
+					1, 1, 1, 1, 1, 2, 2, 2, 2, 2,
+					3, 3, 3, 3, 3, 4, 4, 4, 4, 4,
+					5, 5, 5, 5, 5}, 60, tenThirtyTwo)},
+			},
+			[]float64{11, 31, 33},
+			"summarize(metric1,'10min')",
+			600,
+			tenThirty,
+			tenThirty + 30*60,
+		},
+		{
+			&expr{
+				target: "summarize",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "10min", etype: etString},
+					&expr{valStr: "sum", etype: etString},
+					&expr{target: "true", etype: etName},
+				},
+				argString: "metric1,'10min','sum',true",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
+					1, 1, 1, 1, 1, 2, 2, 2, 2, 2,
+					3, 3, 3, 3, 3, 4, 4, 4, 4, 4,
+					5, 5, 5, 5, 5}, 60, tenThirtyTwo)},
+			},
+			[]float64{15, 35, 25},
+			"summarize(metric1,'10min','sum',true)",
+			600,
+			tenThirtyTwo,
+			tenThirtyTwo + 25*60,
+		},
+		{
+			&expr{
+				target: "hitcount",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "30s", etype: etString},
+				},
+				argString: "metric1,'30s'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
+					1, 1, 1, 1, 1, 2,
+					2, 2, 2, 2, 3, 3,
+					3, 3, 3, 4, 4, 4,
+					4, 4, 5, 5, 5, 5,
+					math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(),
+					5}, 5, now32)},
+			},
+			[]float64{35, 70, 105, 140, math.NaN(), 25},
+			"hitcount(metric1,'30s')",
+			30,
+			now32,
+			now32 + 31*5,
+		},
+		{
+			&expr{
+				target: "hitcount",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "1h", etype: etString},
+				},
+				argString: "metric1,'1h'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
+					1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 3, 3,
+					3, 3, 3, 4, 4, 4, 4, 4, 5, 5, 5, 5,
+					5}, 5, tenFiftyNine)},
+			},
+			[]float64{375},
+			"hitcount(metric1,'1h')",
+			3600,
+			tenFiftyNine,
+			tenFiftyNine + 25*5,
+		},
+		{
+			&expr{
+				target: "hitcount",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "1h", etype: etString},
+					&expr{target: "true", etype: etName},
+				},
+				argString: "metric1,'1h'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{makeResponse("metric1", []float64{
+					1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 3, 3,
+					3, 3, 3, 4, 4, 4, 4, 4, 5, 5, 5, 5,
+					5}, 5, tenFiftyNine)},
+			},
+			[]float64{105, 270},
+			"hitcount(metric1,'1h',true)",
+			3600,
+			tenFiftyNine - (59 * 60),
+			tenFiftyNine + 25*5,
+		},
+	}
+
+	for _, tt := range tests {
+		g := evalExpr(tt.e, 0, 1, tt.m, nil)
+		if g == nil {
+			t.Errorf("failed to eval %v", tt.name)
+			continue
+		}
+		if g[0].GetStepTime() != tt.step {
+			t.Errorf("bad step for %s:\ngot  %d\nwant %d", g[0].GetName(), g[0].GetStepTime(), tt.step)
+		}
+		if g[0].GetStartTime() != tt.start {
+			t.Errorf("bad start for %s: got %s want %s", g[0].GetName(), time.Unix(int64(g[0].GetStartTime()), 0).Format(time.StampNano), time.Unix(int64(tt.start), 0).Format(time.StampNano))
+		}
+		if g[0].GetStopTime() != tt.stop {
+			t.Errorf("bad stop for %s: got %s want %s", g[0].GetName(), time.Unix(int64(g[0].GetStopTime()), 0).Format(time.StampNano), time.Unix(int64(tt.stop), 0).Format(time.StampNano))
+		}
+
+		if !nearlyEqual(g[0].Values, g[0].IsAbsent, tt.w) {
+			t.Errorf("failed: %s:\ngot  %+v,\nwant %+v", g[0].GetName(), g[0].Values, tt.w)
+		}
+		if g[0].GetName() != tt.name {
+			t.Errorf("bad name for %+v: got %v, want %v", g, g[0].GetName(), tt.name)
+		}
+	}
+}
+
+func TestEvalMultipleReturns(t *testing.T) {
+
+	now32 := int32(time.Now().Unix())
+
+	tests := []struct {
+		e       *expr
+		m       map[metricRequest][]*metricData
+		name    string
+		results map[string][]*metricData
+	}{
+		{
+			&expr{
+				target: "groupByNode",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1.foo.*.*"},
+					&expr{val: 3, etype: etConst},
+					&expr{valStr: "sum", etype: etString},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1.foo.*.*", 0, 1}: []*metricData{
+					makeResponse("metric1.foo.bar1.baz", []float64{1, 2, 3, 4, 5}, 1, now32),
+					makeResponse("metric1.foo.bar1.qux", []float64{6, 7, 8, 9, 10}, 1, now32),
+					makeResponse("metric1.foo.bar2.baz", []float64{11, 12, 13, 14, 15}, 1, now32),
+					makeResponse("metric1.foo.bar2.qux", []float64{7, 8, 9, 10, 11}, 1, now32),
+				},
+			},
+			"groupByNode",
+			map[string][]*metricData{
+				"sumSeries(baz)": []*metricData{makeResponse("sumSeries(baz)", []float64{12, 14, 16, 18, 20}, 1, now32)},
+				"sumSeries(qux)": []*metricData{makeResponse("sumSeries(qux)", []float64{13, 15, 17, 19, 21}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "reduceSeries",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{
+						target: "mapSeries",
+						etype:  etFunc,
+						args: []*expr{
+							&expr{target: "servers.*.disk.bytes_*"},
+							&expr{val: 1, etype: etConst},
+						},
+					},
+					&expr{valStr: "divideSeries", etype: etString},
+					&expr{val: 3, etype: etConst},
+					&expr{valStr: "bytes_used", etype: etString},
+					&expr{valStr: "bytes_total", etype: etString},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"servers.*.disk.bytes_*", 0, 1}: []*metricData{
+					makeResponse("servers.server1.disk.bytes_total", []float64{10, 10, 10}, 1, now32),
+					makeResponse("servers.server2.disk.bytes_used", []float64{1, 2, 3}, 1, now32),
+					makeResponse("servers.server1.disk.bytes_used", []float64{5, 6, 7}, 1, now32),
+					makeResponse("servers.server2.disk.bytes_total", []float64{4, 4, 4}, 1, now32),
+					makeResponse("servers.server3.disk.bytes_used", []float64{1, 1, 1}, 1, now32),
+				},
+			},
+			"reduceSeries",
+			map[string][]*metricData{
+				"servers.server1.disk.reduce.divideSeries": []*metricData{makeResponse("servers.server1.disk.reduce.divideSeries", []float64{0.5, 0.6, 0.7}, 1, now32)},
+				"servers.server2.disk.reduce.divideSeries": []*metricData{makeResponse("servers.server2.disk.reduce.divideSeries", []float64{0.25, 0.5, 0.75}, 1, now32)},
+			},
+		},
+		{
+			// tags aren't part of the last node
+			&expr{
+				target: "reduceSeries",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{
+						target: "mapSeries",
+						etype:  etFunc,
+						args: []*expr{
+							&expr{target: "servers.*.disk.bytes_*"},
+							&expr{val: 1, etype: etConst},
+						},
+					},
+					&expr{valStr: "divideSeries", etype: etString},
+					&expr{val: 3, etype: etConst},
+					&expr{valStr: "bytes_used", etype: etString},
+					&expr{valStr: "bytes_total", etype: etString},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"servers.*.disk.bytes_*", 0, 1}: []*metricData{
+					makeResponse("servers.server1.disk.bytes_total;dc=ams", []float64{10, 10, 10}, 1, now32),
+					makeResponse("servers.server2.disk.bytes_used;dc=fra", []float64{1, 2, 3}, 1, now32),
+					makeResponse("servers.server1.disk.bytes_used;dc=ams", []float64{5, 6, 7}, 1, now32),
+					makeResponse("servers.server2.disk.bytes_total;dc=fra", []float64{4, 4, 4}, 1, now32),
+				},
+			},
+			"reduceSeries",
+			map[string][]*metricData{
+				"servers.server1.disk.reduce.divideSeries": []*metricData{makeResponse("servers.server1.disk.reduce.divideSeries", []float64{0.5, 0.6, 0.7}, 1, now32)},
+				"servers.server2.disk.reduce.divideSeries": []*metricData{makeResponse("servers.server2.disk.reduce.divideSeries", []float64{0.25, 0.5, 0.75}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "unique",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1.*"},
+					&expr{target: "metric1.foo"},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1.*", 0, 1}: []*metricData{
+					makeResponse("metric1.foo", []float64{1, 2, 3}, 1, now32),
+					makeResponse("metric1.bar", []float64{4, 5, 6}, 1, now32),
+				},
+				metricRequest{"metric1.foo", 0, 1}: []*metricData{makeResponse("metric1.foo", []float64{1, 2, 3}, 1, now32)},
+			},
+			"unique",
+			map[string][]*metricData{
+				"metric1.foo": []*metricData{makeResponse("metric1.foo", []float64{1, 2, 3}, 1, now32)},
+				"metric1.bar": []*metricData{makeResponse("metric1.bar", []float64{4, 5, 6}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "asPercent",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "hosts.*.used"},
+					&expr{target: "hosts.*.total"},
+					&expr{val: 1, etype: etConst},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"hosts.*.used", 0, 1}: []*metricData{
+					makeResponse("hosts.b.used", []float64{1, 2, math.NaN()}, 1, now32),
+					makeResponse("hosts.a.used", []float64{1, 2, 3}, 1, now32),
+					makeResponse("hosts.c.used", []float64{1, 2, 3}, 1, now32),
+				},
+				metricRequest{"hosts.*.total", 0, 1}: []*metricData{
+					makeResponse("hosts.a.total", []float64{4, 4, 0}, 1, now32),
+					makeResponse("hosts.b.total", []float64{8, 8, 8}, 1, now32),
+					makeResponse("hosts.d.total", []float64{8, 8, 8}, 1, now32),
+				},
+			},
+			"asPercent",
+			map[string][]*metricData{
+				"asPercent(hosts.a.used,hosts.a.total)": []*metricData{makeResponse("", []float64{25, 50, math.NaN()}, 1, now32)},
+				"asPercent(hosts.b.used,hosts.b.total)": []*metricData{makeResponse("", []float64{12.5, 25, math.NaN()}, 1, now32)},
+				"asPercent(hosts.c.used,MISSING)":       []*metricData{makeResponse("", []float64{math.NaN(), math.NaN(), math.NaN()}, 1, now32)},
+				"asPercent(MISSING,hosts.d.total)":      []*metricData{makeResponse("", []float64{math.NaN(), math.NaN(), math.NaN()}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "asPercent",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "hosts.*.*"},
+					&expr{target: "None"},
+					&expr{val: 1, etype: etConst},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"hosts.*.*", 0, 1}: []*metricData{
+					makeResponse("hosts.a.rx", []float64{1, 3}, 1, now32),
+					makeResponse("hosts.a.tx", []float64{3, 1}, 1, now32),
+					makeResponse("hosts.b.rx", []float64{5, 5}, 1, now32),
+				},
+			},
+			"asPercent",
+			map[string][]*metricData{
+				"asPercent(hosts.a.rx,sumSeries(hosts.a.rx,hosts.a.tx))": []*metricData{makeResponse("", []float64{25, 75}, 1, now32)},
+				"asPercent(hosts.a.tx,sumSeries(hosts.a.rx,hosts.a.tx))": []*metricData{makeResponse("", []float64{75, 25}, 1, now32)},
+				"asPercent(hosts.b.rx,hosts.b.rx)":                       []*metricData{makeResponse("", []float64{100, 100}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "divideSeriesLists",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "hosts.*.used"},
+					&expr{target: "hosts.*.total"},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"hosts.*.used", 0, 1}: []*metricData{
+					makeResponse("hosts.b.used", []float64{1, 2, math.NaN()}, 1, now32),
+					makeResponse("hosts.a.used", []float64{1, 2, 3}, 1, now32),
+				},
+				metricRequest{"hosts.*.total", 0, 1}: []*metricData{
+					makeResponse("hosts.a.total", []float64{4, 4, 0}, 1, now32),
+					makeResponse("hosts.b.total", []float64{8, 8, 8}, 1, now32),
+				},
+			},
+			"divideSeriesLists",
+			map[string][]*metricData{
+				"divideSeries(hosts.a.used,hosts.a.total)": []*metricData{makeResponse("", []float64{0.25, 0.5, math.NaN()}, 1, now32)},
+				"divideSeries(hosts.b.used,hosts.b.total)": []*metricData{makeResponse("", []float64{0.125, 0.25, math.NaN()}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "sumSeriesLists",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "hosts.*.rx"},
+					&expr{target: "hosts.*.tx"},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"hosts.*.rx", 0, 1}: []*metricData{
+					makeResponse("hosts.a.rx", []float64{1, math.NaN(), math.NaN()}, 1, now32),
+				},
+				metricRequest{"hosts.*.tx", 0, 1}: []*metricData{
+					makeResponse("hosts.a.tx", []float64{4, 4, math.NaN()}, 1, now32),
+				},
+			},
+			"sumSeriesLists",
+			map[string][]*metricData{
+				"sumSeries(hosts.a.rx,hosts.a.tx)": []*metricData{makeResponse("", []float64{5, 4, math.NaN()}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "removeZeroSeries",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1.*"},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1.*", 0, 1}: []*metricData{
+					makeResponse("metric1.empty", []float64{math.NaN(), math.NaN(), math.NaN()}, 1, now32),
+					makeResponse("metric1.zero", []float64{0, math.NaN(), 0}, 1, now32),
+					makeResponse("metric1.data", []float64{0, 1, math.NaN()}, 1, now32),
+				},
+			},
+			"removeZeroSeries",
+			map[string][]*metricData{
+				"metric1.data": []*metricData{makeResponse("metric1.data", []float64{0, 1, math.NaN()}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "removeEmptySeries",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1.*"},
+					&expr{val: 0.5, etype: etConst},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1.*", 0, 1}: []*metricData{
+					makeResponse("metric1.empty", []float64{math.NaN(), math.NaN(), math.NaN()}, 1, now32),
+					makeResponse("metric1.sparse", []float64{1, math.NaN(), math.NaN()}, 1, now32),
+					makeResponse("metric1.zero", []float64{0, math.NaN(), 0}, 1, now32),
+				},
+			},
+			"removeEmptySeries",
+			map[string][]*metricData{
+				"metric1.zero": []*metricData{makeResponse("metric1.zero", []float64{0, math.NaN(), 0}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "sumSeriesWithWildcards",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1.foo.*.*"},
+					&expr{val: 1, etype: etConst},
+					&expr{val: 2, etype: etConst},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1.foo.*.*", 0, 1}: []*metricData{
+					makeResponse("metric1.foo.bar1.baz", []float64{1, 2, 3, 4, 5}, 1, now32),
+					makeResponse("metric1.foo.bar1.qux", []float64{6, 7, 8, 9, 10}, 1, now32),
+					makeResponse("metric1.foo.bar2.baz", []float64{11, 12, 13, 14, 15}, 1, now32),
+					makeResponse("metric1.foo.bar2.qux", []float64{7, 8, 9, 10, 11}, 1, now32),
+				},
+			},
+			"sumSeriesWithWildcards",
+			map[string][]*metricData{
+				"sumSeriesWithWildcards(metric1.baz)": []*metricData{makeResponse("sumSeriesWithWildcards(metric1.baz)", []float64{12, 14, 16, 18, 20}, 1, now32)},
+				"sumSeriesWithWildcards(metric1.qux)": []*metricData{makeResponse("sumSeriesWithWildcards(metric1.qux)", []float64{13, 15, 17, 19, 21}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "averageSeriesWithWildcards",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1.foo.*.*"},
+					&expr{val: 1, etype: etConst},
+					&expr{val: 2, etype: etConst},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1.foo.*.*", 0, 1}: []*metricData{
+					makeResponse("metric1.foo.bar1.baz", []float64{1, 2, 3, 4, 5}, 1, now32),
+					makeResponse("metric1.foo.bar1.qux", []float64{6, 7, 8, 9, 10}, 1, now32),
+					makeResponse("metric1.foo.bar2.baz", []float64{11, 12, 13, 14, 15}, 1, now32),
+					makeResponse("metric1.foo.bar2.qux", []float64{7, 8, 9, 10, 11}, 1, now32),
+				},
+			},
+			"averageSeriesWithWildcards",
+			map[string][]*metricData{
+				"averageSeriesWithWildcards(metric1.baz)": []*metricData{makeResponse("averageSeriesWithWildcards(metric1.baz)", []float64{6, 7, 8, 9, 10}, 1, now32)},
+				"averageSeriesWithWildcards(metric1.qux)": []*metricData{makeResponse("averageSeriesWithWildcards(metric1.qux)", []float64{6.5, 7.5, 8.5, 9.5, 10.5}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "highestCurrent",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: 2, etype: etConst},
+				},
+				argString: "metric1,2",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
+				},
+			},
+			"highestCurrent",
+			map[string][]*metricData{
+				"metricA": []*metricData{makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32)},
+				"metricC": []*metricData{makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "lowestCurrent",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: 3, etype: etConst},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
+					makeResponse("metricD", []float64{1, 1, 3, 3, 4, 3}, 1, now32),
+					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+				},
+			},
+			"lowestCurrent",
+			map[string][]*metricData{
+				"metricA": []*metricData{makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32)},
+				"metricB": []*metricData{makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32)},
+				"metricD": []*metricData{makeResponse("metricD", []float64{1, 1, 3, 3, 4, 3}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "highest",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: 2, etype: etConst},
+					&expr{valStr: "sum", etype: etString},
+				},
+				argString: "metric1,2,'sum'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+					makeResponse("metricB", []float64{1, 1, 3, 3, 4, 1}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
+				},
+			},
+			"highest",
+			map[string][]*metricData{
+				"metricA": []*metricData{makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32)},
+				"metricC": []*metricData{makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "lowest",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: 1, etype: etConst},
+					&expr{valStr: "stddev", etype: etString},
+				},
+				argString: "metric1,1,'stddev'",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+					makeResponse("metricB", []float64{5, 5, 5, 5, 5, 5}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
+				},
+			},
+			"lowest",
+			map[string][]*metricData{
+				"metricB": []*metricData{makeResponse("metricB", []float64{5, 5, 5, 5, 5, 5}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "filterSeries",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{valStr: "max", etype: etString},
+					&expr{valStr: ">", etype: etString},
+					&expr{val: 12, etype: etConst},
+				},
+				argString: "metric1,'max','>',12",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{1, 1, 3, 3, 4, 12}, 1, now32),
+					makeResponse("metricB", []float64{5, 5, 5, 5, 5, 5}, 1, now32),
+					makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32),
+				},
+			},
+			"filterSeries",
+			map[string][]*metricData{
+				"metricC": []*metricData{makeResponse("metricC", []float64{1, 1, 3, 3, 4, 15}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "limit",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: 2, etype: etConst},
+				},
+				argString: "metric1, 2",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{0, 0, 1, 0, 0, 0}, 1, now32),
+					makeResponse("metricC", []float64{0, 0, 0, 1, 0, 0}, 1, now32),
+					makeResponse("metricD", []float64{0, 0, 0, 0, 1, 0}, 1, now32),
+					makeResponse("metricE", []float64{0, 0, 0, 0, 0, 1}, 1, now32),
+				},
+			},
+			"limit",
+			map[string][]*metricData{
+				"metricA": []*metricData{makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32)},
+				"metricB": []*metricData{makeResponse("metricB", []float64{0, 0, 1, 0, 0, 0}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "limit",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{target: "metric1"},
+					&expr{val: 20, etype: etConst},
+				},
+				argString: "metric1, 20",
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric1", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{0, 0, 1, 0, 0, 0}, 1, now32),
+					makeResponse("metricC", []float64{0, 0, 0, 1, 0, 0}, 1, now32),
+					makeResponse("metricD", []float64{0, 0, 0, 0, 1, 0}, 1, now32),
+					makeResponse("metricE", []float64{0, 0, 0, 0, 0, 1}, 1, now32),
+				},
+			},
+			"limit",
+			map[string][]*metricData{
+				"metricA": []*metricData{makeResponse("metricA", []float64{0, 1, 0, 0, 0, 0}, 1, now32)},
+				"metricB": []*metricData{makeResponse("metricB", []float64{0, 0, 1, 0, 0, 0}, 1, now32)},
+				"metricC": []*metricData{makeResponse("metricC", []float64{0, 0, 0, 1, 0, 0}, 1, now32)},
+				"metricD": []*metricData{makeResponse("metricD", []float64{0, 0, 0, 0, 1, 0}, 1, now32)},
+				"metricE": []*metricData{makeResponse("metricE", []float64{0, 0, 0, 0, 0, 1}, 1, now32)},
+			},
+		},
+		{
+			&expr{
+				target: "mostDeviant",
+				etype:  etFunc,
+				args: []*expr{
+					&expr{val: 2, etype: etConst},
+					&expr{target: "metric*"},
+				},
+			},
+			map[metricRequest][]*metricData{
+				metricRequest{"metric*", 0, 1}: []*metricData{
+					makeResponse("metricA", []float64{0, 0, 0, 0, 0, 0}, 1, now32),
+					makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32),
+					makeResponse("metricC", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
+					makeResponse("metricD", []float64{4, 4, 5, 5, 6, 6}, 1, now32),
+					makeResponse("metricE", []float64{4, 7, 7, 7, 7, 1}, 1, now32),
+				},
+			},
+			"mostDeviant",
+			map[string][]*metricData{
+				"metricB": []*metricData{makeResponse("metricB", []float64{3, 4, 5, 6, 7, 8}, 1, now32)},
+				"metricE": []*metricData{makeResponse("metricE", []float64{4, 7, 7, 7, 7, 1}, 1, now32)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		g := evalExpr(tt.e, 0, 1, tt.m, nil)
+		if g == nil {
+			t.Errorf("failed to eval %v", tt.name)
+			continue
+		}
+		if g[0].GetStepTime() == 0 {
+			t.Errorf("missing step for %+v", g)
+		}
+		if len(g) != len(tt.results) {
+			t.Errorf("unexpected results len: got %d, want %d", len(g), len(tt.results))
+		}
+		for _, gg := range g {
+			r, ok := tt.results[gg.GetName()]
+			if !ok {
+				t.Errorf("missing result name: %v", gg.GetName())
+				continue
+			}
+			if !reflect.DeepEqual(r[0].Values, gg.Values) || !reflect.DeepEqual(r[0].IsAbsent, gg.IsAbsent) ||
+				r[0].GetStartTime() != gg.GetStartTime() ||
+				r[0].GetStopTime() != gg.GetStopTime() ||
+				r[0].GetStepTime() != gg.GetStepTime() {
+				t.Errorf("result mismatch, got\n%#v,\nwant\n%#v", gg, r)
+			}
+		}
+	}
+}
+
+func TestEvalApplyByNode(t *testing.T) {
+
+	now32 := int32(time.Now().Unix())
+
+	// the metrics built from the template are only fetched during eval
+	zipper := map[string][]*metricData{
+		"servers.server1.disk.bytes_used":  []*metricData{makeResponse("servers.server1.disk.bytes_used", []float64{5, 6, 7}, 1, now32)},
+		"servers.server1.disk.bytes_total": []*metricData{makeResponse("servers.server1.disk.bytes_total", []float64{10, 10, 10}, 1, now32)},
+		"servers.server2.disk.bytes_used":  []*metricData{makeResponse("servers.server2.disk.bytes_used", []float64{1, 2, 3}, 1, now32)},
+		"servers.server2.disk.bytes_total": []*metricData{makeResponse("servers.server2.disk.bytes_total", []float64{4, 4, 4}, 1, now32)},
+	}
+
+	exp, _, err := parseExpr("applyByNode(servers.*.disk.bytes_used, 1, 'divideSeries(%.disk.bytes_used, %.disk.bytes_total)', '%.disk.pct_used')")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	values := map[metricRequest][]*metricData{
+		metricRequest{"servers.*.disk.bytes_used", 0, 1}: []*metricData{
+			zipper["servers.server2.disk.bytes_used"][0],
+			zipper["servers.server1.disk.bytes_used"][0],
+		},
+	}
+
+	// the metrics of the targets built, as if already fetched
+	for name, data := range zipper {
+		values[metricRequest{name, 0, 1}] = data
+	}
+
+	want := map[string][]float64{
+		"servers.server1.disk.pct_used": []float64{0.5, 0.6, 0.7},
+		"servers.server2.disk.pct_used": []float64{0.25, 0.5, 0.75},
+	}
+
+	g := evalExpr(exp, 0, 1, values, nil)
+	if len(g) != len(want) {
+		t.Fatalf("got %d series, want %d", len(g), len(want))
+	}
+
+	for _, r := range g {
+		w, ok := want[r.GetName()]
+		if !ok {
+			t.Errorf("unexpected series %s", r.GetName())
+			continue
+		}
+		if !nearlyEqual(r.Values, r.IsAbsent, w) {
+			t.Errorf("failed: %s: got %+v, want %+v", r.GetName(), r.Values, w)
+		}
+	}
+}
+
+func TestEvalHoltWinters(t *testing.T) {
+
+	const step = 3600
+	const from = 8 * 86400
+	const until = from + 4*step
+
+	// a flat week of bootstrap data followed by the requested range
+	values := make([]float64, (until-(from-7*86400))/step)
+	for i := range values {
+		values[i] = 10
+	}
+	values[len(values)-3] = 25
+	values[len(values)-1] = math.NaN()
+
+	m := map[metricRequest][]*metricData{
+		metricRequest{"metric1", from - 7*86400, until}: []*metricData{makeResponse("metric1", values, step, from-7*86400)},
+	}
+
+	tests := []struct {
+		target  string
+		results map[string][]float64
+	}{
+		{
+			"holtWintersForecast(metric1)",
+			map[string][]float64{
+				"holtWintersForecast(metric1)": []float64{10, 10, 10, 10},
+			},
+		},
+		{
+			"holtWintersConfidenceBands(metric1)",
+			map[string][]float64{
+				"holtWintersConfidenceLower(metric1)": []float64{10, 10, 10, 10},
+				"holtWintersConfidenceUpper(metric1)": []float64{10, 10, 10, 10},
+			},
+		},
+		{
+			"holtWintersAberration(metric1, 2)",
+			map[string][]float64{
+				"holtWintersAberration(metric1)": []float64{0, 15, 0, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		exp, _, err := parseExpr(tt.target)
+		if err != nil {
+			t.Errorf("failed to parse %s: %v", tt.target, err)
+			continue
+		}
+
+		g := evalExpr(exp, from, until, m, nil)
+		if len(g) != len(tt.results) {
+			t.Errorf("%s: unexpected results len: got %d, want %d", tt.target, len(g), len(tt.results))
+			continue
+		}
+
+		for _, gg := range g {
+			w, ok := tt.results[gg.GetName()]
+			if !ok {
+				t.Errorf("%s: unexpected result name: %v", tt.target, gg.GetName())
+				continue
+			}
+			if gg.GetStartTime() != from {
+				t.Errorf("%s: bad start time: got %d, want %d", gg.GetName(), gg.GetStartTime(), from)
+			}
+			if !nearlyEqual(gg.Values, gg.IsAbsent, w) {
+				t.Errorf("failed: %s: got %+v, want %+v", gg.GetName(), gg.Values, w)
+			}
+		}
+	}
+}
+
+func TestExprMetrics(t *testing.T) {
+
+	tests := []struct {
+		target string
+		want   []metricRequest
+	}{
+		{
+			"sumSeries(foo.bar, foo.baz)",
+			[]metricRequest{{"foo.bar", 0, 0}, {"foo.baz", 0, 0}},
+		},
+		{
+			"timeShift(foo.bar, '1h')",
+			[]metricRequest{{"foo.bar", -3600, -3600}},
+		},
+		{
+			"timeShift(foo.bar, '+1h')",
+			[]metricRequest{{"foo.bar", 3600, 3600}},
+		},
+		{
+			"timeStack(foo.bar, '1h', 0, 3)",
+			[]metricRequest{{"foo.bar", 0, 0}, {"foo.bar", -3600, -3600}, {"foo.bar", -7200, -7200}},
+		},
+		{
+			"timeStack(foo.bar)",
+			[]metricRequest{
+				{"foo.bar", 0, 0},
+				{"foo.bar", -1 * 86400, -1 * 86400},
+				{"foo.bar", -2 * 86400, -2 * 86400},
+				{"foo.bar", -3 * 86400, -3 * 86400},
+				{"foo.bar", -4 * 86400, -4 * 86400},
+				{"foo.bar", -5 * 86400, -5 * 86400},
+				{"foo.bar", -6 * 86400, -6 * 86400},
+			},
+		},
+		{
+			"movingAverage(foo.bar, 5)",
+			[]metricRequest{{"foo.bar", 0, 0}},
+		},
+		{
+			"movingAverage(foo.bar, '5min')",
+			[]metricRequest{{"foo.bar", -300, 0}},
+		},
+		{
+			"holtWintersForecast(foo.bar)",
+			[]metricRequest{{"foo.bar", -7 * 86400, 0}},
+		},
+		{
+			"identity(foo.bar)",
+			nil,
+		},
+		{
+			"sumSeries(foo.bar, sinFunction('sin', 2))",
+			[]metricRequest{{"foo.bar", 0, 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		exp, _, err := parseExpr(tt.target)
+		if err != nil {
+			t.Errorf("failed to parse %s: %v", tt.target, err)
+			continue
+		}
+		if got := exp.metrics(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("metrics(%s)=%+v, want %+v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestExprBootstrapMetrics(t *testing.T) {
+
+	steps := map[string]int32{"foo.bar": 60}
+
+	tests := []struct {
+		target string
+		want   []metricRequest
+	}{
+		{
+			"movingAverage(foo.bar, 5)",
+			[]metricRequest{{"foo.bar", -300, 0}},
+		},
+		{
+			"movingMedian(foo.bar, '10min')",
+			[]metricRequest{{"foo.bar", -600, 0}},
+		},
+		{
+			"stdev(foo.bar, 10)",
+			[]metricRequest{{"foo.bar", -600, 0}},
+		},
+		{
+			"tukeyAbove(foo.bar, 3, 1.5, 5)",
+			[]metricRequest{{"foo.bar", -180, 0}},
+		},
+		{
+			"movingAverage(foo.baz, 5)",
+			[]metricRequest{{"foo.baz", 0, 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		exp, _, err := parseExpr(tt.target)
+		if err != nil {
+			t.Errorf("failed to parse %s: %v", tt.target, err)
+			continue
+		}
+		if got := exp.bootstrapMetrics(steps); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("bootstrapMetrics(%s)=%+v, want %+v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestEvalTimeShift(t *testing.T) {
+
+	const from = 1500000000
+	const until = 1500000005
+
+	m := map[metricRequest][]*metricData{
+		metricRequest{"metric1", from, until}:         []*metricData{makeResponse("metric1", []float64{1, 2, 3, 4, 5}, 1, from)},
+		metricRequest{"metric1", from - 5, until - 5}: []*metricData{makeResponse("metric1", []float64{6, 7, 8, 9, 10}, 1, from-5)},
+		metricRequest{"metric1", from + 2, until + 2}: []*metricData{makeResponse("metric1", []float64{3, 4, 5}, 1, from+2)},
+	}
+
+	tests := []struct {
+		target  string
+		results map[string][]float64
+	}{
+		{
+			"timeShift(metric1,'5s')",
+			map[string][]float64{
+				"timeShift(metric1)": []float64{6, 7, 8, 9, 10},
+			},
+		},
+		{
+			"timeShift(metric1,'+2s')",
+			map[string][]float64{
+				"timeShift(metric1)": []float64{3, 4, 5, math.NaN(), math.NaN()},
+			},
+		},
+		{
+			"timeShift(metric1,'+2s',false)",
+			map[string][]float64{
+				"timeShift(metric1)": []float64{3, 4, 5},
+			},
+		},
+		{
+			"timeStack(metric1,'5s',0,2)",
+			map[string][]float64{
+				"timeShift(metric1,5s,0)": []float64{1, 2, 3, 4, 5},
+				"timeShift(metric1,5s,1)": []float64{6, 7, 8, 9, 10},
+			},
+		},
+		{
+			"timeSlice(metric1,'1500000001','1500000003')",
+			map[string][]float64{
+				"timeSlice(metric1,1500000001,1500000003)": []float64{math.NaN(), 2, 3, 4, math.NaN()},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		exp, _, err := parseExpr(tt.target)
+		if err != nil {
+			t.Errorf("failed to parse %s: %v", tt.target, err)
+			continue
+		}
+
+		g := evalExpr(exp, from, until, m, nil)
+		if len(g) != len(tt.results) {
+			t.Errorf("%s: unexpected results len: got %d, want %d", tt.target, len(g), len(tt.results))
+			continue
+		}
+
+		for _, gg := range g {
+			w, ok := tt.results[gg.GetName()]
+			if !ok {
+				t.Errorf("%s: unexpected result name: %v", tt.target, gg.GetName())
+				continue
+			}
+			if gg.GetStartTime() != from {
+				t.Errorf("%s: bad start time: got %d, want %d", gg.GetName(), gg.GetStartTime(), from)
+			}
+			if !nearlyEqual(gg.Values, gg.IsAbsent, w) {
+				t.Errorf("failed: %s: got %+v, want %+v", gg.GetName(), gg.Values, w)
+			}
+		}
+	}
+}
+
+func TestExtractMetric(t *testing.T) {
+
+	var tests = []struct {
+		input  string
+		metric string
+	}{
+		{
+			"f",
+			"f",
+		},
+		{
+			"func(f)",
+			"f",
+		},
 		{
 			"foo.bar.baz",
 			"foo.bar.baz",
@@ -2241,6 +3753,18 @@ func TestExtractMetric(t *testing.T) {
 			"{something}",
 			"{something}",
 		},
+		{
+			"sumSeries(servers.{web,api}[0-9]*.cpu)",
+			"servers.{web,api}[0-9]*.cpu",
+		},
+		{
+			"divideSeries(servers.{web,api}[,0-9].cpu,foo.bar)",
+			"servers.{web,api}[,0-9].cpu",
+		},
+		{
+			"movingAverage(foo.bar;dc=ams;env=prod,10)",
+			"foo.bar;dc=ams;env=prod",
+		},
 	}
 
 	for _, tt := range tests {
@@ -2250,6 +3774,292 @@ func TestExtractMetric(t *testing.T) {
 	}
 }
 
+func TestPythonRegexp(t *testing.T) {
+
+	var tests = []struct {
+		pattern string
+		want    string
+	}{
+		{`^.*TCP(\d+)`, `^.*TCP(\d+)`},
+		{`(?P<host>[^.]+)\.cpu`, `(?P<host>[^.]+)\.cpu`},
+		{`foo\Z`, `foo\z`},
+		{`foo(?#comment)bar`, `foobar`},
+		{`[]a]`, `[\]a]`},
+		{`[(?=]`, `[(?=]`},
+	}
+
+	for _, tt := range tests {
+		got, err := translatePythonRegexp(tt.pattern)
+		if err != nil || got != tt.want {
+			t.Errorf("translatePythonRegexp(%q)=%q (%v), want %q", tt.pattern, got, err, tt.want)
+		}
+	}
+
+	for _, pattern := range []string{`foo(?=bar)`, `foo(?!bar)`, `(?<=foo)bar`, `(?<!foo)bar`, `(a)\1`, `(?P<x>a)(?P=x)`} {
+		if _, err := compilePythonRegexp(pattern); err == nil {
+			t.Errorf("compilePythonRegexp(%q) succeeded, want error", pattern)
+		}
+	}
+
+	var replacements = []struct {
+		repl string
+		want string
+	}{
+		{`\1`, `${1}`},
+		{`\12x`, `${12}x`},
+		{`\g<1>0`, `${1}0`},
+		{`\g<host>.cpu`, `${host}.cpu`},
+		{`$1`, `$1`},
+		{`a\\b`, `a\b`},
+	}
+
+	for _, tt := range replacements {
+		if got := pythonReplacement(tt.repl); got != tt.want {
+			t.Errorf("pythonReplacement(%q)=%q, want %q", tt.repl, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAliasQuery(t *testing.T) {
+
+	var tests = []struct {
+		newName string
+		v       float64
+		want    string
+	}{
+		{"%d cores", 16.7, "16 cores"},
+		{"%i cores", 16.7, "16 cores"},
+		{"%.1f load", 0.375, "0.4 load"},
+		{"%5.2f", 3.14159, " 3.14"},
+		{"%g GB", 1.5, "1.5 GB"},
+		{"100% busy", 1, "100% busy"},
+		{"%d%% used", 42, "42% used"},
+		{"x %s", 3, "x 3.0"},
+		{"x %s", 0.25, "x 0.25"},
+		{"x %s", 1e20, "x 1e+20"},
+		{"%s of %d", 3, "3.0 of %d"},
+		{"%.2f %d", 1.5, "1.50 %d"},
+		{"no verbs", 1, "no verbs"},
+		{"trailing %", 1, "trailing %"},
+	}
+
+	for _, tt := range tests {
+		if got := formatAliasQuery(tt.newName, tt.v); got != tt.want {
+			t.Errorf("formatAliasQuery(%q, %v)=%q, want %q", tt.newName, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestValidateExpr(t *testing.T) {
+
+	valid := []string{
+		"foo.bar",
+		"sum(foo.*)",
+		"movingAverage(foo.bar, 5)",
+		"movingAverage(foo.bar, '5min')",
+		"summarize(foo.bar, '1h', 'max', true)",
+		"sortBy(foo.*, 'p95', false)",
+		"aliasByNode(foo.*, 1, 2, 3)",
+		"asPercent(foo.*, None, 1)",
+		"identity(foo)",
+		"aliasSub(foo.bar, '^foo\\.(\\w+)', '\\1')",
+		"maxDataPoints(scale(foo.bar, 2), 100)",
+		"scale(foo.bar, factor=2)",
+		"summarize(foo.bar, '1h', alignToFrom=true)",
+		"asPercent(foo.*, total=bar.baz)",
+		"perSecond(foo.bar, None, 0)",
+		"nonNegativeDerivative(foo.bar, None)",
+		"nonNegativeDerivative(foo.bar, maxValue=None)",
+		"countSeries()",
+	}
+
+	for _, target := range valid {
+		e, _, err := parseExpr(target)
+		if err != nil {
+			t.Fatalf("parseExpr(%q): %v", target, err)
+		}
+		if err := validateExpr(e); err != nil {
+			t.Errorf("validateExpr(%q)=%v, want nil", target, err)
+		}
+	}
+
+	invalid := []struct {
+		target string
+		err    string
+	}{
+		{"nosuch(foo.bar)", "nosuch: unknown function"},
+		{"scale(foo.bar)", "scale: expected at least 2 arguments, got 1"},
+		{"absolute(foo.bar, 1)", "absolute: expected at most 1 arguments, got 2"},
+		{"scale(foo.bar, 'x')", "scale: argument 2: expected number"},
+		{"scale(2, foo.bar)", "scale: argument 1: expected series"},
+		{"aliasByNode(foo.*, 1, 'x')", "aliasByNode: argument 3: expected number"},
+		{"summarize(foo.bar, '1fortnight')", "summarize: argument 2: unknown time units"},
+		{"summarize(foo.bar, '')", "summarize: argument 2: empty interval"},
+		{"hitcount(foo.bar, '1h', maybe)", "hitcount: argument 3: expected boolean"},
+		{"sortBy(foo.*, 'p9x')", `sortBy: argument 2: unknown summary function "p9x"`},
+		{"grep(foo.*, 'a(?=b)')", `grep: argument 2: unsupported regexp construct "(?= (lookahead)"`},
+		{"summarize(foo.bar, func='max')", `summarize: missing argument "intervalString"`},
+		{"summarize(foo.bar, '1h', fn='max')", `summarize: unknown keyword argument "fn"`},
+		{"summarize(foo.bar, '1h', intervalString='1d')", `summarize: argument "intervalString" given by position and by name`},
+		{"summarize(foo.bar, '1h', alignToFrom=1)", "summarize: argument 4: expected boolean"},
+		{"sumSeries(seriesLists=foo.*)", `sumSeries: expected at least 1 arguments, got 0`},
+		{"sumSeries()", `sumSeries: expected at least 1 arguments, got 0`},
+		{"scale(foo.bar, None)", "scale: argument 2: expected number"},
+		{"aliasByNode(foo.*, 1, None)", "aliasByNode: argument 3: expected number"},
+		{"sum(scale(foo.bar))", "scale: expected at least 2 arguments, got 1"},
+	}
+
+	for _, tt := range invalid {
+		e, _, err := parseExpr(tt.target)
+		if err != nil {
+			t.Fatalf("parseExpr(%q): %v", tt.target, err)
+		}
+		if err := validateExpr(e); err == nil || err.Error() != tt.err {
+			t.Errorf("validateExpr(%q)=%v, want %q", tt.target, err, tt.err)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+
+	var tests = []struct {
+		glob      string
+		canonical string
+		match     []string
+		nomatch   []string
+	}{
+		{
+			"foo.bar.baz",
+			"foo.bar.baz",
+			[]string{"foo.bar.baz"},
+			[]string{"foo.bar", "foo.bar.baz.qux", "foo.bar.bazz"},
+		},
+		{
+			"foo.*.baz",
+			"foo.*.baz",
+			[]string{"foo.bar.baz", "foo..baz"},
+			[]string{"foo.bar.qux.baz"},
+		},
+		{
+			"foo.b?r**",
+			"foo.b?r*",
+			[]string{"foo.bar", "foo.bzr", "foo.barometer"},
+			[]string{"foo.br", "foo.bar.baz"},
+		},
+		{
+			"servers.{web,api}[0-9]*.cpu",
+			"servers.{api,web}[0-9]*.cpu",
+			[]string{"servers.web1.cpu", "servers.api42.cpu", "servers.web1-ams.cpu"},
+			[]string{"servers.web.cpu", "servers.db1.cpu", "servers.webx.cpu"},
+		},
+		{
+			"servers.{web,api,web}[!0-9].cpu",
+			"servers.{api,web}[!0-9].cpu",
+			[]string{"servers.webx.cpu"},
+			[]string{"servers.web1.cpu", "servers.web..cpu"},
+		},
+		{
+			"foo.{bar}.{a{1,2},b}",
+			"foo.bar.{a{1,2},b}",
+			[]string{"foo.bar.a1", "foo.bar.a2", "foo.bar.b"},
+			[]string{"foo.bar.a", "foo.bar.a3", "foo.bar.b1"},
+		},
+		{
+			"foo.[z-a_].{,x}",
+			"foo.[_a-z].{,x}",
+			[]string{"foo.q.", "foo._.x"},
+			[]string{"foo.Q.x", "foo.q.y"},
+		},
+		{
+			"foo.[]0]",
+			"foo.[]0]",
+			[]string{"foo.]", "foo.0"},
+			[]string{"foo.[", "foo.1"},
+		},
+		{
+			"foo.[a!]",
+			"foo.[a!]",
+			[]string{"foo.a", "foo.!"},
+			[]string{"foo.b"},
+		},
+		{
+			"foo.[/+-]",
+			"foo.[+/-]",
+			[]string{"foo.+", "foo./", "foo.-"},
+			[]string{"foo.,", "foo.."},
+		},
+		{
+			"foo.[+-/]",
+			"foo.[+-/]",
+			[]string{"foo.+", "foo.,", "foo.-", "foo./"},
+			[]string{"foo.0", "foo.*"},
+		},
+		{
+			"foo.[-!]",
+			"foo.[-!]",
+			[]string{"foo.-", "foo.!"},
+			[]string{"foo.a"},
+		},
+	}
+
+	for _, tt := range tests {
+		g, err := parseGlob(tt.glob)
+		if err != nil {
+			t.Errorf("parseGlob(%q) failed: %v", tt.glob, err)
+			continue
+		}
+		c := g.String()
+		if c != tt.canonical {
+			t.Errorf("parseGlob(%q).String()=%q, want %q", tt.glob, c, tt.canonical)
+		}
+		g2, err := parseGlob(c)
+		if err != nil || g2.String() != c {
+			t.Errorf("canonical glob %q of %q doesn't parse back the same", c, tt.glob)
+			continue
+		}
+		for _, m := range tt.match {
+			if !g.match(m) {
+				t.Errorf("glob %q failed to match %q", tt.glob, m)
+			}
+		}
+		for _, m := range tt.nomatch {
+			if g.match(m) {
+				t.Errorf("glob %q unexpectedly matched %q", tt.glob, m)
+			}
+		}
+		for _, m := range append(tt.match, tt.nomatch...) {
+			if g2.match(m) != g.match(m) {
+				t.Errorf("canonical glob %q and %q disagree on %q", c, tt.glob, m)
+			}
+		}
+	}
+
+	for _, bad := range []string{"foo.{bar", "foo.bar}", "foo.[a-z"} {
+		if _, err := parseGlob(bad); err == nil {
+			t.Errorf("parseGlob(%q) succeeded, expected an error", bad)
+		}
+	}
+}
+
+func TestSplitMetric(t *testing.T) {
+
+	var tests = []struct {
+		metric string
+		nodes  []string
+	}{
+		{"foo.bar.baz", []string{"foo", "bar", "baz"}},
+		{"foo.{bar.baz,qux}.zot", []string{"foo", "{bar.baz,qux}", "zot"}},
+		{"foo.[.a].zot", []string{"foo", "[.a]", "zot"}},
+		{"foo", []string{"foo"}},
+	}
+
+	for _, tt := range tests {
+		if nodes := splitMetric(tt.metric); !reflect.DeepEqual(nodes, tt.nodes) {
+			t.Errorf("splitMetric(%q)=%q, want %q", tt.metric, nodes, tt.nodes)
+		}
+	}
+}
+
 const eps = 0.0000000001
 
 func nearlyEqual(a []float64, absent []bool, b []float64) bool {
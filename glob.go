@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// glob parser and matcher
+//
+// The syntax follows what carbonserver understands for Find queries:
+// '*' matches any run of characters within a node, '?' matches a single
+// character, '[a-z0-9]' (or '[!...]' / '[^...]' to negate) matches a
+// character class and '{foo,bar}' matches any of the alternatives.
+
+type globTermType int
+
+const (
+	gtLiteral globTermType = iota
+	gtStar
+	gtAny
+	gtClass
+	gtAlt
+)
+
+type globRange struct {
+	lo, hi byte
+}
+
+type globTerm struct {
+	ttype  globTermType
+	lit    string
+	ranges []globRange
+	negate bool
+	alts   [][]globTerm
+}
+
+type glob struct {
+	terms []globTerm
+}
+
+var (
+	ErrUnterminatedBrace = errors.New("unterminated brace in glob")
+	ErrUnterminatedClass = errors.New("unterminated character class in glob")
+	ErrUnbalancedBrace   = errors.New("unbalanced brace in glob")
+)
+
+func parseGlob(s string) (*glob, error) {
+	terms, rest, err := parseGlobTerms(s, 0)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, ErrUnbalancedBrace
+	}
+	return &glob{terms: terms}, nil
+}
+
+// parseGlobTerms parses a sequence of glob terms.  When inside a brace
+// group (depth > 0), parsing stops at the first unnested ',' or '}'.
+func parseGlobTerms(s string, depth int) ([]globTerm, string, error) {
+
+	var terms []globTerm
+	var lit []byte
+
+	flush := func() {
+		if len(lit) > 0 {
+			terms = append(terms, globTerm{ttype: gtLiteral, lit: string(lit)})
+			lit = nil
+		}
+	}
+
+	for len(s) > 0 {
+		switch s[0] {
+		case '*':
+			flush()
+			// '**' is the same as '*' inside a single node
+			if len(terms) == 0 || terms[len(terms)-1].ttype != gtStar {
+				terms = append(terms, globTerm{ttype: gtStar})
+			}
+			s = s[1:]
+
+		case '?':
+			flush()
+			terms = append(terms, globTerm{ttype: gtAny})
+			s = s[1:]
+
+		case '[':
+			flush()
+			t, rest, err := parseGlobClass(s)
+			if err != nil {
+				return nil, "", err
+			}
+			terms = append(terms, t)
+			s = rest
+
+		case '{':
+			flush()
+			t, rest, err := parseGlobAlt(s, depth)
+			if err != nil {
+				return nil, "", err
+			}
+			terms = append(terms, t...)
+			s = rest
+
+		case ',', '}':
+			if depth == 0 {
+				if s[0] == '}' {
+					return nil, "", ErrUnbalancedBrace
+				}
+				lit = append(lit, s[0])
+				s = s[1:]
+				continue
+			}
+			flush()
+			return terms, s, nil
+
+		default:
+			lit = append(lit, s[0])
+			s = s[1:]
+		}
+	}
+
+	if depth > 0 {
+		return nil, "", ErrUnterminatedBrace
+	}
+
+	flush()
+	return terms, "", nil
+}
+
+func parseGlobClass(s string) (globTerm, string, error) {
+
+	t := globTerm{ttype: gtClass}
+
+	// skip '['
+	s = s[1:]
+
+	if len(s) > 0 && (s[0] == '!' || s[0] == '^') {
+		t.negate = true
+		s = s[1:]
+	}
+
+	for i := 0; len(s) > 0; i++ {
+		// a ']' as the first character is a literal
+		if s[0] == ']' && i > 0 {
+			sort.Sort(byRange(t.ranges))
+			return t, s[1:], nil
+		}
+
+		r := globRange{lo: s[0], hi: s[0]}
+		if len(s) > 2 && s[1] == '-' && s[2] != ']' {
+			r.hi = s[2]
+			if r.hi < r.lo {
+				r.lo, r.hi = r.hi, r.lo
+			}
+			s = s[3:]
+		} else {
+			s = s[1:]
+		}
+		t.ranges = append(t.ranges, r)
+	}
+
+	return globTerm{}, "", ErrUnterminatedClass
+}
+
+func parseGlobAlt(s string, depth int) ([]globTerm, string, error) {
+
+	var alts [][]globTerm
+
+	// skip '{'
+	s = s[1:]
+
+	for {
+		alt, rest, err := parseGlobTerms(s, depth+1)
+		if err != nil {
+			return nil, "", err
+		}
+		alts = append(alts, alt)
+
+		s = rest[1:]
+		if rest[0] == '}' {
+			break
+		}
+	}
+
+	// canonical order, so {b,a} and {a,b} produce the same glob
+	byStr := make(map[string][]globTerm, len(alts))
+	var keys []string
+	for _, a := range alts {
+		k := globTermsString(a)
+		if _, ok := byStr[k]; ok {
+			continue
+		}
+		byStr[k] = a
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 1 {
+		// a single alternative is the same as no braces at all
+		return byStr[keys[0]], s, nil
+	}
+
+	t := globTerm{ttype: gtAlt}
+	for _, k := range keys {
+		t.alts = append(t.alts, byStr[k])
+	}
+
+	return []globTerm{t}, s, nil
+}
+
+type byRange []globRange
+
+func (r byRange) Len() int      { return len(r) }
+func (r byRange) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byRange) Less(i, j int) bool {
+	if r[i].lo != r[j].lo {
+		return r[i].lo < r[j].lo
+	}
+	return r[i].hi < r[j].hi
+}
+
+// String returns the canonical form of the glob
+func (g *glob) String() string {
+	return globTermsString(g.terms)
+}
+
+func globTermsString(terms []globTerm) string {
+	var b bytes.Buffer
+	writeGlobTerms(&b, terms)
+	return b.String()
+}
+
+func writeGlobTerms(b *bytes.Buffer, terms []globTerm) {
+	for _, t := range terms {
+		switch t.ttype {
+		case gtLiteral:
+			b.WriteString(t.lit)
+		case gtStar:
+			b.WriteByte('*')
+		case gtAny:
+			b.WriteByte('?')
+		case gtClass:
+			b.WriteByte('[')
+			if t.negate {
+				b.WriteByte('!')
+			}
+			for _, r := range classPrintOrder(t) {
+				b.WriteByte(r.lo)
+				if r.hi != r.lo {
+					b.WriteByte('-')
+					b.WriteByte(r.hi)
+				}
+			}
+			b.WriteByte(']')
+		case gtAlt:
+			b.WriteByte('{')
+			for i, a := range t.alts {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				writeGlobTerms(b, a)
+			}
+			b.WriteByte('}')
+		}
+	}
+}
+
+// classPrintOrder orders the ranges of a class so that it parses back the
+// same: a literal ']' must come first, a literal '-' last so it doesn't
+// join its neighbours into a range, and a leading '!' or '^' would negate
+// the class
+func classPrintOrder(t globTerm) []globRange {
+	var first, rest, last []globRange
+	for _, r := range t.ranges {
+		switch {
+		case r.lo == ']':
+			first = append(first, r)
+		case r.lo == '-' && r.hi == '-':
+			last = append(last, r)
+		default:
+			rest = append(rest, r)
+		}
+	}
+
+	order := append(append(first, rest...), last...)
+	if len(order) > 1 && (order[0].lo == '!' || order[0].lo == '^') {
+		order[0], order[1] = order[1], order[0]
+	}
+
+	return order
+}
+
+// match reports whether the metric name matches the glob.  Wildcards never
+// match across a '.' node separator.
+func (g *glob) match(metric string) bool {
+	return matchGlobTerms(g.terms, metric, func(rest string) bool { return rest == "" })
+}
+
+// matchPrefix reports whether the glob matches the metric name or its
+// leading nodes, as prod.web matches prod.web.host1.requests
+func (g *glob) matchPrefix(metric string) bool {
+	return matchGlobTerms(g.terms, metric, func(rest string) bool { return rest == "" || rest[0] == '.' })
+}
+
+// matchGlobTerms matches terms against a prefix of s, and calls k with the
+// unmatched remainder for every way the terms can match
+func matchGlobTerms(terms []globTerm, s string, k func(string) bool) bool {
+
+	if len(terms) == 0 {
+		return k(s)
+	}
+
+	t, terms := terms[0], terms[1:]
+
+	switch t.ttype {
+	case gtLiteral:
+		if !strings.HasPrefix(s, t.lit) {
+			return false
+		}
+		return matchGlobTerms(terms, s[len(t.lit):], k)
+
+	case gtStar:
+		for i := 0; i <= len(s); i++ {
+			if matchGlobTerms(terms, s[i:], k) {
+				return true
+			}
+			if i < len(s) && s[i] == '.' {
+				break
+			}
+		}
+		return false
+
+	case gtAny:
+		if s == "" || s[0] == '.' {
+			return false
+		}
+		return matchGlobTerms(terms, s[1:], k)
+
+	case gtClass:
+		if s == "" || s[0] == '.' || !t.matchClass(s[0]) {
+			return false
+		}
+		return matchGlobTerms(terms, s[1:], k)
+
+	case gtAlt:
+		for _, a := range t.alts {
+			if matchGlobTerms(a, s, func(rest string) bool { return matchGlobTerms(terms, rest, k) }) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return false
+}
+
+func (t *globTerm) matchClass(c byte) bool {
+	for _, r := range t.ranges {
+		if r.lo <= c && c <= r.hi {
+			return !t.negate
+		}
+	}
+	return t.negate
+}
+
+// globCacheKey returns the key used to cache Find responses for metric.
+// Equivalent globs share a key; anything we can't parse is used verbatim.
+func globCacheKey(metric string) string {
+	g, err := parseGlob(metric)
+	if err != nil {
+		return metric
+	}
+	return g.String()
+}
+
+// globGroupEnd returns the index just past the '}' or ']' closing the group
+// opened at s[i], or -1 if the group is not terminated
+func globGroupEnd(s string, i int) int {
+
+	if s[i] == '[' {
+		// a ']' as the first character of the class is a literal
+		j := i + 1
+		if j < len(s) && (s[j] == '!' || s[j] == '^') {
+			j++
+		}
+		if j < len(s) && s[j] == ']' {
+			j++
+		}
+		for ; j < len(s); j++ {
+			if s[j] == ']' {
+				return j + 1
+			}
+		}
+		return -1
+	}
+
+	braces := 0
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '[':
+			end := globGroupEnd(s, j)
+			if end == -1 {
+				return -1
+			}
+			j = end - 1
+		case '{':
+			braces++
+		case '}':
+			braces--
+			if braces == 0 {
+				return j + 1
+			}
+		}
+	}
+
+	return -1
+}
+
+// splitMetric splits a metric name or glob into its nodes.  Dots inside
+// braces or character classes do not start a new node.
+func splitMetric(m string) []string {
+
+	var nodes []string
+
+	start := 0
+	for i := 0; i < len(m); i++ {
+		switch m[i] {
+		case '{', '[':
+			end := globGroupEnd(m, i)
+			if end == -1 {
+				return append(nodes, m[start:])
+			}
+			i = end - 1
+		case '.':
+			nodes = append(nodes, m[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(nodes, m[start:])
+}
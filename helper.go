@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -50,6 +51,16 @@ func dateParamToEpoch(s string, d int64) int32 {
 	return int32(d)
 }
 
+// isRelativeDate reports whether dateParamToEpoch(s) depends on the time now
+func isRelativeDate(s string) bool {
+	return s == "" || s == "now" || s[0] == '-'
+}
+
+// quantize rounds t down to a multiple of q
+func quantize(t, q int32) int32 {
+	return t - t%q
+}
+
 // intervalString converts a sign and string into a number of seconds
 func intervalString(s string, defaultSign int) (int32, error) {
 
@@ -119,3 +130,21 @@ func truthyBool(s string) bool {
 	}
 	return false
 }
+
+// parseAssignments parses a comma separated list like "a=1,b=2"
+func parseAssignments(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if s == "" {
+		return m, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		eq := strings.LastIndexByte(kv, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("expected name=value, got %q", kv)
+		}
+		m[strings.TrimSpace(kv[:eq])] = strings.TrimSpace(kv[eq+1:])
+	}
+
+	return m, nil
+}
@@ -1,10 +1,186 @@
 package main
 
-type limiter chan struct{}
+import (
+	"sync"
+	"time"
+)
 
-func (l limiter) enter() { l <- struct{}{} }
-func (l limiter) leave() { <-l }
+// limiter bounds our concurrency to the zipper.  When every slot is taken,
+// a freed slot goes to a request of the highest priority waiting, and
+// among those to the client using the smallest share of the slots for its
+// weight, so one busy client can't starve the others.
+type limiter struct {
+	mu sync.Mutex
 
-func NewLimiter(l int) limiter {
-	return make(chan struct{}, l)
+	free    int
+	weights map[string]int
+	inUse   map[string]int
+
+	priorities [numPriorities]priorityQueue
+}
+
+type priorityQueue struct {
+	limit   int // most slots used at once, 0 for no limit of its own
+	timeout time.Duration
+
+	inUse   int
+	waiting map[string][]chan struct{}
+}
+
+// zipperClient is who a zipper request is made for
+type zipperClient struct {
+	name     string
+	user     string
+	priority priority
+}
+
+func NewLimiter(l int) *limiter {
+	lim := &limiter{
+		free:    l,
+		weights: make(map[string]int),
+		inUse:   make(map[string]int),
+	}
+	for p := range lim.priorities {
+		lim.priorities[p].waiting = make(map[string][]chan struct{})
+	}
+	return lim
+}
+
+// setWeight gives client weight times the share of the slots of a client
+// with the default weight of 1
+func (l *limiter) setWeight(client string, weight int) {
+	l.mu.Lock()
+	l.weights[client] = weight
+	l.mu.Unlock()
+}
+
+// setPriorityLimits limits the slots requests of priority p may use at once,
+// and how long they may wait for one; zero means no limit
+func (l *limiter) setPriorityLimits(p priority, slots int, timeout time.Duration) {
+	l.mu.Lock()
+	l.priorities[p].limit = slots
+	l.priorities[p].timeout = timeout
+	l.mu.Unlock()
+}
+
+func (l *limiter) weight(client string) int {
+	if w, ok := l.weights[client]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// admits returns whether q is under its own limit
+func (q *priorityQueue) admits() bool {
+	return q.limit == 0 || q.inUse < q.limit
+}
+
+func (l *limiter) take(c zipperClient) {
+	l.free--
+	l.inUse[c.name]++
+	l.priorities[c.priority].inUse++
+}
+
+// enter waits for a slot, returning ErrQueueTimeout if that takes longer
+// than the timeout of c's priority
+func (l *limiter) enter(c zipperClient) error {
+	l.mu.Lock()
+
+	q := &l.priorities[c.priority]
+
+	if l.free > 0 && q.admits() {
+		l.take(c)
+		l.mu.Unlock()
+		return nil
+	}
+
+	ch := make(chan struct{})
+	q.waiting[c.name] = append(q.waiting[c.name], ch)
+	timeout := q.timeout
+	l.mu.Unlock()
+
+	if timeout == 0 {
+		<-ch
+		return nil
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	waiting := q.waiting[c.name]
+	for i := range waiting {
+		if waiting[i] == ch {
+			if len(waiting) == 1 {
+				delete(q.waiting, c.name)
+			} else {
+				q.waiting[c.name] = append(waiting[:i:i], waiting[i+1:]...)
+			}
+			priorityMetrics[c.priority].QueueTimeouts.Add(1)
+			return ErrQueueTimeout{Priority: c.priority}
+		}
+	}
+
+	// given a slot just as we timed out
+	return nil
+}
+
+func (l *limiter) leave(c zipperClient) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.free++
+	l.inUse[c.name]--
+	if l.inUse[c.name] == 0 {
+		delete(l.inUse, c.name)
+	}
+	l.priorities[c.priority].inUse--
+
+	l.dispatch()
+}
+
+// dispatch hands out the free slots to waiting requests
+func (l *limiter) dispatch() {
+	for l.free > 0 {
+		var q *priorityQueue
+		var p priority
+		for i := range l.priorities {
+			if len(l.priorities[i].waiting) > 0 && l.priorities[i].admits() {
+				q, p = &l.priorities[i], priority(i)
+				break
+			}
+		}
+
+		if q == nil {
+			return
+		}
+
+		// compare inUse/weight between clients without dividing
+		var next string
+		found := false
+		for c := range q.waiting {
+			if !found || l.inUse[c]*l.weight(next) < l.inUse[next]*l.weight(c) {
+				next = c
+				found = true
+			}
+		}
+
+		ch := q.waiting[next][0]
+		if len(q.waiting[next]) == 1 {
+			delete(q.waiting, next)
+		} else {
+			q.waiting[next] = q.waiting[next][1:]
+		}
+
+		l.take(zipperClient{name: next, priority: p})
+		close(ch)
+	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// query cost limits
+//
+// A single target like *.*.*.* can match hundreds of thousands of series.
+// The number of series a request matches is checked once the finds are done
+// and before anything is rendered, the number of datapoints once the data is
+// in, and evaluation gets a deadline.  Requests over a limit get a 422.
+
+// queryLimits are set from the command line; zero means no limit
+var queryLimits struct {
+	globMatches int
+	datapoints  int
+	evalTime    time.Duration
+}
+
+type ErrQueryLimit struct {
+	Target string
+	Reason string
+}
+
+func (e ErrQueryLimit) Error() string {
+	return fmt.Sprintf("%s: %s", e.Target, e.Reason)
+}
+
+func writeQueryLimitError(w http.ResponseWriter, err error) {
+	msg := fmt.Sprintf("%s\n\n%-20s: %s\n", http.StatusText(http.StatusUnprocessableEntity), "Error", err.Error())
+	http.Error(w, msg, http.StatusUnprocessableEntity)
+}
+
+// costCounter adds up a cost over the metrics of a request, counting each
+// metric once even if several targets use it
+type costCounter struct {
+	what     string
+	limit    int
+	rejected *expvar.Int
+
+	total   int
+	counted map[metricRequest]bool
+}
+
+func newCostCounter(what string, limit int, rejected *expvar.Int) *costCounter {
+	return &costCounter{what: what, limit: limit, rejected: rejected, counted: make(map[metricRequest]bool)}
+}
+
+// add counts the cost n of metric m, used by target
+func (c *costCounter) add(target string, m metricRequest, n int) error {
+	if c.counted[m] {
+		return nil
+	}
+	c.counted[m] = true
+	c.total += n
+
+	if c.limit > 0 && c.total > c.limit {
+		c.rejected.Add(1)
+		return ErrQueryLimit{Target: target, Reason: fmt.Sprintf("%d %s is more than the limit of %d", c.total, c.what, c.limit)}
+	}
+
+	return nil
+}
+
+// addTargets counts the cost of the requests of each target.  Request times
+// are offsets from from32 and until32, cost is given absolute ones.
+func (c *costCounter) addTargets(targets []string, requests [][]metricRequest, from32, until32 int32, cost func(m metricRequest) int) error {
+	for i, target := range targets {
+		for _, m := range requests[i] {
+			m = absoluteRequest(m, from32, until32)
+			if err := c.add(target, m, cost(m)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
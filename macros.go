@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// template variables and macros
+//
+// Targets may refer to $name or ${name}, bound either by a var.name request
+// parameter or by a macro from the -macros file.  Request variables win over
+// macros of the same name, and macros may use other macros and variables.
+
+// targetMacros are the macros read from the -macros file
+var targetMacros map[string]string
+
+// macro expansion stops at this depth, which catches macros using themselves
+const maxMacroDepth = 10
+
+type ErrUnboundVariable struct {
+	Name string
+}
+
+func (e ErrUnboundVariable) Error() string {
+	return fmt.Sprintf("unbound variable $%s", e.Name)
+}
+
+// readMacros reads macro definitions, one `name = expansion' per line.
+// Blank lines and lines starting with # are ignored.
+func readMacros(r io.Reader) (map[string]string, error) {
+
+	macros := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+
+		eq := strings.IndexByte(l, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("line %d: expected name = expansion", line)
+		}
+
+		name := strings.TrimSpace(l[:eq])
+		if !isVariableName(name) {
+			return nil, fmt.Errorf("line %d: bad macro name %q", line, name)
+		}
+
+		macros[name] = strings.TrimSpace(l[eq+1:])
+	}
+
+	return macros, scanner.Err()
+}
+
+func isVariableName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && isDigit(c)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// expandTarget substitutes the variables in target.  A variable nobody has
+// bound is an error, except inside a quoted string, where it's left alone:
+// replacement strings may use $1 or ${name} for regexp groups.
+func expandTarget(target string, vars map[string]string) (string, error) {
+	return expandMacros(target, vars, 0)
+}
+
+func expandMacros(target string, vars map[string]string, depth int) (string, error) {
+
+	if strings.IndexByte(target, '$') == -1 {
+		return target, nil
+	}
+
+	if depth == maxMacroDepth {
+		return "", fmt.Errorf("macros nested more than %d deep", maxMacroDepth)
+	}
+
+	var b bytes.Buffer
+
+	var quote byte
+
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		}
+
+		if c != '$' {
+			b.WriteByte(c)
+			continue
+		}
+
+		var name string
+		var end int
+
+		if strings.HasPrefix(target[i+1:], "{") {
+			if close := strings.IndexByte(target[i:], '}'); close != -1 {
+				name, end = target[i+2:i+close], i+close+1
+			}
+		} else {
+			end = i + 1
+			for end < len(target) && isVariableName(target[i+1:end+1]) {
+				end++
+			}
+			name = target[i+1 : end]
+		}
+
+		if !isVariableName(name) {
+			b.WriteByte(c)
+			continue
+		}
+
+		v, ok := vars[name]
+		if !ok {
+			v, ok = targetMacros[name]
+		}
+
+		if !ok {
+			if quote != 0 {
+				b.WriteByte(c)
+				continue
+			}
+			return "", ErrUnboundVariable{Name: name}
+		}
+
+		v, err := expandMacros(v, vars, depth+1)
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(v)
+		i = end - 1
+	}
+
+	return b.String(), nil
+}
@@ -6,6 +6,7 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	_ "net/http/pprof"
@@ -14,10 +15,13 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
 	"github.com/dgryski/carbonzipper/mlog"
+	"github.com/gogo/protobuf/proto"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	ecache "github.com/dgryski/go-expirecache"
@@ -35,6 +39,13 @@ var Metrics = struct {
 
 	MemcacheTimeouts *expvar.Int
 
+	RejectedGlobMatches *expvar.Int
+	RejectedDatapoints  *expvar.Int
+	RejectedEvalTime    *expvar.Int
+
+	RateLimited  *expvar.Int
+	AuthFailures *expvar.Int
+
 	CacheSize  expvar.Func
 	CacheItems expvar.Func
 }{
@@ -47,6 +58,13 @@ var Metrics = struct {
 	RenderRequests: expvar.NewInt("render_requests"),
 
 	MemcacheTimeouts: expvar.NewInt("memcache_timeouts"),
+
+	RejectedGlobMatches: expvar.NewInt("rejected_glob_matches"),
+	RejectedDatapoints:  expvar.NewInt("rejected_datapoints"),
+	RejectedEvalTime:    expvar.NewInt("rejected_eval_time"),
+
+	RateLimited:  expvar.NewInt("rate_limited"),
+	AuthFailures: expvar.NewInt("auth_failures"),
 }
 
 var BuildVersion = "(development build)"
@@ -62,7 +80,11 @@ var logger mlog.Level
 
 var Zipper zipper
 
-var Limiter limiter
+var Limiter *limiter
+
+// relative from and until are rounded down to a multiple of this many
+// seconds, so that requests made a little apart share a cache entry
+var timeQuantum int32
 
 // for testing
 var timeNow = time.Now
@@ -111,10 +133,23 @@ const (
 
 type renderStats struct {
 	zipperRequests int
+	queueTimeouts  int
 }
 
 func buildParseErrorString(target, e string, err error) string {
 	msg := fmt.Sprintf("%s\n\n%-20s: %s\n", http.StatusText(http.StatusBadRequest), "Target", target)
+
+	// point at where things went wrong
+	pos := -1
+	if e != "" {
+		pos = len(target) - len(e)
+	} else if ic, ok := err.(ErrInvalidCall); ok {
+		pos = ic.Pos
+	}
+	if pos >= 0 {
+		msg += fmt.Sprintf("%-20s  %s^\n", "", strings.Repeat(" ", pos))
+	}
+
 	if err != nil {
 		msg += fmt.Sprintf("%-20s: %s\n", "Error", err.Error())
 	}
@@ -130,17 +165,32 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 
 	Metrics.Requests.Add(1)
 
+	user, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest)+": "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	prio, err := requestPriority(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest)+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	priorityMetrics[prio].Requests.Add(1)
+
+	client := zipperClient{name: clientID(r), user: user, priority: prio}
+
 	targets := r.Form["target"]
 	from := r.FormValue("from")
 	until := r.FormValue("until")
 	format := r.FormValue("format")
 	useCache := truthyBool(r.FormValue("noCache")) == false
+	infix := truthyBool(r.FormValue("infix"))
 
 	var jsonp string
 
@@ -179,9 +229,64 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 		}
 	}
 
+	// parse and validate every target before fetching anything, so a bad
+	// argument in the last target doesn't cost us the fetches for the others.
+	// What we evaluate and cache is the canonical form of each target, so
+	// targets which only differ in spacing or quoting share a cache entry.
+	var canonical []string
+
+	vars := make(map[string]string)
+	for k, v := range r.Form {
+		if strings.HasPrefix(k, "var.") {
+			vars[k[len("var."):]] = v[0]
+		}
+	}
+
+	for _, target := range targets {
+		expanded, err := expandTarget(target, vars)
+		if err != nil {
+			msg := buildParseErrorString(target, "", err)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		target = expanded
+
+		parse := parseExpr
+		if infix {
+			parse = parseInfixExpr
+		}
+		exp, e, err := parse(target)
+
+		if err != nil || e != "" {
+			msg := buildParseErrorString(target, e, err)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		if err := validateExpr(exp); err != nil {
+			msg := buildParseErrorString(target, "", err)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		canonical = append(canonical, exp.String())
+	}
+
+	r.Form["target"] = canonical
+
+	// infix operators have been rewritten into function calls and variables
+	// substituted by now
+	r.Form.Del("infix")
+	for k := range vars {
+		r.Form.Del("var." + k)
+	}
+
 	// make sure the cache key doesn't say noCache, because it will never hit
 	r.Form.Del("noCache")
 
+	// the same targets render the same whatever their priority
+	r.Form.Del("priority")
+
 	// jsonp callback names are frequently autogenerated and hurt our cache
 	r.Form.Del("jsonp")
 
@@ -190,107 +295,161 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 	r.Form.Del("_ts")
 	r.Form.Del("_t") // Used by jquery.graphite.js
 
-	cacheKey := r.Form.Encode()
-
-	if response, ok := queryCache.get(cacheKey); useCache && ok {
-		Metrics.RequestCacheHits.Add(1)
-		writeResponse(w, response, format, jsonp)
-		return
-	}
-
 	// normalize from and until values
 	// BUG(dgryski): doesn't handle timezones the same as graphite-web
 	from32 := dateParamToEpoch(from, timeNow().Add(-24*time.Hour).Unix())
 	until32 := dateParamToEpoch(until, timeNow().Unix())
+
+	// relative times would give a different key every second
+	if timeQuantum > 0 {
+		if isRelativeDate(from) {
+			from32 = quantize(from32, timeQuantum)
+			r.Form.Set("from", strconv.Itoa(int(from32)))
+		}
+		if isRelativeDate(until) {
+			until32 = quantize(until32, timeQuantum)
+			r.Form.Set("until", strconv.Itoa(int(until32)))
+		}
+	}
+
 	if from32 == until32 {
 		http.Error(w, "Invalid empty time range", http.StatusBadRequest)
 		return
 	}
 
-	var results []*metricData
-	metricMap := make(map[metricRequest][]*metricData)
+	// Encode sorts the parameters by name.  The targets keep their order, as
+	// it's the order of the series in the response.
+	cacheKey := r.Form.Encode()
 
-	for _, target := range targets {
+	// users see different series for the same targets
+	if metricACLs != nil {
+		cacheKey = "user=" + url.QueryEscape(user) + "&" + cacheKey
+	}
+
+	if response, ok := queryCache.get(cacheKey); useCache && ok {
+		Metrics.RequestCacheHits.Add(1)
+		writeResponse(w, response, format, jsonp)
+		return
+	}
+
+	var exps []*expr
+
+	for _, target := range canonical {
 		if maxDataPoints > 0 {
-			target = fmt.Sprintf("maxDataPoints(%s, %d)", target, maxDataPoints)
+			target = fmt.Sprintf("maxDataPoints(%s,%d)", target, maxDataPoints)
 		}
-		exp, e, err := parseExpr(target)
 
+		exp, e, err := parseExpr(target)
 		if err != nil || e != "" {
 			msg := buildParseErrorString(target, e, err)
 			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
+		exps = append(exps, exp)
+	}
 
-		for _, m := range exp.metrics() {
+	metricMap := make(map[metricRequest][]*metricData)
 
-			mfetch := m
-			mfetch.from += from32
-			mfetch.until += until32
+	matches := newCostCounter("matching series", queryLimits.globMatches, Metrics.RejectedGlobMatches)
+	datapoints := newCostCounter("datapoints", queryLimits.datapoints, Metrics.RejectedDatapoints)
 
-			if _, ok := metricMap[mfetch]; ok {
-				// already fetched this metric for this request
-				continue
-			}
+	// Fetch the metrics of all targets at once, so the slowest fetch isn't
+	// waited for once per target.
+	var all []metricRequest
+	requests := make([][]metricRequest, len(exps))
+	for i, exp := range exps {
+		requests[i] = exp.metrics()
+		all = append(all, requests[i]...)
+	}
 
-			var glob pb.GlobResponse
-			var haveCacheData bool
+	leaves := findMetrics(all, from32, until32, metricMap, useCache, client, stats)
 
-			if response, ok := findCache.get(m.metric); useCache && ok {
-				Metrics.FindCacheHits.Add(1)
-				err := glob.Unmarshal(response)
-				haveCacheData = err == nil
-			}
+	err = matches.addTargets(canonical, requests, from32, until32, func(m metricRequest) int {
+		return len(leaves[m])
+	})
+	if err != nil {
+		writeQueryLimitError(w, err)
+		return
+	}
 
-			if !haveCacheData {
-				var err error
-				Metrics.FindRequests.Add(1)
-				stats.zipperRequests++
-				glob, err = Zipper.Find(m.metric)
-				if err != nil {
-					logger.Logf("Find: %v: %v", m.metric, err)
-					continue
-				}
-				b, err := glob.Marshal()
-				if err == nil {
-					findCache.set(m.metric, b, 5*60)
-				}
-			}
+	renderMetrics(leaves, metricMap, client, stats)
 
-			// For each metric returned in the Find response, query Render
-			// This is a conscious decision to *not* cache render data
-			rch := make(chan *metricData, len(glob.GetMatches()))
-			leaves := 0
-			for _, m := range glob.GetMatches() {
-				if !m.GetIsLeaf() {
-					continue
-				}
-				Metrics.RenderRequests.Add(1)
-				leaves++
-				Limiter.enter()
-				stats.zipperRequests++
-				go func(m *pb.GlobMatch, from, until int32) {
-					var rptr *metricData
-					r, err := Zipper.Render(m.GetPath(), from, until)
-					if err == nil {
-						rptr = &r
-					} else {
-						logger.Logf("Render: %v: %v", m.GetPath(), err)
-					}
-					rch <- rptr
-					Limiter.leave()
-				}(m, mfetch.from, mfetch.until)
-			}
+	if stats.queueTimeouts > 0 {
+		writeQueueTimeoutError(w, ErrQueueTimeout{Priority: prio})
+		return
+	}
 
-			for i := 0; i < leaves; i++ {
-				r := <-rch
-				if r != nil {
-					metricMap[mfetch] = append(metricMap[mfetch], r)
-				}
+	err = datapoints.addTargets(canonical, requests, from32, until32, func(m metricRequest) int {
+		var n int
+		for _, d := range metricMap[m] {
+			n += len(d.Values)
+		}
+		return n
+	})
+	if err != nil {
+		writeQueryLimitError(w, err)
+		return
+	}
+
+	// Windows given in points need the data from before `from', which needs
+	// the step of the data fetched above.  Only that data is fetched, for
+	// the series already found.
+	steps := metricSteps(metricMap)
+	extend := make(map[metricRequest]metricRequest)
+	extended := make([][]metricRequest, len(exps))
+	for i, exp := range exps {
+		extended[i] = exp.bootstrapMetrics(steps)
+		for j, m := range extended[i] {
+			m = absoluteRequest(m, from32, until32)
+			if _, ok := metricMap[m]; !ok && j < len(requests[i]) {
+				extend[m] = absoluteRequest(requests[i][j], from32, until32)
 			}
 		}
+	}
+
+	if len(extend) > 0 {
+		fetched := extendMetrics(extend, leaves, metricMap, client, stats)
+
+		if stats.queueTimeouts > 0 {
+			writeQueueTimeoutError(w, ErrQueueTimeout{Priority: prio})
+			return
+		}
 
-		func() {
+		err = datapoints.addTargets(canonical, extended, from32, until32, func(m metricRequest) int {
+			return fetched[m]
+		})
+		if err != nil {
+			writeQueryLimitError(w, err)
+			return
+		}
+	}
+
+	// metrics only known during evaluation are fetched for the same client,
+	// within the same limits
+	fetch := &fetchContext{
+		client:     client,
+		useCache:   useCache,
+		stats:      stats,
+		matches:    matches,
+		datapoints: datapoints,
+	}
+
+	// The targets are evaluated in parallel.  evalExpr adds to the map it's
+	// given, so each target gets its own copy of metricMap, but the
+	// subexpressions they share are still evaluated once, through fetch.
+	targetResults := make([][]*metricData, len(exps))
+	evaluated := make([]int32, len(exps))
+
+	var wg sync.WaitGroup
+	for i, exp := range exps {
+		values := make(map[metricRequest][]*metricData, len(metricMap))
+		for k, v := range metricMap {
+			values[k] = v
+		}
+
+		wg.Add(1)
+		go func(i int, exp *expr) {
+			defer wg.Done()
 			defer func() {
 				if r := recover(); r != nil {
 					var buf [1024]byte
@@ -298,9 +457,51 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 					logger.Logf("panic during eval: %s: %s\n%s\n", cacheKey, r, string(buf[:]))
 				}
 			}()
-			exprs := evalExpr(exp, from32, until32, metricMap)
-			results = append(results, exprs...)
-		}()
+			targetResults[i] = evalExpr(exp, from32, until32, values, fetch)
+			atomic.StoreInt32(&evaluated[i], 1)
+		}(i, exp)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if queryLimits.evalTime > 0 {
+		timer := time.NewTimer(queryLimits.evalTime)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-done:
+	case <-timeout:
+		// the evaluations can't be stopped; their results are dropped
+		fetch.stop()
+		for i := range exps {
+			if atomic.LoadInt32(&evaluated[i]) == 0 {
+				Metrics.RejectedEvalTime.Add(1)
+				writeQueryLimitError(w, ErrQueryLimit{Target: canonical[i], Reason: fmt.Sprintf("evaluation took longer than the limit of %v", queryLimits.evalTime)})
+				return
+			}
+		}
+		<-done
+	}
+
+	if err := fetch.err; err != nil {
+		if _, ok := err.(ErrQueueTimeout); ok {
+			writeQueueTimeoutError(w, err)
+		} else {
+			writeQueryLimitError(w, err)
+		}
+		return
+	}
+
+	var results []*metricData
+	for _, r := range targetResults {
+		results = append(results, r...)
 	}
 
 	var body []byte
@@ -327,8 +528,371 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 	}
 }
 
+// fetchContext fetches the metrics a render request's targets only name once
+// they're being evaluated, such as those built by applyByNode, for the same
+// client and within the same query limits as the rest of the request.  It
+// also shares the subexpressions evaluated between the targets.  A nil
+// fetchContext fetches nothing and shares nothing.
+type fetchContext struct {
+	client   zipperClient
+	useCache bool
+
+	mu         sync.Mutex
+	stats      *renderStats
+	matches    *costCounter
+	datapoints *costCounter
+
+	// err is the first queue timeout or query limit hit, after which
+	// nothing more is fetched
+	err     error
+	stopped bool
+
+	memo map[metricRequest]*memoEntry
+}
+
+// memoEntry is a subexpression being evaluated, whose result is ready once
+// done is closed
+type memoEntry struct {
+	done chan struct{}
+	r    []*metricData
+}
+
+// onDemand fetches the requests that aren't already in values.  Request
+// times are offsets from from32 and until32.
+func (f *fetchContext) onDemand(requests []metricRequest, from32, until32 int32, values map[metricRequest][]*metricData) {
+	if f == nil {
+		return
+	}
+
+	var stats renderStats
+
+	leaves := findMetrics(requests, from32, until32, values, f.useCache, f.client, &stats)
+	if !f.record(&stats, f.matches, leaves, func(m metricRequest) int {
+		return len(leaves[m])
+	}) {
+		return
+	}
+
+	fetched := make(map[metricRequest][]*metricData)
+	renderMetrics(leaves, fetched, f.client, &stats)
+	if !f.record(&stats, f.datapoints, leaves, func(m metricRequest) int {
+		var n int
+		for _, d := range fetched[m] {
+			n += len(d.Values)
+		}
+		return n
+	}) {
+		return
+	}
+
+	for m, data := range fetched {
+		values[m] = data
+	}
+}
+
+// record adds stats to those of the request, and the cost of each request in
+// leaves to c.  It returns whether fetching may go on.
+func (f *fetchContext) record(stats *renderStats, c *costCounter, leaves map[metricRequest][]string, cost func(m metricRequest) int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stopped {
+		return false
+	}
+
+	f.stats.zipperRequests += stats.zipperRequests
+	f.stats.queueTimeouts += stats.queueTimeouts
+	if stats.queueTimeouts > 0 && f.err == nil {
+		f.err = ErrQueueTimeout{Priority: f.client.priority}
+	}
+	*stats = renderStats{}
+
+	for m := range leaves {
+		if f.err != nil {
+			break
+		}
+		f.err = c.add(m.metric, m, cost(m))
+	}
+
+	return f.err == nil
+}
+
+// evalOnce returns the result of the subexpression m, calling eval for it if
+// no target has yet.  Targets asking for it meanwhile wait for the first.
+func (f *fetchContext) evalOnce(m metricRequest, eval func() []*metricData) []*metricData {
+	if f == nil {
+		return eval()
+	}
+
+	f.mu.Lock()
+	if e, ok := f.memo[m]; ok {
+		f.mu.Unlock()
+		<-e.done
+		return e.r
+	}
+	if f.memo == nil {
+		f.memo = make(map[metricRequest]*memoEntry)
+	}
+	e := &memoEntry{done: make(chan struct{})}
+	f.memo[m] = e
+	f.mu.Unlock()
+
+	// close done even if eval panics, so no one waits forever
+	defer close(e.done)
+	e.r = eval()
+	return e.r
+}
+
+// stop keeps anything more being fetched, or added to the request's stats,
+// once the request has given up on its evaluations
+func (f *fetchContext) stop() {
+	f.mu.Lock()
+	f.stopped = true
+	f.mu.Unlock()
+}
+
+// absoluteRequest turns the offsets in m into times
+func absoluteRequest(m metricRequest, from32, until32 int32) metricRequest {
+	m.from += from32
+	m.until += until32
+	return m
+}
+
+// findMetrics finds the series matching each request that isn't already in
+// metricMap.  The results are keyed by requests with absolute times.
+func findMetrics(requests []metricRequest, from32, until32 int32, metricMap map[metricRequest][]*metricData, useCache bool, client zipperClient, stats *renderStats) map[metricRequest][]string {
+
+	type found struct {
+		m              metricRequest
+		paths          []string
+		zipperRequests int
+		err            error
+	}
+
+	ch := make(chan found, len(requests))
+	pending := make(map[metricRequest]bool)
+
+	for _, m := range requests {
+
+		mfetch := absoluteRequest(m, from32, until32)
+
+		if _, ok := metricMap[mfetch]; ok || pending[mfetch] {
+			// already fetched this metric for this request
+			continue
+		}
+		pending[mfetch] = true
+
+		go func(mfetch metricRequest) {
+			paths, n, err := findLeaves(mfetch.metric, useCache, client)
+			ch <- found{m: mfetch, paths: paths, zipperRequests: n, err: err}
+		}(mfetch)
+	}
+
+	leaves := make(map[metricRequest][]string)
+
+	for range pending {
+		f := <-ch
+		stats.zipperRequests += f.zipperRequests
+		if _, ok := f.err.(ErrQueueTimeout); ok {
+			stats.queueTimeouts++
+		}
+		if f.err != nil {
+			logger.Logf("Find: %v: %v", f.m.metric, f.err)
+			continue
+		}
+		leaves[f.m] = f.paths
+	}
+
+	return leaves
+}
+
+// findLeaves returns the paths of the series matching metric, and the number
+// of requests made to the zipper
+func findLeaves(metric string, useCache bool, client zipperClient) ([]string, int, error) {
+
+	var zipperRequests int
+
+	var glob pb.GlobResponse
+	var haveCacheData bool
+
+	findCacheKey := globCacheKey(metric)
+
+	if response, ok := findCache.get(findCacheKey); useCache && ok {
+		Metrics.FindCacheHits.Add(1)
+		err := glob.Unmarshal(response)
+		haveCacheData = err == nil
+	}
+
+	if !haveCacheData {
+		var err error
+		Metrics.FindRequests.Add(1)
+		zipperRequests++
+		if err := Limiter.enter(client); err != nil {
+			return nil, zipperRequests, err
+		}
+		glob, err = Zipper.Find(metric)
+		Limiter.leave(client)
+		if err != nil {
+			return nil, zipperRequests, err
+		}
+		b, err := glob.Marshal()
+		if err == nil {
+			findCache.set(findCacheKey, b, 5*60)
+		}
+	}
+
+	var paths []string
+	for _, m := range glob.GetMatches() {
+		if m.GetIsLeaf() && aclAllows(client.user, m.GetPath(), true) {
+			paths = append(paths, m.GetPath())
+		}
+	}
+
+	return paths, zipperRequests, nil
+}
+
+// renderMetrics fetches the data of the series found by findMetrics
+func renderMetrics(leaves map[metricRequest][]string, metricMap map[metricRequest][]*metricData, client zipperClient, stats *renderStats) {
+
+	type rendered struct {
+		m metricRequest
+		r *metricData
+	}
+
+	var n int
+	for _, paths := range leaves {
+		n += len(paths)
+	}
+
+	// This is a conscious decision to *not* cache render data
+	ch := make(chan rendered, n)
+
+	for m, paths := range leaves {
+		for _, path := range paths {
+			if stats.queueTimeouts == 0 {
+				if err := Limiter.enter(client); err != nil {
+					logger.Logf("Render: %v: %v", path, err)
+					stats.queueTimeouts++
+				}
+			}
+			if stats.queueTimeouts > 0 {
+				// don't wait for more slots for a request that's failed
+				ch <- rendered{m: m}
+				continue
+			}
+			Metrics.RenderRequests.Add(1)
+			stats.zipperRequests++
+			go func(m metricRequest, path string) {
+				var rptr *metricData
+				r, err := Zipper.Render(path, m.from, m.until)
+				if err == nil {
+					rptr = &r
+				} else {
+					logger.Logf("Render: %v: %v", path, err)
+				}
+				Limiter.leave(client)
+				ch <- rendered{m: m, r: rptr}
+			}(m, path)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		r := <-ch
+		if r.r != nil {
+			metricMap[r.m] = append(metricMap[r.m], r.r)
+		}
+	}
+}
+
+// extendMetrics fetches the data from before the start of requests already
+// in metricMap.  extend maps each request wanted to the fetched request it
+// starts earlier than, whose series are in leaves.  It returns the number of
+// datapoints fetched for each request.
+func extendMetrics(extend map[metricRequest]metricRequest, leaves map[metricRequest][]string, metricMap map[metricRequest][]*metricData, client zipperClient, stats *renderStats) map[metricRequest]int {
+
+	// the data from the start of the wanted request to that of the fetched one
+	before := func(m metricRequest) metricRequest {
+		return metricRequest{metric: m.metric, from: m.from, until: extend[m].from}
+	}
+
+	missing := make(map[metricRequest][]string)
+	for m, fetched := range extend {
+		missing[before(m)] = leaves[fetched]
+	}
+
+	prefixes := make(map[metricRequest][]*metricData)
+	renderMetrics(missing, prefixes, client, stats)
+
+	points := make(map[metricRequest]int)
+
+	for m, fetched := range extend {
+		byName := make(map[string]*metricData)
+		for _, p := range prefixes[before(m)] {
+			byName[p.GetName()] = p
+		}
+
+		var data []*metricData
+		for _, d := range metricMap[fetched] {
+			r := d
+			if p, ok := byName[d.GetName()]; ok {
+				r = prependData(p, d)
+				points[m] += len(r.Values) - len(d.Values)
+			}
+			data = append(data, r)
+		}
+		metricMap[m] = data
+	}
+
+	return points
+}
+
+// prependData returns d with the values of p from before the start of d
+func prependData(p, d *metricData) *metricData {
+
+	step := d.GetStepTime()
+	if p.GetStepTime() != step || step <= 0 || p.GetStartTime() >= d.GetStartTime() {
+		return d
+	}
+
+	n := int((d.GetStartTime() - p.GetStartTime()) / step)
+
+	r := *d
+	r.StartTime = proto.Int32(d.GetStartTime() - int32(n)*step)
+	r.Values = make([]float64, n, n+len(d.Values))
+	r.IsAbsent = make([]bool, n, n+len(d.Values))
+	for i := 0; i < n; i++ {
+		if i < len(p.Values) {
+			r.Values[i] = p.Values[i]
+			r.IsAbsent[i] = p.IsAbsent[i]
+		} else {
+			r.Values[i] = math.NaN()
+			r.IsAbsent[i] = true
+		}
+	}
+	r.Values = append(r.Values, d.Values...)
+	r.IsAbsent = append(r.IsAbsent, d.IsAbsent...)
+
+	return &r
+}
+
+// metricSteps returns the step of the data fetched for each metric
+func metricSteps(metricMap map[metricRequest][]*metricData) map[string]int32 {
+	steps := make(map[string]int32)
+	for m, data := range metricMap {
+		if len(data) > 0 {
+			steps[m.metric] = data[0].GetStepTime()
+		}
+	}
+	return steps
+}
+
 func findHandler(w http.ResponseWriter, r *http.Request) {
 
+	user, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
 	format := r.FormValue("format")
 	jsonp := r.FormValue("jsonp")
 
@@ -349,6 +913,16 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if metricACLs != nil {
+		var allowed []*pb.GlobMatch
+		for _, m := range globs.GetMatches() {
+			if aclAllows(user, m.GetPath(), m.GetIsLeaf()) {
+				allowed = append(allowed, m)
+			}
+		}
+		globs.Matches = allowed
+	}
+
 	var b []byte
 	switch format {
 	case "treejson", "json":
@@ -475,6 +1049,17 @@ func corsHandler(handler http.HandlerFunc) http.HandlerFunc {
 }
 
 func passthroughHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// the zipper would tell anyone about any series
+	if !aclAllows(user, r.FormValue("target"), true) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
 	var data []byte
 	var err error
 
@@ -523,6 +1108,22 @@ func main() {
 	graphiteHost := flag.String("graphite", "", "graphite destination host")
 	logdir := flag.String("logdir", "/var/log/carbonapi/", "logging directory")
 	logtostdout := flag.Bool("stdout", false, "log also to stdout")
+	quantum := flag.Int("quantize", 0, "round relative from and until down to this many seconds (0 to disable)")
+	macros := flag.String("macros", "", "file of target macros, one name = expansion per line")
+	maxGlobMatches := flag.Int("max-glob-matches", 0, "most series a render request may match (0 for no limit)")
+	maxDatapoints := flag.Int("max-datapoints", 0, "most datapoints a render request may fetch (0 for no limit)")
+	maxEvalTime := flag.Duration("max-eval-time", 0, "longest a render request may spend evaluating its targets (0 for no limit)")
+	clientHdr := flag.String("client-header", "", "header identifying the client, such as an API key (default is the source address)")
+	clientRate := flag.Float64("client-rate", 0, "requests a second allowed to each client (0 for no limit)")
+	clientBurst := flag.Int("client-burst", 10, "requests a client may make at once above -client-rate")
+	clientWeights := flag.String("client-weights", "", "comma separated client=weight shares of the zipper concurrency (default weight is 1)")
+	priorityLimits := flag.String("priority-limits", "", "comma separated priority=N most zipper requests of each priority at once, e.g. bulk=4")
+	apiKeysFile := flag.String("api-keys", "", "file of API keys, one key user per line, sent in the X-Api-Key header")
+	htpasswdFile := flag.String("htpasswd", "", "htpasswd file of users allowed with basic auth, with {SHA} passwords")
+	trustedUserHeader := flag.String("trusted-user-header", "", "header naming the user, set by an authenticating proxy")
+	trustedProxies := flag.String("trusted-proxies", "127.0.0.1/32,::1/128", "comma separated networks of the proxies allowed to set -trusted-user-header")
+	aclFile := flag.String("acl", "", "file of the metric prefixes each user may see, one user prefix... per line")
+	priorityTimeouts := flag.String("priority-timeouts", "", "comma separated priority=D longest wait for the zipper at each priority, e.g. bulk=30s")
 
 	flag.Parse()
 
@@ -537,6 +1138,106 @@ func main() {
 
 	Limiter = NewLimiter(*l)
 
+	weights, err := parseClientWeights(*clientWeights)
+	if err != nil {
+		logger.Fatalln("unable to parse client weights:", err)
+	}
+	for client, w := range weights {
+		Limiter.setWeight(client, w)
+	}
+
+	plimits, err := parsePriorityLimits(*priorityLimits)
+	if err != nil {
+		logger.Fatalln("unable to parse priority limits:", err)
+	}
+	ptimeouts, err := parsePriorityTimeouts(*priorityTimeouts)
+	if err != nil {
+		logger.Fatalln("unable to parse priority timeouts:", err)
+	}
+	for p := priority(0); p < numPriorities; p++ {
+		Limiter.setPriorityLimits(p, plimits[p], ptimeouts[p])
+	}
+
+	clientHeader = *clientHdr
+
+	if *clientRate > 0 {
+		// a bucket holding less than a token would refuse every request
+		if *clientBurst < 1 {
+			logger.Fatalln("-client-burst must be at least 1 with -client-rate")
+		}
+		RateLimiter = newClientRateLimiter(*clientRate, *clientBurst)
+		go RateLimiter.cleaner(time.Minute)
+	}
+
+	timeQuantum = int32(*quantum)
+
+	queryLimits.globMatches = *maxGlobMatches
+	queryLimits.datapoints = *maxDatapoints
+	queryLimits.evalTime = *maxEvalTime
+
+	if *apiKeysFile != "" {
+		f, err := os.Open(*apiKeysFile)
+		if err != nil {
+			logger.Fatalln("unable to open API keys:", err)
+		}
+		keys, err := readAPIKeys(f)
+		f.Close()
+		if err != nil {
+			logger.Fatalf("unable to read API keys from %s: %v", *apiKeysFile, err)
+		}
+		authenticators = append(authenticators, keys)
+	}
+
+	if *htpasswdFile != "" {
+		f, err := os.Open(*htpasswdFile)
+		if err != nil {
+			logger.Fatalln("unable to open htpasswd:", err)
+		}
+		h, err := readHtpasswd(f)
+		f.Close()
+		if err != nil {
+			logger.Fatalf("unable to read htpasswd from %s: %v", *htpasswdFile, err)
+		}
+		authenticators = append(authenticators, h)
+	}
+
+	if *trustedUserHeader != "" {
+		nets, err := parseNetworks(*trustedProxies)
+		if err != nil {
+			logger.Fatalln("unable to parse trusted proxies:", err)
+		}
+		authenticators = append(authenticators, trustedProxy{header: *trustedUserHeader, proxies: nets})
+	}
+
+	if *aclFile != "" {
+		if len(authenticators) == 0 {
+			logger.Fatalln("ACLs need one of -api-keys, -htpasswd or -trusted-user-header")
+		}
+		f, err := os.Open(*aclFile)
+		if err != nil {
+			logger.Fatalln("unable to open ACLs:", err)
+		}
+		metricACLs, err = readACLs(f)
+		f.Close()
+		if err != nil {
+			logger.Fatalf("unable to read ACLs from %s: %v", *aclFile, err)
+		}
+		logger.Logf("read ACLs for %d users from %s", len(metricACLs), *aclFile)
+	}
+
+	if *macros != "" {
+		f, err := os.Open(*macros)
+		if err != nil {
+			logger.Fatalln("unable to open macros:", err)
+		}
+		targetMacros, err = readMacros(f)
+		f.Close()
+		if err != nil {
+			logger.Fatalf("unable to read macros from %s: %v", *macros, err)
+		}
+		logger.Logf("read %d macros from %s", len(targetMacros), *macros)
+	}
+
 	if *z == "" {
 		logger.Fatalln("no zipper provided")
 	}
@@ -643,6 +1344,18 @@ func main() {
 
 		graphite.Register(fmt.Sprintf("carbon.api.%s.memcache_timeouts", hostname), Metrics.MemcacheTimeouts)
 
+		graphite.Register(fmt.Sprintf("carbon.api.%s.rejected_glob_matches", hostname), Metrics.RejectedGlobMatches)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.rejected_datapoints", hostname), Metrics.RejectedDatapoints)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.rejected_eval_time", hostname), Metrics.RejectedEvalTime)
+
+		graphite.Register(fmt.Sprintf("carbon.api.%s.rate_limited", hostname), Metrics.RateLimited)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.auth_failures", hostname), Metrics.AuthFailures)
+
+		for p := range priorityMetrics {
+			graphite.Register(fmt.Sprintf("carbon.api.%s.%s_requests", hostname, priorityNames[p]), priorityMetrics[p].Requests)
+			graphite.Register(fmt.Sprintf("carbon.api.%s.%s_queue_timeouts", hostname, priorityNames[p]), priorityMetrics[p].QueueTimeouts)
+		}
+
 		if Metrics.CacheSize != nil {
 			graphite.Register(fmt.Sprintf("carbon.api.%s.cache_size", hostname), Metrics.CacheSize)
 			graphite.Register(fmt.Sprintf("carbon.api.%s.cache_items", hostname), Metrics.CacheItems)
@@ -657,17 +1370,17 @@ func main() {
 		logger.Logln(r.RequestURI, since.Nanoseconds()/int64(time.Millisecond), stats.zipperRequests)
 	}
 
-	http.HandleFunc("/render/", corsHandler(render))
-	http.HandleFunc("/render", corsHandler(render))
+	http.HandleFunc("/render/", corsHandler(rateLimited(render)))
+	http.HandleFunc("/render", corsHandler(rateLimited(render)))
 
-	http.HandleFunc("/metrics/find/", corsHandler(findHandler))
-	http.HandleFunc("/metrics/find", corsHandler(findHandler))
+	http.HandleFunc("/metrics/find/", corsHandler(rateLimited(findHandler)))
+	http.HandleFunc("/metrics/find", corsHandler(rateLimited(findHandler)))
 
-	http.HandleFunc("/info/", passthroughHandler)
-	http.HandleFunc("/info", passthroughHandler)
+	http.HandleFunc("/info/", rateLimited(passthroughHandler))
+	http.HandleFunc("/info", rateLimited(passthroughHandler))
 
 	http.HandleFunc("/lb_check", lbcheckHandler)
-	http.HandleFunc("/", proxyHandler)
+	http.HandleFunc("/", rateLimited(proxyHandler))
 
 	logger.Logln("listening on port", *port)
 	logger.Fatalln(http.ListenAndServe(":"+strconv.Itoa(*port), nil))
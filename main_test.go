@@ -2,10 +2,21 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"expvar"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/gogo/protobuf/proto"
 )
 
 func TestInterval(t *testing.T) {
@@ -100,6 +111,822 @@ func TestRawResponse(t *testing.T) {
 	}
 }
 
+func TestRenderGeneratedSeries(t *testing.T) {
+
+	// generated series need no zipper, so the whole handler can run
+	queryCache = nullCache{}
+	findCache = nullCache{}
+
+	tests := []struct {
+		query string
+		out   string
+	}{
+		{
+			"target=identity('foo')&from=1500000000&until=1500000180&format=json",
+			`[{"target":"foo","datapoints":[[1500000000,1500000000],[1500000060,1500000060],[1500000120,1500000120]]}]`,
+		},
+		{
+			"target=scale(timeFunction(foo,60),2)&from=1500000000&until=1500000120&format=raw",
+			"scale(foo,2),1500000000,1500000120,60|3000000000,3000000120\n",
+		},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/render/?"+tt.query, nil)
+		renderHandler(w, r, &renderStats{})
+
+		if w.Code != http.StatusOK || w.Body.String() != tt.out {
+			t.Errorf("render(%s)=%d %s, want %s", tt.query, w.Code, w.Body.String(), tt.out)
+		}
+	}
+}
+
+func TestRenderInvalidTarget(t *testing.T) {
+
+	queryCache = nullCache{}
+	findCache = nullCache{}
+
+	// the first target is fine, but nothing may be fetched for it: there's
+	// no zipper here
+	query := "target=foo.bar&target=movingAverage(foo.*,'5x')&from=1500000000&until=1500000180&format=json"
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/render/?"+query, nil)
+	renderHandler(w, r, &renderStats{})
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "movingAverage: argument 2") {
+		t.Errorf("render(%s)=%d %s, want 400", query, w.Code, w.Body.String())
+	}
+
+	// folding the constants would give one the canonical target can't hold
+	query = "target=1e308 * 10 %2B a.b&infix=1&from=1500000000&until=1500000180&format=json"
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/render/?"+query, nil)
+	renderHandler(w, r, &renderStats{})
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrConstantOverflow.Error()) {
+		t.Errorf("render(%s)=%d %s, want 400", query, w.Code, w.Body.String())
+	}
+}
+
+func TestParseErrorCaret(t *testing.T) {
+
+	tests := []struct {
+		target string
+		pos    int
+	}{
+		// the parser stopped at the stray paren
+		{"sum(foo.bar))", 12},
+		// validation points at the bad argument
+		{"sum(scale(foo.bar, 'x'))", 19},
+	}
+
+	for _, tt := range tests {
+		exp, e, err := parseExpr(tt.target)
+		if err == nil && e == "" {
+			err = validateExpr(exp)
+		}
+
+		msg := buildParseErrorString(tt.target, e, err)
+
+		// the caret sits under the target, which follows a 22 column label
+		want := "\n" + strings.Repeat(" ", 22+tt.pos) + "^\n"
+		if !strings.Contains(msg, want) {
+			t.Errorf("buildParseErrorString(%q)=\n%s\nwant caret at %d", tt.target, msg, tt.pos)
+		}
+	}
+}
+
+type mapCache map[string][]byte
+
+func (m mapCache) get(k string) ([]byte, bool)          { v, ok := m[k]; return v, ok }
+func (m mapCache) set(k string, v []byte, expire int32) { m[k] = v }
+
+func TestRenderCacheKey(t *testing.T) {
+
+	cache := mapCache{}
+	queryCache = cache
+	findCache = nullCache{}
+
+	defer func() {
+		timeNow = time.Now
+		timeQuantum = 0
+	}()
+
+	render := func(query string) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/render/?"+query, nil)
+		renderHandler(w, r, &renderStats{})
+		if w.Code != http.StatusOK {
+			t.Fatalf("render(%s)=%d %s", query, w.Code, w.Body.String())
+		}
+	}
+
+	// the same targets, written differently
+	render("target=scale(timeFunction(foo,60), 2.0)&from=1500000000&until=1500000120&format=raw")
+	render("format=raw&until=1500000120&target=scale(timeFunction(foo, 60),2)&from=1500000000")
+	render("target=timeFunction(foo,60) * 2&infix=1&from=1500000000&until=1500000120&format=raw")
+	render("target=scale(timeFunction($name,60),2)&var.name=foo&from=1500000000&until=1500000120&format=raw")
+
+	if len(cache) != 1 {
+		t.Errorf("got %d cache entries, want 1: %v", len(cache), cache)
+	}
+
+	// relative times are rounded down when asked to
+	cache = mapCache{}
+	queryCache = cache
+	timeQuantum = 60
+
+	for _, now := range []int64{1500000000, 1500000030} {
+		timeNow = func() time.Time { return time.Unix(now, 0) }
+		render("target=timeFunction(foo)&from=-5min&format=raw")
+	}
+
+	if len(cache) != 1 {
+		t.Errorf("got %d cache entries for quantized times, want 1: %v", len(cache), cache)
+	}
+}
+
+func TestExpandTarget(t *testing.T) {
+
+	targetMacros = map[string]string{
+		"webnginx": "prod.$dc.web.*.nginx",
+		"loop":     "$loop",
+	}
+	defer func() { targetMacros = nil }()
+
+	vars := map[string]string{"dc": "ams", "n": "2"}
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"sumSeries($webnginx.requests)", "sumSeries(prod.ams.web.*.nginx.requests)"},
+		{"scale(${webnginx}_total, $n)", "scale(prod.ams.web.*.nginx_total, 2)"},
+		{"alias(a.b, '$dc web')", "alias(a.b, 'ams web')"},
+		// regexp replacements aren't variables
+		{"aliasSub(a.b, '(.*)', '$1 ${host}')", "aliasSub(a.b, '(.*)', '$1 ${host}')"},
+	}
+
+	for _, tt := range tests {
+		got, err := expandTarget(tt.target, vars)
+		if err != nil || got != tt.want {
+			t.Errorf("expandTarget(%q)=%q (%v), want %q", tt.target, got, err, tt.want)
+		}
+	}
+
+	if _, err := expandTarget("sumSeries($nosuch.*)", vars); err != (ErrUnboundVariable{Name: "nosuch"}) {
+		t.Errorf("expandTarget with unbound variable: got %v", err)
+	}
+
+	if _, err := expandTarget("$loop", vars); err == nil {
+		t.Errorf("expandTarget with recursive macro succeeded")
+	}
+}
+
+func TestReadMacros(t *testing.T) {
+
+	macros, err := readMacros(strings.NewReader(`
+# nginx on the web servers
+webnginx = prod.ams.web.*.nginx
+db=prod.*.db.*
+`))
+	want := map[string]string{"webnginx": "prod.ams.web.*.nginx", "db": "prod.*.db.*"}
+	if err != nil || !reflect.DeepEqual(macros, want) {
+		t.Errorf("readMacros()=%v (%v), want %v", macros, err, want)
+	}
+
+	if _, err := readMacros(strings.NewReader("web.nginx = prod")); err == nil {
+		t.Errorf("readMacros accepted a bad name")
+	}
+}
+
+// testZipper answers finds and renders as the zipper would.  A find of one
+// of its paths' queries matches those series, any other query matches the
+// series of that name.  Every series has its values, a minute apart, as
+// many as fit before until.
+type testZipper struct {
+	srv *httptest.Server
+
+	paths  map[string][]string
+	values []float64
+
+	// onFind is called before a find is answered, which fails on an error
+	onFind func() error
+
+	mu      sync.Mutex
+	finds   []string
+	renders []string // "target from until"
+}
+
+// newTestZipper starts a testZipper and points Zipper and Limiter at it
+func newTestZipper(paths map[string][]string, values []float64) *testZipper {
+
+	z := &testZipper{paths: paths, values: values}
+
+	z.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b []byte
+		switch r.URL.Path {
+		case "/metrics/find/":
+			if z.onFind != nil {
+				if err := z.onFind(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			query := r.FormValue("query")
+			z.mu.Lock()
+			z.finds = append(z.finds, query)
+			z.mu.Unlock()
+			paths, ok := z.paths[query]
+			if !ok {
+				paths = []string{query}
+			}
+			glob := pb.GlobResponse{Name: proto.String(query)}
+			for _, p := range paths {
+				glob.Matches = append(glob.Matches, &pb.GlobMatch{Path: proto.String(p), IsLeaf: proto.Bool(true)})
+			}
+			b, _ = glob.Marshal()
+		case "/info/":
+			b = []byte("info " + r.FormValue("target"))
+		case "/render/":
+			z.mu.Lock()
+			z.renders = append(z.renders, r.FormValue("target")+" "+r.FormValue("from")+" "+r.FormValue("until"))
+			z.mu.Unlock()
+			from, _ := strconv.Atoi(r.FormValue("from"))
+			until, _ := strconv.Atoi(r.FormValue("until"))
+			values := z.values
+			if n := (until - from) / 60; n < len(values) {
+				values = values[:n]
+			}
+			b, _ = (&pb.MultiFetchResponse{Metrics: []*pb.FetchResponse{{
+				Name:      proto.String(r.FormValue("target")),
+				StartTime: proto.Int32(int32(from)),
+				StopTime:  proto.Int32(int32(from + 60*len(values))),
+				StepTime:  proto.Int32(60),
+				Values:    values,
+				IsAbsent:  make([]bool, len(values)),
+			}}}).Marshal()
+		}
+		w.Write(b)
+	}))
+
+	Zipper = zipper{z: z.srv.URL, client: &http.Client{}}
+	Limiter = NewLimiter(10)
+
+	return z
+}
+
+func (z *testZipper) close() {
+	z.srv.Close()
+	Zipper = zipper{}
+	Limiter = nil
+}
+
+func TestRenderFetchesTargetsConcurrently(t *testing.T) {
+
+	queryCache = nullCache{}
+	findCache = nullCache{}
+
+	z := newTestZipper(nil, []float64{1, 2})
+	defer z.close()
+
+	// finds are only answered once both are in flight
+	var finds sync.WaitGroup
+	finds.Add(2)
+
+	z.onFind = func() error {
+		finds.Done()
+		done := make(chan struct{})
+		go func() { finds.Wait(); close(done) }()
+		select {
+		case <-done:
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("finds weren't concurrent")
+		}
+	}
+
+	query := "target=a.b&target=scale(c.d,2)&from=1500000000&until=1500000120&format=raw"
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/render/?"+query, nil)
+	renderHandler(w, r, &renderStats{})
+
+	want := "a.b,1500000000,1500000120,60|1,2\nscale(c.d,2),1500000000,1500000120,60|2,4\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("render(%s)=%d %q, want %q", query, w.Code, w.Body.String(), want)
+	}
+}
+
+func TestRenderFetchesWindowOnce(t *testing.T) {
+
+	queryCache = nullCache{}
+	findCache = nullCache{}
+
+	z := newTestZipper(nil, []float64{1, 2, 3})
+	defer func() {
+		z.close()
+		queryLimits.datapoints = 0
+	}()
+
+	// two points before from are needed, which is all the second render
+	// asks for, and all that's counted
+	queryLimits.datapoints = 4
+
+	query := "target=movingSum(a.b,2)&from=1500000000&until=1500000120&format=raw"
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/render/?"+query, nil)
+	renderHandler(w, r, &renderStats{})
+
+	want := "movingSum(a.b,2),1500000000,1500000120,60|3,3\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("render(%s)=%d %q, want %q", query, w.Code, w.Body.String(), want)
+	}
+
+	wantFinds := []string{"a.b"}
+	wantRenders := []string{"a.b 1500000000 1500000120", "a.b 1499999880 1500000000"}
+	if !reflect.DeepEqual(z.finds, wantFinds) || !reflect.DeepEqual(z.renders, wantRenders) {
+		t.Errorf("render(%s) found %q and rendered %q, want %q and %q", query, z.finds, z.renders, wantFinds, wantRenders)
+	}
+}
+
+func TestRenderSharesSubexpressionsBetweenTargets(t *testing.T) {
+
+	queryCache = nullCache{}
+	findCache = nullCache{}
+
+	// a random walk evaluated twice would walk differently
+	query := "target=randomWalk('w')&target=scale(randomWalk('w'),1)&from=1500000000&until=1500000600&format=raw"
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/render/?"+query, nil)
+	renderHandler(w, r, &renderStats{})
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || len(lines) != 2 {
+		t.Fatalf("render(%s)=%d %q, want 2 series", query, w.Code, w.Body.String())
+	}
+
+	values := func(line string) string {
+		return line[strings.Index(line, "|"):]
+	}
+	if values(lines[0]) != values(lines[1]) {
+		t.Errorf("randomWalk('w') was evaluated for each target: %q", lines)
+	}
+}
+
+func TestRenderQueryLimits(t *testing.T) {
+
+	queryCache = nullCache{}
+	findCache = nullCache{}
+
+	// x.* matches three series of two points each
+	z := newTestZipper(map[string][]string{"x.*": {"x.1", "x.2", "x.3"}}, []float64{1, 2})
+	defer func() {
+		z.close()
+		queryLimits.globMatches = 0
+		queryLimits.datapoints = 0
+	}()
+
+	tests := []struct {
+		globMatches int
+		datapoints  int
+		code        int
+		err         string
+		rejected    *expvar.Int
+	}{
+		{0, 0, http.StatusOK, "", nil},
+		{3, 6, http.StatusOK, "", nil},
+		{2, 0, http.StatusUnprocessableEntity, "sumSeries(x.*): 3 matching series is more than the limit of 2", Metrics.RejectedGlobMatches},
+		{0, 5, http.StatusUnprocessableEntity, "sumSeries(x.*): 6 datapoints is more than the limit of 5", Metrics.RejectedDatapoints},
+	}
+
+	query := "target=sumSeries(x.*)&from=1500000000&until=1500000120&format=raw"
+
+	for _, tt := range tests {
+		queryLimits.globMatches = tt.globMatches
+		queryLimits.datapoints = tt.datapoints
+
+		var rejected int64
+		if tt.rejected != nil {
+			rejected = tt.rejected.Value()
+		}
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/render/?"+query, nil)
+		renderHandler(w, r, &renderStats{})
+
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.err) {
+			t.Errorf("render with limits %d/%d=%d %q, want %d %q", tt.globMatches, tt.datapoints, w.Code, w.Body.String(), tt.code, tt.err)
+		}
+		if tt.rejected != nil && tt.rejected.Value() != rejected+1 {
+			t.Errorf("rejection with limits %d/%d wasn't counted", tt.globMatches, tt.datapoints)
+		}
+	}
+}
+
+func TestLimiterFairShare(t *testing.T) {
+
+	tests := []struct {
+		slots   int
+		weights map[string]int
+		holding []string
+		queued  []string
+		leaving string
+		want    string
+	}{
+		// b has no slots, so gets the next even though a queued first
+		{2, nil, []string{"a", "a"}, []string{"a", "b"}, "a", "b"},
+		// a at 2 of weight 3 has a smaller share than b at 1 of weight 1
+		{4, map[string]int{"a": 3}, []string{"a", "a", "a", "b"}, []string{"b", "a"}, "a", "a"},
+		// without the weight, b is owed the slot
+		{4, nil, []string{"a", "a", "a", "b"}, []string{"b", "a"}, "a", "b"},
+	}
+
+	for _, tt := range tests {
+		l := NewLimiter(tt.slots)
+		for c, w := range tt.weights {
+			l.setWeight(c, w)
+		}
+		for _, c := range tt.holding {
+			l.enter(zipperClient{name: c})
+		}
+
+		granted := make(chan string, len(tt.queued))
+		for i, c := range tt.queued {
+			go func(c string) {
+				l.enter(zipperClient{name: c})
+				granted <- c
+			}(c)
+			waitQueued(l, i+1)
+		}
+
+		l.leave(zipperClient{name: tt.leaving})
+		if got := <-granted; got != tt.want {
+			t.Errorf("limiter(%d slots, weights %v) holding %v queued %v gave the slot freed by %s to %s, want %s", tt.slots, tt.weights, tt.holding, tt.queued, tt.leaving, got, tt.want)
+		}
+
+		// let the others finish
+		for range tt.queued[1:] {
+			l.leave(zipperClient{name: tt.leaving})
+			<-granted
+		}
+	}
+}
+
+// waitQueued waits for n requests to queue in l, so the queue order is known
+func waitQueued(l *limiter, n int) {
+	for queued := 0; queued != n; {
+		time.Sleep(time.Millisecond)
+		l.mu.Lock()
+		queued = 0
+		for _, q := range l.priorities {
+			for _, w := range q.waiting {
+				queued += len(w)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func TestLimiterPriorities(t *testing.T) {
+
+	interactive := zipperClient{name: "grafana", priority: priorityInteractive}
+	alerting := zipperClient{name: "alerts", priority: priorityAlerting}
+	bulk := zipperClient{name: "export", priority: priorityBulk}
+
+	// the slot freed by bulk goes to the interactive request, though the
+	// others queued first
+	l := NewLimiter(1)
+	l.enter(bulk)
+
+	granted := make(chan zipperClient, 3)
+	for i, c := range []zipperClient{bulk, alerting, interactive} {
+		go func(c zipperClient) {
+			l.enter(c)
+			granted <- c
+		}(c)
+		waitQueued(l, i+1)
+	}
+
+	holder := bulk
+	for _, want := range []zipperClient{interactive, alerting, bulk} {
+		l.leave(holder)
+		if got := <-granted; got != want {
+			t.Errorf("freed slot went to %s priority, want %s", got.priority, want.priority)
+		}
+		holder = want
+	}
+
+	// bulk may only use one slot, and only wait for it briefly
+	l = NewLimiter(2)
+	l.setPriorityLimits(priorityBulk, 1, 10*time.Millisecond)
+	bulk = zipperClient{name: "export", priority: priorityBulk}
+
+	if err := l.enter(bulk); err != nil {
+		t.Errorf("first bulk request: %v", err)
+	}
+
+	timeouts := priorityMetrics[priorityBulk].QueueTimeouts.Value()
+	err := l.enter(bulk)
+	if _, ok := err.(ErrQueueTimeout); !ok {
+		t.Errorf("second bulk request=%v, want queue timeout", err)
+	}
+	if n := priorityMetrics[priorityBulk].QueueTimeouts.Value() - timeouts; n != 1 {
+		t.Errorf("bulk queue timeouts went up by %d, want 1", n)
+	}
+	if n := len(l.priorities[priorityBulk].waiting); n != 0 {
+		t.Errorf("%d bulk clients still waiting after timing out", n)
+	}
+
+	// which leaves the other slot for interactive requests
+	if err := l.enter(interactive); err != nil {
+		t.Errorf("interactive request: %v", err)
+	}
+}
+
+func TestRenderQueueTimeout(t *testing.T) {
+
+	queryCache = nullCache{}
+	findCache = nullCache{}
+
+	// no zipper slots at all, so bulk requests time out
+	Limiter = NewLimiter(0)
+	Limiter.setPriorityLimits(priorityBulk, 0, time.Millisecond)
+	defer func() {
+		Limiter = nil
+	}()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/render/bulk/?target=a.b&from=1500000000&until=1500000120&format=raw", nil)
+	renderHandler(w, r, &renderStats{})
+
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "bulk priority") {
+		t.Errorf("render with no zipper slots=%d %q, want %d", w.Code, w.Body.String(), http.StatusServiceUnavailable)
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+
+	tests := []struct {
+		url    string
+		header string
+		want   priority
+		err    bool
+	}{
+		{"/render/?target=a.b", "", priorityInteractive, false},
+		{"/render/?target=a.b&priority=bulk", "", priorityBulk, false},
+		{"/render/?target=a.b", "alerting", priorityAlerting, false},
+		{"/render/bulk/?target=a.b", "", priorityBulk, false},
+		{"/render/bulk/?target=a.b&priority=interactive", "alerting", priorityInteractive, false},
+		{"/render/bulk/?target=a.b", "alerting", priorityAlerting, false},
+		{"/render/?target=a.b&priority=urgent", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("X-Priority", tt.header)
+		}
+		p, err := requestPriority(r)
+		if (err != nil) != tt.err || err == nil && p != tt.want {
+			t.Errorf("requestPriority(%s, X-Priority: %q)=%v, %v want %v", tt.url, tt.header, p, err, tt.want)
+		}
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+
+	var now int64 = 1500000000
+	timeNow = func() time.Time { return time.Unix(now, 0) }
+	RateLimiter = newClientRateLimiter(0.5, 2)
+	clientHeader = "X-Api-Key"
+	defer func() {
+		timeNow = time.Now
+		RateLimiter = nil
+		clientHeader = ""
+	}()
+
+	handler := rateLimited(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		advance int64
+		client  string
+		key     string
+		code    int
+	}{
+		{0, "10.0.0.1:1234", "", http.StatusOK},
+		{0, "10.0.0.1:1235", "", http.StatusOK},
+		{0, "10.0.0.1:1236", "", http.StatusTooManyRequests},
+		// other clients have buckets of their own
+		{0, "10.0.0.2:1234", "", http.StatusOK},
+		{0, "10.0.0.1:1234", "secret", http.StatusOK},
+		// a token every two seconds
+		{1, "10.0.0.1:1234", "", http.StatusTooManyRequests},
+		{1, "10.0.0.1:1234", "", http.StatusOK},
+		{0, "10.0.0.1:1234", "", http.StatusTooManyRequests},
+	}
+
+	for i, tt := range tests {
+		now += tt.advance
+
+		r, _ := http.NewRequest("GET", "/render/?target=a.b", nil)
+		r.RemoteAddr = tt.client
+		if tt.key != "" {
+			r.Header.Set("X-Api-Key", tt.key)
+		}
+
+		limited := Metrics.RateLimited.Value()
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != tt.code {
+			t.Errorf("request %d from %s %q=%d, want %d", i, tt.client, tt.key, w.Code, tt.code)
+		}
+		var want int64
+		if tt.code == http.StatusTooManyRequests {
+			want = 1
+		}
+		if counted := Metrics.RateLimited.Value() - limited; counted != want {
+			t.Errorf("request %d from %s %q counted %d times as rate limited", i, tt.client, tt.key, counted)
+		}
+	}
+
+	// the buckets that have filled up are forgotten
+	now += 10
+	RateLimiter.clean()
+	if n := len(RateLimiter.buckets); n != 0 {
+		t.Errorf("clean left %d buckets", n)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	keys, _ := readAPIKeys(strings.NewReader("# keys\nk1 alice\n"))
+	passwords, _ := readHtpasswd(strings.NewReader("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\ncarol:secret\n"))
+	nets, _ := parseNetworks("10.0.0.0/8")
+
+	authenticators = []authenticator{keys, passwords, trustedProxy{header: "X-Forwarded-User", proxies: nets}}
+	defer func() {
+		authenticators = nil
+	}()
+
+	tests := []struct {
+		remote string
+		header string
+		value  string
+		user   string
+		pass   string
+		want   string
+		code   int
+	}{
+		{"192.168.0.1:1234", "X-Api-Key", "k1", "", "", "alice", http.StatusOK},
+		{"192.168.0.1:1234", "X-Api-Key", "k2", "", "", "", http.StatusUnauthorized},
+		{"192.168.0.1:1234", "", "", "bob", "password", "bob", http.StatusOK},
+		{"192.168.0.1:1234", "", "", "bob", "secret", "", http.StatusUnauthorized},
+		{"192.168.0.1:1234", "", "", "carol", "secret", "carol", http.StatusOK},
+		{"192.168.0.1:1234", "", "", "mallory", "secret", "", http.StatusUnauthorized},
+		{"10.1.2.3:1234", "X-Forwarded-User", "dave", "", "", "dave", http.StatusOK},
+		// only the proxy may say who the user is
+		{"192.168.0.1:1234", "X-Forwarded-User", "dave", "", "", "", http.StatusUnauthorized},
+		{"192.168.0.1:1234", "", "", "", "", "", http.StatusUnauthorized},
+	}
+
+	for i, tt := range tests {
+		r, _ := http.NewRequest("GET", "/render/?target=a.b", nil)
+		r.RemoteAddr = tt.remote
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+
+		failures := Metrics.AuthFailures.Value()
+		w := httptest.NewRecorder()
+		user, ok := authenticateRequest(w, r)
+
+		if user != tt.want || ok != (tt.code == http.StatusOK) || w.Code != tt.code {
+			t.Errorf("request %d: authenticated as %q, %v (%d), want %q (%d)", i, user, ok, w.Code, tt.want, tt.code)
+		}
+		if !ok && (Metrics.AuthFailures.Value() != failures+1 || w.Header().Get("WWW-Authenticate") == "") {
+			t.Errorf("request %d: failure not counted or no basic auth challenge", i)
+		}
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+
+	acls, err := readACLs(strings.NewReader("alice prod.web.{host1,host2} dev\nbob prod.db*\n* shared.*.cpu\n"))
+	if err != nil {
+		t.Fatalf("readACLs: %v", err)
+	}
+	metricACLs = acls
+	defer func() {
+		metricACLs = nil
+	}()
+
+	tests := []struct {
+		user string
+		path string
+		leaf bool
+		want bool
+	}{
+		{"alice", "prod.web.host1.requests", true, true},
+		{"alice", "prod.web.host3.requests", true, false},
+		{"alice", "dev.anything.at.all", true, true},
+		{"alice", "development.x", true, false},
+		// branches leading to the prefixes can be browsed
+		{"alice", "prod", false, true},
+		{"alice", "prod.web", false, true},
+		{"alice", "prod.web.host2", false, true},
+		{"alice", "prod.db1", false, false},
+		{"alice", "prod.web", true, false},
+		{"bob", "prod.db1.queries", true, true},
+		{"bob", "prod.web.host1.requests", true, false},
+		// everyone may see what's given to *
+		{"bob", "shared.host1.cpu", true, true},
+		{"carol", "shared.host1.cpu.user", true, true},
+		{"carol", "shared.host1.mem", true, false},
+		{"carol", "prod", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := aclAllows(tt.user, tt.path, tt.leaf); got != tt.want {
+			t.Errorf("aclAllows(%s, %s, leaf=%v)=%v, want %v", tt.user, tt.path, tt.leaf, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"alice", "alice prod.{web"} {
+		if _, err := readACLs(strings.NewReader(bad)); err == nil {
+			t.Errorf("readACLs(%q) succeeded, expected an error", bad)
+		}
+	}
+}
+
+func TestRenderACL(t *testing.T) {
+
+	queryCache = mapCache{}
+	findCache = nullCache{}
+
+	z := newTestZipper(map[string][]string{
+		"*.cpu":   {"team1.cpu", "team2.cpu"},
+		"team1.*": {"team1.cpu", "team1.mem", "team2.cpu"},
+		"team2.*": {"team2.cpu", "team2.mem", "team1.cpu"},
+	}, []float64{1})
+	authenticators = []authenticator{apiKeys{"k1": "alice", "k2": "bob"}}
+	metricACLs, _ = readACLs(strings.NewReader("alice team1\nbob team2\n"))
+	defer func() {
+		z.close()
+		authenticators = nil
+		metricACLs = nil
+	}()
+
+	// bob's render mustn't be answered from alice's cache entry
+	tests := []struct {
+		url  string
+		key  string
+		code int
+		want string
+	}{
+		{"/render/?target=*.cpu&from=1500000000&until=1500000060&format=raw", "k1", http.StatusOK, "team1.cpu,1500000000,1500000060,60|1\n"},
+		{"/render/?target=*.cpu&from=1500000000&until=1500000060&format=raw", "k2", http.StatusOK, "team2.cpu,1500000000,1500000060,60|1\n"},
+		{"/render/?target=*.cpu&from=1500000000&until=1500000060&format=raw", "", http.StatusUnauthorized, ""},
+		// the targets applyByNode builds are fetched for the same user
+		{"/render/?target=applyByNode(*.cpu,0,'sumSeries(%25.*)')&from=1500000000&until=1500000060&format=raw", "k1", http.StatusOK, "sumSeries(team1.*),1500000000,1500000060,60|2\n"},
+		{"/render/?target=applyByNode(*.cpu,0,'sumSeries(%25.*)')&from=1500000000&until=1500000060&format=raw", "k2", http.StatusOK, "sumSeries(team2.*),1500000000,1500000060,60|2\n"},
+		{"/metrics/find/?query=*.cpu&format=completer", "k1", http.StatusOK, `"path":"team1.cpu"`},
+		{"/metrics/find/?query=*.cpu&format=completer", "k2", http.StatusOK, `"path":"team2.cpu"`},
+		{"/metrics/find/?query=*.cpu&format=completer", "", http.StatusUnauthorized, ""},
+		{"/info/?target=team1.cpu", "k1", http.StatusOK, "info team1.cpu"},
+		{"/info/?target=team1.cpu", "k2", http.StatusForbidden, ""},
+		{"/info/?target=team1.cpu", "", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", tt.url, nil)
+		if tt.key != "" {
+			r.Header.Set("X-Api-Key", tt.key)
+		}
+		w := httptest.NewRecorder()
+		switch {
+		case strings.HasPrefix(tt.url, "/render/"):
+			renderHandler(w, r, &renderStats{})
+		case strings.HasPrefix(tt.url, "/info/"):
+			passthroughHandler(w, r)
+		default:
+			findHandler(w, r)
+		}
+
+		body := w.Body.String()
+		other := map[string]string{"k1": "team2", "k2": "team1"}[tt.key]
+		if w.Code != tt.code || !strings.Contains(body, tt.want) || other != "" && strings.Contains(body, other) {
+			t.Errorf("%s with key %q=%d %q, want %d %q", tt.url, tt.key, w.Code, body, tt.code, tt.want)
+		}
+	}
+}
+
 func getData(rangeSize int) []float64 {
 	var data = make([]float64, rangeSize)
 	var r = rand.New(rand.NewSource(99))
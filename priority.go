@@ -0,0 +1,142 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// render priorities
+//
+// Render requests are interactive, alerting or bulk, from the priority
+// parameter, the X-Priority header or a /render/<priority>/ path, in that
+// order, and are interactive if none of them says.  When the zipper is busy,
+// freed slots go to the waiting requests of the highest priority.  Each
+// priority may be limited to a number of slots with -priority-limits, and to
+// a time waiting for one with -priority-timeouts.
+
+type priority int
+
+const (
+	priorityInteractive priority = iota
+	priorityAlerting
+	priorityBulk
+
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"interactive", "alerting", "bulk"}
+
+func (p priority) String() string {
+	return priorityNames[p]
+}
+
+func parsePriority(s string) (priority, bool) {
+	for p, name := range priorityNames {
+		if s == name {
+			return priority(p), true
+		}
+	}
+	return 0, false
+}
+
+// priorityMetrics are the render requests and zipper queue timeouts of
+// each priority
+var priorityMetrics = func() (m [numPriorities]struct {
+	Requests      *expvar.Int
+	QueueTimeouts *expvar.Int
+}) {
+	for p := range m {
+		m[p].Requests = expvar.NewInt(priorityNames[p] + "_requests")
+		m[p].QueueTimeouts = expvar.NewInt(priorityNames[p] + "_queue_timeouts")
+	}
+	return m
+}()
+
+type ErrQueueTimeout struct {
+	Priority priority
+}
+
+func (e ErrQueueTimeout) Error() string {
+	return fmt.Sprintf("timed out waiting for the zipper at %s priority", e.Priority)
+}
+
+func writeQueueTimeoutError(w http.ResponseWriter, err error) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable)+": "+err.Error(), http.StatusServiceUnavailable)
+}
+
+// requestPriority returns the priority r asks for
+func requestPriority(r *http.Request) (priority, error) {
+
+	if s := r.FormValue("priority"); s != "" {
+		p, ok := parsePriority(s)
+		if !ok {
+			return 0, fmt.Errorf("unknown priority %q", s)
+		}
+		return p, nil
+	}
+
+	if s := r.Header.Get("X-Priority"); s != "" {
+		p, ok := parsePriority(s)
+		if !ok {
+			return 0, fmt.Errorf("unknown priority %q", s)
+		}
+		return p, nil
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/render"), "/")
+	if p, ok := parsePriority(path); ok {
+		return p, nil
+	}
+
+	return priorityInteractive, nil
+}
+
+// parsePriorityLimits parses a list like "alerting=10,bulk=4"
+func parsePriorityLimits(s string) (map[priority]int, error) {
+	list, err := parseAssignments(s)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := make(map[priority]int)
+	for name, v := range list {
+		p, ok := parsePriority(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown priority %q", name)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad limit %q for %s", v, name)
+		}
+		limits[p] = n
+	}
+
+	return limits, nil
+}
+
+// parsePriorityTimeouts parses a list like "bulk=1m,alerting=10s"
+func parsePriorityTimeouts(s string) (map[priority]time.Duration, error) {
+	list, err := parseAssignments(s)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := make(map[priority]time.Duration)
+	for name, v := range list {
+		p, ok := parsePriority(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown priority %q", name)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad timeout %q for %s", v, name)
+		}
+		timeouts[p] = d
+	}
+
+	return timeouts, nil
+}
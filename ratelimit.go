@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// per-client rate limits
+//
+// Each client gets a token bucket refilled at -client-rate requests a
+// second, holding at most -client-burst.  A request finding the bucket empty
+// gets a 429.  Clients are told apart by the -client-header header, such as
+// an API key or X-Forwarded-For, falling back to the source address.
+
+// clientHeader names the header identifying the client; empty means the
+// source address is used
+var clientHeader string
+
+// RateLimiter is nil if clients aren't rate limited
+var RateLimiter *clientRateLimiter
+
+// clientID returns the name of the client making r
+func clientID(r *http.Request) string {
+	if clientHeader != "" {
+		if id := r.Header.Get(clientHeader); id != "" {
+			return id
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type clientRateLimiter struct {
+	mu sync.Mutex
+
+	rate  float64
+	burst float64
+
+	buckets map[string]*tokenBucket
+}
+
+func newClientRateLimiter(rate float64, burst int) *clientRateLimiter {
+	return &clientRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// refill adds the tokens client earned since its bucket was last looked at
+func (c *clientRateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * c.rate
+	if b.tokens > c.burst {
+		b.tokens = c.burst
+	}
+	b.last = now
+}
+
+// allow takes a token from the bucket of client, returning false if it's empty
+func (c *clientRateLimiter) allow(client string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := timeNow()
+
+	b, ok := c.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: c.burst, last: now}
+		c.buckets[client] = b
+	}
+
+	c.refill(b, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// clean forgets the clients whose buckets have filled up again, which are
+// no different from new ones
+func (c *clientRateLimiter) clean() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := timeNow()
+	for client, b := range c.buckets {
+		c.refill(b, now)
+		if b.tokens >= c.burst {
+			delete(c.buckets, client)
+		}
+	}
+}
+
+func (c *clientRateLimiter) cleaner(every time.Duration) {
+	for range time.Tick(every) {
+		c.clean()
+	}
+}
+
+// rateLimited rejects requests from clients over their rate
+func rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RateLimiter != nil && !RateLimiter.allow(clientID(r)) {
+			Metrics.RateLimited.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(1/RateLimiter.rate)+1))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// parseClientWeights parses a list like "grafana=4,cron=1"
+func parseClientWeights(s string) (map[string]int, error) {
+	list, err := parseAssignments(s)
+	if err != nil {
+		return nil, err
+	}
+
+	weights := make(map[string]int)
+	for client, v := range list {
+		w, err := strconv.Atoi(v)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("bad weight %q for %s", v, client)
+		}
+		weights[client] = w
+	}
+
+	return weights, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// graphite-web is written in python, so dashboards use python's regexp
+// syntax.  RE2 understands most of it; the rest is either rewritten here or
+// rejected with an error naming the construct.
+
+type ErrUnsupportedRegexp struct {
+	Construct string
+}
+
+func (e ErrUnsupportedRegexp) Error() string {
+	return fmt.Sprintf("unsupported regexp construct %q", e.Construct)
+}
+
+var unsupportedRegexpGroups = []struct {
+	prefix string
+	what   string
+}{
+	{"(?=", "lookahead"},
+	{"(?!", "negative lookahead"},
+	{"(?<=", "lookbehind"},
+	{"(?<!", "negative lookbehind"},
+	{"(?P=", "named backreference"},
+	{"(?(", "conditional group"},
+}
+
+// compilePythonRegexp compiles a python regular expression
+func compilePythonRegexp(pattern string) (*regexp.Regexp, error) {
+	translated, err := translatePythonRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile(translated)
+}
+
+func translatePythonRegexp(pattern string) (string, error) {
+
+	var b bytes.Buffer
+
+	inClass := false
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			next := pattern[i+1]
+			i++
+
+			switch {
+			case inClass:
+				b.WriteByte(c)
+				b.WriteByte(next)
+			case '1' <= next && next <= '9':
+				return "", ErrUnsupportedRegexp{Construct: pattern[i-1:i+1] + " (backreference)"}
+			case next == 'Z':
+				// python's end of string
+				b.WriteString(`\z`)
+			default:
+				b.WriteByte(c)
+				b.WriteByte(next)
+			}
+
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteByte(c)
+
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+			// a ']' right at the start of the class is a literal
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+				b.WriteByte('^')
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+				b.WriteString(`\]`)
+			}
+
+		case c == '(' && strings.HasPrefix(pattern[i:], "(?#"):
+			// comments are dropped
+			end := strings.IndexByte(pattern[i:], ')')
+			if end == -1 {
+				return "", ErrUnsupportedRegexp{Construct: "(?#"}
+			}
+			i += end
+
+		case c == '(' && strings.HasPrefix(pattern[i:], "(?"):
+			for _, g := range unsupportedRegexpGroups {
+				if strings.HasPrefix(pattern[i:], g.prefix) {
+					return "", ErrUnsupportedRegexp{Construct: g.prefix + " (" + g.what + ")"}
+				}
+			}
+			b.WriteByte(c)
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// pythonReplacement rewrites the backreferences of a python replacement
+// string (\1, \g<1>, \g<name>) into the form used by regexp.Expand.  Go's
+// own $1 keeps working, as carbonapi has always accepted it.
+func pythonReplacement(repl string) string {
+
+	var b bytes.Buffer
+
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+
+		if c != '\\' || i+1 == len(repl) {
+			b.WriteByte(c)
+			continue
+		}
+
+		next := repl[i+1]
+
+		switch {
+		case '1' <= next && next <= '9':
+			j := i + 2
+			// python allows two digit group numbers
+			if j < len(repl) && '0' <= repl[j] && repl[j] <= '9' {
+				j++
+			}
+			b.WriteString("${" + repl[i+1:j] + "}")
+			i = j - 1
+
+		case next == 'g' && i+2 < len(repl) && repl[i+2] == '<':
+			end := strings.IndexByte(repl[i:], '>')
+			if end == -1 {
+				b.WriteByte(c)
+				continue
+			}
+			b.WriteString("${" + repl[i+3:i+end] + "}")
+			i += end
+
+		case next == '\\':
+			b.WriteByte('\\')
+			i++
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
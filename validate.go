@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// semantic validation of parsed targets
+//
+// evalExpr only finds out about bad arguments after everything has been
+// fetched.  validateExpr checks every call against the signature of its
+// function first, so typos are rejected before we talk to the zipper.
+
+type argType int
+
+const (
+	argSeries argType = iota
+	argNumber
+	argString
+	argInterval
+	argWindow // a number of points or an interval
+	argBool
+	argName // a name for a generated series, quoted or not
+	argRegexp
+	argSummary // a function understood by summarizeValues
+	argSeriesOrNumber
+)
+
+var argTypeNames = map[argType]string{
+	argSeries:         "series",
+	argNumber:         "number",
+	argString:         "string",
+	argInterval:       "interval",
+	argWindow:         "number of points or interval",
+	argBool:           "boolean",
+	argName:           "name",
+	argRegexp:         "regular expression",
+	argSummary:        "summary function",
+	argSeriesOrNumber: "series or number",
+}
+
+type signature struct {
+	names    []string // as in graphite-web, for keyword arguments
+	args     []argType
+	required int
+	variadic bool // the last argument may be repeated
+}
+
+// sig is a signature whose first required arguments must be given
+func sig(required int, names string, args ...argType) signature {
+	return signature{names: strings.Split(names, ", "), args: args, required: required}
+}
+
+// varsig is a signature whose last argument may be repeated
+func varsig(required int, names string, args ...argType) signature {
+	return signature{names: strings.Split(names, ", "), args: args, required: required, variadic: true}
+}
+
+// optional reports whether argument n has a default, which the repeated
+// last argument of a varsig doesn't
+func (s signature) optional(n int) bool {
+	return n >= s.required && !(s.variadic && n >= len(s.args)-1)
+}
+
+// paramName returns the name of argument n of function f, or "" if it can
+// only be given by position
+func paramName(f string, n int) string {
+	s, ok := functionSignatures[f]
+	if !ok || n >= len(s.names) || s.variadic && n == len(s.names)-1 {
+		return ""
+	}
+	return s.names[n]
+}
+
+// paramIndex is the reverse of paramName
+func paramIndex(f string, name string) int {
+	for i := range functionSignatures[f].names {
+		if paramName(f, i) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+var functionSignatures = map[string]signature{
+	"absolute":                   sig(1, "seriesList", argSeries),
+	"alias":                      sig(2, "seriesList, newName", argSeries, argString),
+	"aliasByMetric":              sig(1, "seriesList", argSeries),
+	"aliasByNode":                varsig(2, "seriesList, nodes", argSeries, argNumber),
+	"aliasQuery":                 sig(4, "seriesList, search, replace, newName", argSeries, argRegexp, argString, argString),
+	"aliasSub":                   sig(3, "seriesList, search, replace", argSeries, argRegexp, argString),
+	"aliasTemplate":              sig(2, "seriesList, template", argSeries, argString),
+	"applyByNode":                sig(3, "seriesList, nodeNum, templateFunction, newName", argSeries, argNumber, argString, argString),
+	"asPercent":                  varsig(1, "seriesList, total, nodes", argSeries, argSeriesOrNumber, argNumber),
+	"averageAbove":               sig(2, "seriesList, n", argSeries, argNumber),
+	"averageBelow":               sig(2, "seriesList, n", argSeries, argNumber),
+	"averageSeries":              varsig(1, "seriesLists", argSeries),
+	"averageSeriesWithWildcards": varsig(2, "seriesList, position", argSeries, argNumber),
+	"avg":                        varsig(1, "seriesLists", argSeries),
+	"changed":                    sig(1, "seriesList", argSeries),
+	"checkEqual":                 sig(2, "seriesList, series", argSeries, argSeries),
+	"checkGreater":               sig(2, "seriesList, series", argSeries, argSeries),
+	"checkGreaterEqual":          sig(2, "seriesList, series", argSeries, argSeries),
+	"checkLess":                  sig(2, "seriesList, series", argSeries, argSeries),
+	"checkLessEqual":             sig(2, "seriesList, series", argSeries, argSeries),
+	"checkVariance":              sig(3, "seriesList, acceptableStdevs, windows", argSeries, argNumber, argNumber),
+	"color":                      sig(2, "seriesList, theColor", argSeries, argString),
+	"constantLine":               sig(1, "value", argNumber),
+	"countSeries":                varsig(0, "seriesLists", argSeries),
+	"currentAbove":               sig(2, "seriesList, n", argSeries, argNumber),
+	"currentBelow":               sig(2, "seriesList, n", argSeries, argNumber),
+	"dashed":                     sig(1, "seriesList, dashLength", argSeries, argNumber),
+	"delay":                      sig(2, "seriesList, steps", argSeries, argNumber),
+	"derivative":                 sig(1, "seriesList", argSeries),
+	"derivativeByInterval":       sig(2, "seriesList, intervalUnit", argSeries, argInterval),
+	"diffSeries":                 varsig(2, "seriesLists", argSeries),
+	"diffSeriesLists":            sig(2, "seriesListFirstPos, seriesListSecondPos", argSeries, argSeries),
+	"divideSeries":               sig(2, "dividendSeriesList, divisorSeriesList", argSeries, argSeries),
+	"divideSeriesLists":          sig(2, "dividendSeriesList, divisorSeriesList", argSeries, argSeries),
+	"drawAsInfinite":             sig(1, "seriesList", argSeries),
+	"exclude":                    sig(2, "seriesList, pattern", argSeries, argRegexp),
+	"exponentialMovingAverage":   sig(2, "seriesList, windowSize", argSeries, argWindow),
+	"fallbackSeries":             sig(2, "seriesList, fallback", argSeries, argSeries),
+	"filterSeries":               sig(4, "seriesList, func, operator, threshold", argSeries, argSummary, argString, argNumber),
+	"grep":                       sig(2, "seriesList, pattern", argSeries, argRegexp),
+	"group":                      varsig(1, "seriesLists", argSeries),
+	"groupByNode":                sig(3, "seriesList, nodeNum, callback", argSeries, argNumber, argString),
+	"highest":                    sig(1, "seriesList, n, func", argSeries, argNumber, argSummary),
+	"highestAverage":             sig(2, "seriesList, n", argSeries, argNumber),
+	"highestCurrent":             sig(2, "seriesList, n", argSeries, argNumber),
+	"highestMax":                 sig(2, "seriesList, n", argSeries, argNumber),
+	"hitcount":                   sig(2, "seriesList, intervalString, alignToInterval", argSeries, argInterval, argBool),
+	"holtWintersAberration":      sig(1, "seriesList, delta", argSeries, argNumber),
+	"holtWintersConfidenceArea":  sig(1, "seriesList, delta", argSeries, argNumber),
+	"holtWintersConfidenceBands": sig(1, "seriesList, delta", argSeries, argNumber),
+	"holtWintersForecast":        sig(1, "seriesList", argSeries),
+	"identity":                   sig(1, "name", argName),
+	"integral":                   sig(1, "seriesList", argSeries),
+	"integralByInterval":         sig(2, "seriesList, intervalUnit", argSeries, argInterval),
+	"interpolate":                sig(1, "seriesList, limit", argSeries, argNumber),
+	"invert":                     sig(1, "seriesList", argSeries),
+	"isNonNull":                  sig(1, "seriesList", argSeries),
+	"isNotNull":                  sig(1, "seriesList", argSeries),
+	"keepLastValue":              sig(1, "seriesList, limit", argSeries, argNumber),
+	"kolmogorovSmirnovTest2":     sig(3, "seriesList1, seriesList2, windowSize", argSeries, argSeries, argNumber),
+	"ksTest2":                    sig(3, "seriesList1, seriesList2, windowSize", argSeries, argSeries, argNumber),
+	"legendValue":                varsig(2, "seriesList, valueTypes", argSeries, argString),
+	"limit":                      sig(2, "seriesList, n", argSeries, argNumber),
+	"linearRegression":           sig(1, "seriesList, startSourceAt, endSourceAt", argSeries, argString, argString),
+	"log":                        sig(1, "seriesList, base", argSeries, argNumber),
+	"logarithm":                  sig(1, "seriesList, base", argSeries, argNumber),
+	"lowest":                     sig(1, "seriesList, n, func", argSeries, argNumber, argSummary),
+	"lowestAverage":              sig(2, "seriesList, n", argSeries, argNumber),
+	"lowestCurrent":              sig(2, "seriesList, n", argSeries, argNumber),
+	"mapSeries":                  varsig(2, "seriesList, nodes", argSeries, argNumber),
+	"maxDataPoints":              sig(2, "seriesList, maxDataPoints", argSeries, argNumber),
+	"maxSeries":                  varsig(1, "seriesLists", argSeries),
+	"maximumAbove":               sig(2, "seriesList, n", argSeries, argNumber),
+	"maximumBelow":               sig(2, "seriesList, n", argSeries, argNumber),
+	"minMax":                     sig(1, "seriesList", argSeries),
+	"minSeries":                  varsig(1, "seriesLists", argSeries),
+	"minimumAbove":               sig(2, "seriesList, n", argSeries, argNumber),
+	"minimumBelow":               sig(2, "seriesList, n", argSeries, argNumber),
+	"mostDeviant":                sig(2, "n, seriesList", argNumber, argSeries),
+	"movingAverage":              sig(2, "seriesList, windowSize", argSeries, argWindow),
+	"movingMax":                  sig(2, "seriesList, windowSize", argSeries, argWindow),
+	"movingMedian":               sig(2, "seriesList, windowSize", argSeries, argWindow),
+	"movingMin":                  sig(2, "seriesList, windowSize", argSeries, argWindow),
+	"movingSum":                  sig(2, "seriesList, windowSize", argSeries, argWindow),
+	"movingWindow":               sig(2, "seriesList, windowSize, func, xFilesFactor", argSeries, argWindow, argSummary, argNumber),
+	"multiplySeries":             varsig(1, "seriesLists", argSeries),
+	"multiplySeriesLists":        sig(2, "seriesListFirstPos, seriesListSecondPos", argSeries, argSeries),
+	"nPercentile":                sig(2, "seriesList, n", argSeries, argNumber),
+	"nonNegativeDerivative":      sig(1, "seriesList, maxValue, minValue", argSeries, argNumber, argNumber),
+	"offset":                     sig(2, "seriesList, factor", argSeries, argNumber),
+	"offsetToZero":               sig(1, "seriesList", argSeries),
+	"pearson":                    sig(3, "seriesList1, seriesList2, windowSize", argSeries, argSeries, argNumber),
+	"pearsonClosest":             sig(3, "series, seriesList, n, direction", argSeries, argSeries, argNumber, argString),
+	"perSecond":                  sig(1, "seriesList, maxValue, minValue", argSeries, argNumber, argNumber),
+	"percentileOfSeries":         sig(2, "seriesList, n, interpolate", argSeries, argNumber, argBool),
+	"pow":                        sig(2, "seriesList, factor", argSeries, argNumber),
+	"randomWalk":                 sig(1, "name, step", argName, argNumber),
+	"reduceSeries":               varsig(4, "seriesLists, reduceFunction, reduceNode, reduceMatchers", argSeries, argString, argNumber, argString),
+	"removeAboveValue":           sig(2, "seriesList, n", argSeries, argNumber),
+	"removeBelowValue":           sig(2, "seriesList, n", argSeries, argNumber),
+	"removeBetweenPercentile":    sig(2, "seriesList, n", argSeries, argNumber),
+	"removeEmptySeries":          sig(1, "seriesList, xFilesFactor", argSeries, argNumber),
+	"removeZeroSeries":           sig(1, "seriesList, xFilesFactor", argSeries, argNumber),
+	"scale":                      sig(2, "seriesList, factor", argSeries, argNumber),
+	"scaleToSeconds":             sig(2, "seriesList, seconds", argSeries, argNumber),
+	"secondYAxis":                sig(1, "seriesList", argSeries),
+	"seriesByGlob":               sig(2, "seriesList, pattern", argSeries, argString),
+	"severity":                   sig(2, "seriesList, severity", argSeries, argNumber),
+	"sinFunction":                sig(1, "name, amplitude, step", argName, argNumber, argNumber),
+	"sortBy":                     sig(1, "seriesList, func, reverse", argSeries, argSummary, argBool),
+	"sortByMaxima":               sig(1, "seriesList", argSeries),
+	"sortByMinima":               sig(1, "seriesList", argSeries),
+	"sortByName":                 sig(1, "seriesList", argSeries),
+	"sortByTotal":                sig(1, "seriesList", argSeries),
+	"squareRoot":                 sig(1, "seriesList", argSeries),
+	"stddev":                     sig(2, "seriesList, points, missingThreshold", argSeries, argWindow, argNumber),
+	"stdev":                      sig(2, "seriesList, points, missingThreshold", argSeries, argWindow, argNumber),
+	"sum":                        varsig(1, "seriesLists", argSeries),
+	"sumSeries":                  varsig(1, "seriesLists", argSeries),
+	"sumSeriesLists":             sig(2, "seriesListFirstPos, seriesListSecondPos", argSeries, argSeries),
+	"sumSeriesWithWildcards":     varsig(2, "seriesList, position", argSeries, argNumber),
+	"summarize":                  sig(2, "seriesList, intervalString, func, alignToFrom", argSeries, argInterval, argString, argBool),
+	"timeFunction":               sig(1, "name, step", argName, argNumber),
+	"timeShift":                  sig(2, "seriesList, timeShift, resetEnd", argSeries, argInterval, argBool),
+	"timeSlice":                  sig(2, "seriesList, startSliceAt, endSliceAt", argSeries, argString, argString),
+	"timeStack":                  sig(1, "seriesList, timeShiftUnit, timeShiftStart, timeShiftEnd", argSeries, argInterval, argNumber, argNumber),
+	"transformNull":              sig(1, "seriesList, default", argSeries, argNumber),
+	"tukeyAbove":                 sig(4, "seriesList, interval, basis, n", argSeries, argWindow, argNumber, argNumber),
+	"unique":                     varsig(1, "seriesLists", argSeries),
+	"useSeriesAbove":             sig(4, "seriesList, value, search, replace", argSeries, argNumber, argRegexp, argString),
+}
+
+// ErrInvalidCall describes a call which doesn't match the signature of its
+// function.  Arguments are numbered from 1; 0 is the call as a whole.  Pos is
+// the offset in the target of the offending call or argument.
+type ErrInvalidCall struct {
+	Function string
+	Arg      int
+	Reason   string
+	Pos      int
+}
+
+func (e ErrInvalidCall) Error() string {
+	if e.Arg == 0 {
+		return fmt.Sprintf("%s: %s", e.Function, e.Reason)
+	}
+	return fmt.Sprintf("%s: argument %d: %s", e.Function, e.Arg, e.Reason)
+}
+
+// validateExpr checks every function call in e against its signature
+func validateExpr(e *expr) error {
+
+	if e.etype != etFunc {
+		return nil
+	}
+
+	s, ok := functionSignatures[e.target]
+	if !ok {
+		return ErrInvalidCall{Function: e.target, Reason: "unknown function", Pos: e.pos}
+	}
+
+	for i := len(e.args); i < s.required; i++ {
+		name := paramName(e.target, i)
+		if e.namedArgs[name] != nil {
+			continue
+		}
+		if name == "" || len(e.namedArgs) == 0 {
+			return ErrInvalidCall{Function: e.target, Reason: fmt.Sprintf("expected at least %d arguments, got %d", s.required, len(e.args)), Pos: e.pos}
+		}
+		return ErrInvalidCall{Function: e.target, Reason: fmt.Sprintf("missing argument %q", name), Pos: e.pos}
+	}
+
+	if !s.variadic && len(e.args) > len(s.args) {
+		return ErrInvalidCall{Function: e.target, Reason: fmt.Sprintf("expected at most %d arguments, got %d", len(s.args), len(e.args)), Pos: e.pos}
+	}
+
+	for i, a := range e.args {
+		t := s.args[len(s.args)-1]
+		if i < len(s.args) {
+			t = s.args[i]
+		}
+
+		if err := validateArg(a, t, s.optional(i)); err != nil {
+			return ErrInvalidCall{Function: e.target, Arg: i + 1, Reason: err.Error(), Pos: a.pos}
+		}
+
+		if err := validateExpr(a); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for name := range e.namedArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		a := e.namedArgs[name]
+		i := paramIndex(e.target, name)
+		if i == -1 {
+			return ErrInvalidCall{Function: e.target, Reason: fmt.Sprintf("unknown keyword argument %q", name), Pos: a.pos}
+		}
+		if i < len(e.args) {
+			return ErrInvalidCall{Function: e.target, Reason: fmt.Sprintf("argument %q given by position and by name", name), Pos: a.pos}
+		}
+
+		if err := validateArg(a, s.args[i], s.optional(i)); err != nil {
+			return ErrInvalidCall{Function: e.target, Arg: i + 1, Reason: err.Error(), Pos: a.pos}
+		}
+
+		if err := validateExpr(a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateArg checks a is of type t.  None may be given for optional numbers.
+func validateArg(a *expr, t argType, optional bool) error {
+
+	var ok bool
+
+	switch t {
+	case argSeries:
+		ok = a.etype == etName || a.etype == etFunc
+	case argNumber:
+		ok = a.etype == etConst || optional && isNone(a)
+	case argString:
+		ok = a.etype == etString
+	case argInterval:
+		if a.etype == etString {
+			return validateInterval(a.valStr)
+		}
+	case argWindow:
+		if a.etype == etString {
+			return validateInterval(a.valStr)
+		}
+		ok = a.etype == etConst
+	case argBool:
+		switch a.target {
+		case "True", "true", "False", "false":
+			ok = a.etype == etName
+		}
+	case argName:
+		ok = a.etype == etName || a.etype == etString
+	case argRegexp:
+		if a.etype == etString {
+			_, err := compilePythonRegexp(a.valStr)
+			return err
+		}
+	case argSummary:
+		if a.etype == etString && !isSummaryFunc(a.valStr) {
+			return fmt.Errorf("unknown summary function %q", a.valStr)
+		}
+		ok = a.etype == etString
+	case argSeriesOrNumber:
+		ok = a.etype == etName || a.etype == etFunc || a.etype == etConst
+	}
+
+	if !ok {
+		return fmt.Errorf("expected %s", argTypeNames[t])
+	}
+
+	return nil
+}
+
+func validateInterval(s string) error {
+	if s == "" {
+		return fmt.Errorf("empty interval")
+	}
+	_, err := intervalString(s, 1)
+	return err
+}